@@ -19,6 +19,6 @@ if [ ! -f "$DB_DIR/isucon8q-initial-dataset.sql.gz" ]; then
   exit 1
 fi
 
-mysql -h ${DB_HOST} -uisucon torb -e 'ALTER TABLE reservations DROP KEY event_id_and_sheet_id_idx'
+mysql -h ${DB_HOST} -uisucon torb -e 'ALTER TABLE reservations DROP KEY event_id_and_sheet_id_idx, DROP KEY event_id_and_sheet_id_active_uniq'
 gzip -dc "$DB_DIR/isucon8q-initial-dataset.sql.gz" | mysql -h ${DB_HOST} -uisucon torb
-mysql -h ${DB_HOST} -uisucon torb -e 'ALTER TABLE reservations ADD KEY event_id_and_sheet_id_idx (event_id, sheet_id)'
+mysql -h ${DB_HOST} -uisucon torb -e 'ALTER TABLE reservations ADD KEY event_id_and_sheet_id_idx (event_id, sheet_id), ADD UNIQUE KEY event_id_and_sheet_id_active_uniq (event_id, sheet_id, active)'
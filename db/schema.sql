@@ -11,15 +11,30 @@ CREATE TABLE IF NOT EXISTS events (
     title       VARCHAR(128)     NOT NULL,
     public_fg   TINYINT(1)       NOT NULL,
     closed_fg   TINYINT(1)       NOT NULL,
-    price       INTEGER UNSIGNED NOT NULL
+    price       INTEGER UNSIGNED NOT NULL,
+    venue_id    INTEGER UNSIGNED NOT NULL DEFAULT 1,
+    allocation  VARCHAR(1024)    DEFAULT NULL,
+    limits      VARCHAR(1024)    DEFAULT NULL,
+    schedule    VARCHAR(255)     DEFAULT NULL,
+    pricing     VARCHAR(1024)    DEFAULT NULL,
+    cancellation VARCHAR(1024)   DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS venues (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    name        VARCHAR(128)     NOT NULL
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+INSERT IGNORE INTO venues (id, name) VALUES (1, 'default');
+
 CREATE TABLE IF NOT EXISTS sheets (
     id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    venue_id    INTEGER UNSIGNED NOT NULL DEFAULT 1,
     `rank`      VARCHAR(128)     NOT NULL,
     num         INTEGER UNSIGNED NOT NULL,
     price       INTEGER UNSIGNED NOT NULL,
-    UNIQUE KEY rank_num_uniq (`rank`, num)
+    retired_fg  TINYINT(1)       NOT NULL DEFAULT 0,
+    UNIQUE KEY venue_rank_num_uniq (venue_id, `rank`, num)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE IF NOT EXISTS reservations (
@@ -29,7 +44,28 @@ CREATE TABLE IF NOT EXISTS reservations (
     user_id     INTEGER UNSIGNED NOT NULL,
     reserved_at DATETIME(6)      NOT NULL,
     canceled_at DATETIME(6)      DEFAULT NULL,
-    KEY event_id_and_sheet_id_idx (event_id, sheet_id)
+    expires_at  DATETIME(6)      DEFAULT NULL,
+    price       INTEGER UNSIGNED DEFAULT NULL,
+    base_price  INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    rank_price  INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    adjustment  INTEGER          NOT NULL DEFAULT 0,
+    discount    INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    promo_id    INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    cancel_fee  INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    active      TINYINT(1)       AS (IF(canceled_at IS NULL, 1, NULL)) STORED,
+    KEY event_id_and_sheet_id_idx (event_id, sheet_id),
+    KEY expires_at_idx (expires_at),
+    KEY promo_id_idx (promo_id),
+    UNIQUE KEY event_id_and_sheet_id_active_uniq (event_id, sheet_id, active)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS waitlist (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id    INTEGER UNSIGNED NOT NULL,
+    `rank`      VARCHAR(128)     NOT NULL,
+    user_id     INTEGER UNSIGNED NOT NULL,
+    created_at  DATETIME(6)      NOT NULL,
+    UNIQUE KEY event_id_rank_user_id_uniq (event_id, `rank`, user_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE IF NOT EXISTS administrators (
@@ -39,3 +75,70 @@ CREATE TABLE IF NOT EXISTS administrators (
     pass_hash   VARCHAR(128) NOT NULL,
     UNIQUE KEY login_name_uniq (login_name)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS event_transitions (
+    id            INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id      INTEGER UNSIGNED NOT NULL,
+    public_fg     TINYINT(1)       NOT NULL,
+    closed_fg     TINYINT(1)       NOT NULL,
+    run_at        DATETIME(6)      NOT NULL,
+    scheduled_by  INTEGER UNSIGNED NOT NULL,
+    created_at    DATETIME(6)      NOT NULL,
+    done_at       DATETIME(6)      DEFAULT NULL,
+    canceled_fg   TINYINT(1)       NOT NULL DEFAULT 0,
+    error_message VARCHAR(255)     NOT NULL DEFAULT '',
+    KEY event_id_idx (event_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS settings (
+    name        VARCHAR(64)      PRIMARY KEY,
+    value       VARCHAR(1024)    NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS changes (
+    id          BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    op          VARCHAR(32)      NOT NULL,
+    data        TEXT             NOT NULL,
+    created_at  DATETIME(6)      NOT NULL,
+    KEY created_at_idx (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS promo_codes (
+    id                INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    code              VARCHAR(64)      NOT NULL,
+    kind              VARCHAR(16)      NOT NULL,
+    value             INTEGER UNSIGNED NOT NULL,
+    scope             VARCHAR(1024)    NOT NULL,
+    max_uses          INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    max_uses_per_user INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    expires_at        DATETIME(6)      DEFAULT NULL,
+    disabled_fg       TINYINT(1)       NOT NULL DEFAULT 0,
+    created_at        DATETIME(6)      NOT NULL,
+    UNIQUE KEY code_uniq (code)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS transfers (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    reservation_id INTEGER UNSIGNED NOT NULL,
+    event_id       INTEGER UNSIGNED NOT NULL,
+    from_user_id   INTEGER UNSIGNED NOT NULL,
+    to_user_id     INTEGER UNSIGNED NOT NULL,
+    created_at     DATETIME(6)      NOT NULL,
+    done_at        DATETIME(6)      DEFAULT NULL,
+    accepted_fg    TINYINT(1)       NOT NULL DEFAULT 0,
+    KEY reservation_id_idx (reservation_id),
+    KEY from_user_id_idx (from_user_id),
+    KEY to_user_id_idx (to_user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id      INTEGER UNSIGNED NOT NULL,
+    idem_key     VARCHAR(255)     NOT NULL,
+    fingerprint  CHAR(64)         NOT NULL,
+    status       SMALLINT         NOT NULL DEFAULT 0,
+    content_type VARCHAR(128)     NOT NULL DEFAULT '',
+    body         MEDIUMBLOB       DEFAULT NULL,
+    expires_at   DATETIME(6)      NOT NULL,
+    PRIMARY KEY (user_id, idem_key),
+    KEY expires_at_idx (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
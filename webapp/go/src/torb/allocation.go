@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSeatsPerReservation caps how many seats one request can book.
+const maxSeatsPerReservation = 6
+
+// SeatRun is a stretch of free, neighbouring sheets: sheets[Start:End].
+type SeatRun struct {
+	Start, End int
+}
+
+// SeatAllocator decides where seats the customer did not choose go. Place
+// gets the runs, in num order, that can fit count seats and returns the
+// index of the sheet the group starts at.
+type SeatAllocator interface {
+	Place(runs []SeatRun, count int) int
+}
+
+// randomAllocator picks uniformly among every place the group fits, so that
+// concurrent customers rarely race for the same seats.
+type randomAllocator struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newRandomAllocator(src rand.Source) *randomAllocator {
+	return &randomAllocator{rnd: rand.New(src)}
+}
+
+func (a *randomAllocator) Place(runs []SeatRun, count int) int {
+	windows := 0
+	for _, r := range runs {
+		windows += r.End - r.Start - count + 1
+	}
+	a.mu.Lock()
+	w := a.rnd.Intn(windows)
+	a.mu.Unlock()
+	for _, r := range runs {
+		n := r.End - r.Start - count + 1
+		if w < n {
+			return r.Start + w
+		}
+		w -= n
+	}
+	return runs[0].Start
+}
+
+// bestAvailableAllocator fills the lowest numbers first.
+type bestAvailableAllocator struct{}
+
+func (bestAvailableAllocator) Place(runs []SeatRun, count int) int {
+	return runs[0].Start
+}
+
+// fillFromBackAllocator fills the highest numbers first.
+type fillFromBackAllocator struct{}
+
+func (fillFromBackAllocator) Place(runs []SeatRun, count int) int {
+	return runs[len(runs)-1].End - count
+}
+
+// balancedAllocator spreads customers out by seating each group in the
+// middle of the widest free stretch.
+type balancedAllocator struct{}
+
+func (balancedAllocator) Place(runs []SeatRun, count int) int {
+	widest := runs[0]
+	for _, r := range runs[1:] {
+		if r.End-r.Start > widest.End-widest.Start {
+			widest = r
+		}
+	}
+	return widest.Start + (widest.End-widest.Start-count)/2
+}
+
+var seatAllocators = map[string]SeatAllocator{
+	"random":         newRandomAllocator(seatAllocatorSource()),
+	"best_available": bestAvailableAllocator{},
+	"fill_from_back": fillFromBackAllocator{},
+	"balanced":       balancedAllocator{},
+}
+
+// seatAllocatorSource seeds the random allocator from SEAT_STRATEGY_SEED
+// when it is set, so runs can be reproduced.
+func seatAllocatorSource() rand.Source {
+	if seed := GetenvInt("SEAT_STRATEGY_SEED", 0); seed != 0 {
+		return rand.NewSource(int64(seed))
+	}
+	return rand.NewSource(time.Now().UnixNano())
+}
+
+var defaultSeatStrategy = Getenv("SEAT_STRATEGY", "random")
+
+var errUnknownSeatStrategy = errors.New("unknown seat strategy")
+
+// SeatPolicy names the strategies an event allocates seats with. Ranks
+// overrides Default for single ranks; whatever is left empty falls back to
+// SEAT_STRATEGY. It is stored as JSON in events.allocation.
+type SeatPolicy struct {
+	Default string            `json:"default,omitempty"`
+	Ranks   map[string]string `json:"ranks,omitempty"`
+}
+
+func (p *SeatPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if _, ok := seatAllocators[p.Default]; p.Default != "" && !ok {
+		return errUnknownSeatStrategy
+	}
+	for _, name := range p.Ranks {
+		if _, ok := seatAllocators[name]; !ok {
+			return errUnknownSeatStrategy
+		}
+	}
+	return nil
+}
+
+// Allocator returns the strategy for a rank. A nil policy is allowed.
+func (p *SeatPolicy) Allocator(rank string) SeatAllocator {
+	name := defaultSeatStrategy
+	if p != nil {
+		if n, ok := p.Ranks[rank]; ok {
+			name = n
+		} else if p.Default != "" {
+			name = p.Default
+		}
+	}
+	if a, ok := seatAllocators[name]; ok {
+		return a
+	}
+	return seatAllocators["random"]
+}
+
+func (p *SeatPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+func (p SeatPolicy) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
+func (p *SeatPolicy) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, p)
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	}
+	return fmt.Errorf("cannot scan %T into SeatPolicy", src)
+}
+
+// pickSeats chooses count free sheets from sheets, which must be in num
+// order. It seats the group together where the allocator says if it can;
+// failing that it fills up from the longest free stretches. It returns nil if
+// fewer than count sheets are free.
+func pickSeats(sheets []*Sheet, count int, taken func(sheetID int64) bool, alloc SeatAllocator) []int64 {
+	var runs []SeatRun
+	free := 0
+	for i, s := range sheets {
+		if taken(s.ID) {
+			continue
+		}
+		free++
+		if n := len(runs); n > 0 && runs[n-1].End == i && sheets[i-1].Num+1 == s.Num {
+			runs[n-1].End++
+			continue
+		}
+		runs = append(runs, SeatRun{i, i + 1})
+	}
+	if count <= 0 || free < count {
+		return nil
+	}
+
+	var fits []SeatRun
+	for _, r := range runs {
+		if r.End-r.Start >= count {
+			fits = append(fits, r)
+		}
+	}
+	if len(fits) > 0 {
+		start := alloc.Place(fits, count)
+		return sheetIDs(sheets[start : start+count])
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].End-runs[i].Start > runs[j].End-runs[j].Start })
+	ids := make([]int64, 0, count)
+	for _, r := range runs {
+		for _, s := range sheets[r.Start:r.End] {
+			if len(ids) == count {
+				return ids
+			}
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids
+}
+
+func sheetIDs(sheets []*Sheet) []int64 {
+	ids := make([]int64, len(sheets))
+	for i, s := range sheets {
+		ids[i] = s.ID
+	}
+	return ids
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// testSheets returns sheets with the given nums. Sheet n has ID 100+n.
+func testSheets(nums ...int64) []*Sheet {
+	sheets := make([]*Sheet, len(nums))
+	for i, n := range nums {
+		sheets[i] = &Sheet{ID: 100 + n, Rank: "S", Num: n}
+	}
+	return sheets
+}
+
+func oneToTen() []*Sheet {
+	return testSheets(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+}
+
+// takenNums marks sheets as taken by num.
+func takenNums(nums ...int64) func(int64) bool {
+	taken := make(map[int64]bool)
+	for _, n := range nums {
+		taken[100+n] = true
+	}
+	return func(id int64) bool { return taken[id] }
+}
+
+func TestPickSeats(t *testing.T) {
+	tests := []struct {
+		name     string
+		sheets   []*Sheet
+		taken    []int64
+		count    int
+		strategy string
+		want     []int64
+	}{
+		{"best available", oneToTen(), nil, 3, "best_available", []int64{101, 102, 103}},
+		{"best available skips taken", oneToTen(), []int64{1, 2, 5}, 2, "best_available", []int64{103, 104}},
+		{"best available keeps the group together", oneToTen(), []int64{2, 4}, 3, "best_available", []int64{105, 106, 107}},
+		{"fill from back", oneToTen(), nil, 2, "fill_from_back", []int64{109, 110}},
+		{"fill from back keeps the group together", oneToTen(), []int64{9}, 2, "fill_from_back", []int64{107, 108}},
+		{"balanced", oneToTen(), nil, 2, "balanced", []int64{105, 106}},
+		{"balanced picks the widest run", oneToTen(), []int64{3}, 2, "balanced", []int64{106, 107}},
+		{"retired sheet splits a run", testSheets(1, 2, 4, 5, 6), nil, 3, "best_available", []int64{104, 105, 106}},
+		{"no run fits, longest runs first", oneToTen(), []int64{3, 4, 8}, 4, "best_available", []int64{105, 106, 107, 101}},
+		{"no run fits, all singles", oneToTen(), []int64{2, 4, 6, 8, 10}, 3, "fill_from_back", []int64{101, 103, 105}},
+		{"too few free", oneToTen(), []int64{1, 2, 3, 4, 5, 6, 7, 8}, 3, "best_available", nil},
+		{"nothing asked", oneToTen(), nil, 0, "best_available", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pickSeats(tt.sheets, tt.count, takenNums(tt.taken...), seatAllocators[tt.strategy])
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pickSeats = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickSeatsRandom(t *testing.T) {
+	taken := []int64{2, 4, 7}
+	for seed := int64(1); seed <= 20; seed++ {
+		got := pickSeats(oneToTen(), 2, takenNums(taken...), newRandomAllocator(rand.NewSource(seed)))
+		again := pickSeats(oneToTen(), 2, takenNums(taken...), newRandomAllocator(rand.NewSource(seed)))
+		if !reflect.DeepEqual(got, again) {
+			t.Errorf("seed %d: picked %v, then %v", seed, got, again)
+		}
+		// Free pairs are 5-6, 8-9 and 9-10.
+		if len(got) != 2 || got[1] != got[0]+1 || (got[0] != 105 && got[0] != 108 && got[0] != 109) {
+			t.Errorf("seed %d: picked %v, want two free neighbours", seed, got)
+		}
+	}
+
+	// No pair is free: the group is split, whatever the seed.
+	got := pickSeats(oneToTen(), 2, takenNums(2, 4, 6, 8, 10), newRandomAllocator(rand.NewSource(1)))
+	if want := []int64{101, 103}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pickSeats = %v, want %v", got, want)
+	}
+}
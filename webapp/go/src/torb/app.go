@@ -2,11 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	. "github.com/ahmetb/go-linq"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo"
@@ -15,13 +15,13 @@ import (
 	"html/template"
 	"io"
 	"log"
-	"math/rand"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
@@ -38,7 +38,16 @@ type Event struct {
 	PublicFg bool   `json:"public,omitempty"`
 	ClosedFg bool   `json:"closed,omitempty"`
 	Price    int64  `json:"price,omitempty"`
+	VenueID  int64  `json:"venue_id,omitempty"`
 
+	Allocation   *SeatPolicy         `json:"allocation,omitempty"`
+	Limits       *PurchaseLimits     `json:"limits,omitempty"`
+	Schedule     *EventSchedule      `json:"schedule,omitempty"`
+	Pricing      *PricingPolicy      `json:"pricing,omitempty"`
+	Cancellation *CancellationPolicy `json:"cancellation,omitempty"`
+	OnSale       bool                `json:"on_sale"`
+
+	Ranks   []string           `json:"ranks,omitempty"`
 	Total   int                `json:"total"`
 	Remains int                `json:"remains"`
 	Sheets  map[string]*Sheets `json:"sheets,omitempty"`
@@ -49,16 +58,23 @@ type Sheets struct {
 	Remains int      `json:"remains"`
 	Detail  []*Sheet `json:"detail,omitempty"`
 	Price   int64    `json:"price"`
+
+	Waitlist int `json:"waitlist,omitempty"`
+	Waiting  int `json:"waiting,omitempty"`
 }
 
 type Sheet struct {
-	ID    int64  `json:"-"`
-	Rank  string `json:"-"`
-	Num   int64  `json:"num"`
-	Price int64  `json:"-"`
+	ID      int64  `json:"-"`
+	VenueID int64  `json:"-"`
+	Rank    string `json:"-"`
+	Num     int64  `json:"num"`
+	Price   int64  `json:"-"`
+	Retired bool   `json:"-"`
 
 	Mine           bool       `json:"mine,omitempty"`
 	Reserved       bool       `json:"reserved,omitempty"`
+	Held           bool       `json:"held,omitempty"`
+	ReservationID  int64      `json:"reservation_id,omitempty"`
 	ReservedAt     *time.Time `json:"-"`
 	ReservedAtUnix int64      `json:"reserved_at,omitempty"`
 }
@@ -70,13 +86,29 @@ type Reservation struct {
 	UserID     int64      `json:"-"`
 	ReservedAt *time.Time `json:"-"`
 	CanceledAt *time.Time `json:"-"`
+	// ExpiresAt is set while the reservation is an unconfirmed hold.
+	ExpiresAt *time.Time `json:"-"`
+	// Price is what the reservation was charged, made up as Breakdown says.
+	Price     int64           `json:"price"`
+	Breakdown *PriceBreakdown `json:"price_breakdown,omitempty"`
+	// PromoCodeID is the promo code the reservation was made with, if any.
+	PromoCodeID int64 `json:"-"`
+	// CancelFee is what was kept of Price when the reservation was canceled;
+	// the rest was refunded.
+	CancelFee int64 `json:"cancel_fee,omitempty"`
 
 	Event          *Event `json:"event,omitempty"`
 	SheetRank      string `json:"sheet_rank,omitempty"`
 	SheetNum       int64  `json:"sheet_num,omitempty"`
-	Price          int64  `json:"price,omitempty"`
 	ReservedAtUnix int64  `json:"reserved_at,omitempty"`
 	CanceledAtUnix int64  `json:"canceled_at,omitempty"`
+	ExpiresAtUnix  int64  `json:"expires_at,omitempty"`
+}
+
+// lapsedHold reports whether r was a hold that ended without being
+// confirmed; it never became a sale.
+func (r *Reservation) lapsedHold() bool {
+	return r.ExpiresAt != nil && r.CanceledAt != nil
 }
 
 type Administrator struct {
@@ -86,31 +118,23 @@ type Administrator struct {
 	PassHash  string `json:"pass_hash,omitempty"`
 }
 
-type SheetConfig struct {
-	ID    int64
-	Count int64
-	Price int64
-}
-
-var SheetConfigs map[string]SheetConfig = map[string]SheetConfig{
-	"S": SheetConfig{1, 50, 5000},
-	"A": SheetConfig{51, 150, 3000},
-	"B": SheetConfig{201, 300, 1000},
-	"C": SheetConfig{501, 500, 0},
-}
-
-func getSheetRange(rank string) (int64, int64) {
-	sc := SheetConfigs[rank]
-	return sc.ID, sc.ID + sc.Count
-}
-
-var DefaultSheets []*Sheet
-
 func getSheetFromId(id int64) *Sheet {
-	sheet := DefaultSheets[id-1]
+	sheet, _ := store.GetSheet(id)
 	return sheet
 }
 
+// getEventVenue falls back to the default venue if the event points at a
+// venue missing from the database, which only inconsistent data can cause:
+// venues are never deleted.
+func getEventVenue(e *Event) *Venue {
+	venue, err := store.GetVenue(e.VenueID)
+	if err != nil {
+		log.Printf("event %d: venue %d not found, using the default venue", e.ID, e.VenueID)
+		venue, _ = store.GetVenue(defaultVenueID)
+	}
+	return venue
+}
+
 func sessUser(c echo.Context) *User {
 	sess, _ := session.Get("session", c)
 	if x, ok := sess.Values["user"]; ok {
@@ -211,121 +235,69 @@ func getLoginAdministrator(c echo.Context) (*Administrator, error) {
 	if administratorID == 0 {
 		return nil, errors.New("not logged in")
 	}
-	var administrator Administrator
-	err := db.QueryRow("SELECT id, nickname FROM administrators WHERE id = ?", administratorID).Scan(&administrator.ID, &administrator.Nickname)
-	return &administrator, err
-}
-
-var (
-	reservationStore = make([]*Reservation, 0)
-	reservationMutex = new(sync.Mutex)
-)
-
-func initReservation() error {
-	rows, err := db.Query("SELECT * FROM reservations")
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	reservationStore = make([]*Reservation, 0)
-
-	for rows.Next() {
-		var reservation Reservation
-		rows.Scan(
-			&reservation.ID,
-			&reservation.EventID,
-			&reservation.SheetID,
-			&reservation.UserID,
-			&reservation.ReservedAt,
-			&reservation.CanceledAt)
-		reservationStore = append(reservationStore, &reservation)
-	}
-
-	return nil
-}
-
-var (
-	eventStore = make([]*Event, 0)
-	eventMutex = new(sync.Mutex)
-)
-
-func initEvents() error {
-	rows, err := db.Query("SELECT * FROM events ORDER BY id ASC")
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	eventStore = make([]*Event, 0)
-	for rows.Next() {
-		var event Event
-		if err := rows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
-			return err
-		}
-		eventStore = append(eventStore, &event)
-	}
-
-	return nil
+	return store.GetAdministrator(administratorID)
 }
 
 func getEvents(all bool) ([]*Event, error) {
 	var events []*Event
-	for _, event := range eventStore {
+	for _, event := range store.ListEvents() {
 		if !all && !event.PublicFg {
 			continue
 		}
 		events = append(events, event)
 	}
 	for i, event := range events {
-		event = fillEventOtherFields(event, -1)
-		for k := range event.Sheets {
-			event.Sheets[k].Detail = nil
-		}
-		events[i] = event
+		events[i] = fillEventSummary(event)
 	}
 	return events, nil
 }
 
-func fillEventOtherFields(e *Event, loginUserID int64) *Event {
+func fillEventSummary(e *Event) *Event {
 	event := *e
+	venue := getEventVenue(e)
 
-	event.Sheets = map[string]*Sheets{
-		"S": &Sheets{},
-		"A": &Sheets{},
-		"B": &Sheets{},
-		"C": &Sheets{},
+	event.Ranks = venue.RankNames()
+	event.OnSale = event.Schedule.CheckSale(time.Now()) == nil
+	event.Sheets = make(map[string]*Sheets, len(venue.Ranks))
+	event.Total = 0
+	event.Remains = 0
+	reserved := store.ReservedCounts(event.ID)
+	now := time.Now()
+	for _, vr := range venue.Ranks {
+		remains := int(vr.Count) - reserved[vr.Rank]
+		event.Sheets[vr.Rank] = &Sheets{
+			Total:   int(vr.Count),
+			Remains: remains,
+			Price:   event.Pricing.Quote(event.Price, vr.Price, vr.Rank, remains, now).Total(),
+		}
+		event.Total += int(vr.Count)
+		event.Remains += remains
 	}
+	return &event
+}
 
-	reservationsMap := make(map[int64]*Reservation)
+func fillEventOtherFields(e *Event, loginUserID int64) *Event {
+	event := *e
+	venue := getEventVenue(e)
 
-	var reservations []*Reservation
-	From(reservationStore).Where(func(c interface{}) bool {
-		r := c.(*Reservation)
-		if r.EventID != event.ID {
-			return false
-		}
-		if r.CanceledAt != nil {
-			return false
-		}
-		return true
-	}).ToSlice(&reservations)
+	event.Ranks = venue.RankNames()
+	event.OnSale = event.Schedule.CheckSale(time.Now()) == nil
+	event.Sheets = make(map[string]*Sheets, len(venue.Ranks))
 
-	for _, r := range reservations {
-		reservationsMap[r.SheetID] = r
-	}
+	reservationsMap := store.ActiveReservations(event.ID)
 
-	event.Total = 1000
+	event.Total = venue.Total
 	event.Remains = 0
-	for rank, sc := range SheetConfigs {
-		event.Sheets[rank].Total = int(sc.Count)
-		event.Sheets[rank].Price = event.Price + sc.Price
-		event.Sheets[rank].Remains = 0
-		event.Sheets[rank].Detail = make([]*Sheet, 0)
+	for _, vr := range venue.Ranks {
+		event.Sheets[vr.Rank] = &Sheets{
+			Total:   int(vr.Count),
+			Remains: 0,
+			Detail:  make([]*Sheet, 0, vr.Count),
+		}
+		event.Sheets[vr.Rank].Waitlist, event.Sheets[vr.Rank].Waiting = store.WaitlistStatus(event.ID, vr.Rank, loginUserID)
 	}
 
-
-	for _, s := range DefaultSheets {
+	for _, s := range venue.Sheets() {
 		var sheet = Sheet{
 			ID:    s.ID,
 			Rank:  s.Rank,
@@ -340,36 +312,44 @@ func fillEventOtherFields(e *Event, loginUserID int64) *Event {
 		} else {
 			sheet.Mine = reservation.UserID == loginUserID
 			sheet.Reserved = true
+			sheet.Held = reservation.ExpiresAt != nil
+			if sheet.Mine {
+				sheet.ReservationID = reservation.ID
+			}
 			sheet.ReservedAtUnix = reservation.ReservedAt.Unix()
 		}
 
 		event.Sheets[sheet.Rank].Detail = append(event.Sheets[sheet.Rank].Detail, &sheet)
 	}
+
+	// What the next sheet of a rank costs depends on how many are left.
+	now := time.Now()
+	for _, vr := range venue.Ranks {
+		sheets := event.Sheets[vr.Rank]
+		sheets.Price = event.Pricing.Quote(event.Price, vr.Price, vr.Rank, sheets.Remains, now).Total()
+	}
 	return &event
 }
 
 func getEvent(eventID, loginUserID int64) (*Event, error) {
-	if eventID <= 0 || len(eventStore) <= int(eventID) - 1 {
-		return nil, sql.ErrNoRows
+	e, err := store.GetEvent(eventID)
+	if err != nil {
+		return nil, err
 	}
-	e := eventStore[eventID - 1]
 	return fillEventOtherFields(e, loginUserID), nil
 }
 
-func updateEvent(eventID int64, public bool, closed bool) {
-	if eventID <= 0 || len(eventStore) <= int(eventID) - 1 {
-		return
-	}
-	e := eventStore[eventID - 1]
-	e.PublicFg = public
-	e.ClosedFg = closed
-}
-
+// sanitizeEvent strips an event down to what customers see. The terms they
+// buy under stay on purpose: Limits, Schedule, which the page shows, and
+// Cancellation. How seats are picked and prices worked out does not; the
+// sheet prices already carry the outcome.
 func sanitizeEvent(e *Event) *Event {
 	sanitized := *e
 	sanitized.Price = 0
 	sanitized.PublicFg = false
 	sanitized.ClosedFg = false
+	sanitized.Allocation = nil
+	sanitized.Pricing = nil
 	return &sanitized
 }
 
@@ -391,8 +371,8 @@ func fillinAdministrator(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-func validateRank(rank string) bool {
-	_, ok := SheetConfigs[rank]
+func validateRank(venue *Venue, rank string) bool {
+	_, ok := venue.Rank(rank)
 	return ok
 }
 
@@ -404,7 +384,7 @@ func (r *Renderer) Render(w io.Writer, name string, data interface{}, c echo.Con
 	return r.templates.ExecuteTemplate(w, name, data)
 }
 
-var db *sql.DB
+var store Store
 
 func Getenv(key, fallback string) string {
 	ret := os.Getenv(key)
@@ -415,6 +395,14 @@ func Getenv(key, fallback string) string {
 	}
 }
 
+func GetenvInt(key string, fallback int) int {
+	ret, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return ret
+}
+
 func main() {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&charset=utf8mb4",
 		Getenv("DB_USER", "isucon"), Getenv("DB_PASS", "isucon"),
@@ -422,29 +410,70 @@ func main() {
 		Getenv("DB_DATABASE", "torb"),
 	)
 
-	var err error
-	db, err = sql.Open("mysql", dsn)
-	if err != nil {
+	if _, ok := seatAllocators[defaultSeatStrategy]; !ok {
+		log.Fatalf("unknown SEAT_STRATEGY %q", defaultSeatStrategy)
+	}
+
+	switch Getenv("STORE", "mysql") {
+	case "file":
+		fs, err := newFileStore(Getenv("STORE_PATH", "torb.data"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = fs
+	case "cluster":
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = newClusterStore(db)
+		idempotencyCache.shared = newSharedIdempotency(db, idempotencyCache.ttl)
+	default:
+		db, err := sql.Open("mysql", dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ms, err := newMySQLStore(db, Getenv("JOURNAL_PATH", "torb.journal"), Getenv("SEAT_ALLOCATION", "memory") == "db")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if interval := GetenvInt("RECONCILE_INTERVAL_SEC", 0); interval > 0 {
+			go ms.reconcileLoop(time.Duration(interval)*time.Second, Getenv("RECONCILE_REPAIR", repairNone))
+		}
+		store = ms
+		idempotencyCache.shared = newSharedIdempotency(db, idempotencyCache.ttl)
+	}
+	if err := store.Load(); err != nil {
 		log.Fatal(err)
 	}
+	go sweepHolds(time.Duration(GetenvInt("HOLD_SWEEP_INTERVAL_SEC", 5)) * time.Second)
+	go runTransitions(time.Duration(GetenvInt("TRANSITION_INTERVAL_SEC", 1)) * time.Second)
+	if url := Getenv("NOTIFY_WEBHOOK_URL", ""); url != "" {
+		notifier = newWebhookNotifier(url)
+	}
+
+	e := newApp()
 
-	initReservation()
-	initEvents()
-
-	// DefaultSheets
-	DefaultSheets = make([]*Sheet, 0, 1000)
-	for _, rank := range []string{"S", "A", "B", "C"} {
-		c := SheetConfigs[rank]
-		for num := int64(1); num <= c.Count; num++ {
-			DefaultSheets = append(DefaultSheets, &Sheet{
-				ID:    c.ID + num - 1,
-				Rank:  rank,
-				Num:   num,
-				Price: c.Price,
-			})
+	go func() {
+		if err := e.Start(Getenv("LISTEN_ADDR", ":8080")); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
 		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-quit
+	log.Printf("received %s, shutting down", sig)
+
+	timeout := time.Duration(GetenvInt("SHUTDOWN_TIMEOUT_SEC", 30)) * time.Second
+	if !shutdown(e, timeout) {
+		os.Exit(1)
 	}
+}
 
+// newApp sets up the routes on the global store. Templates and static files
+// are looked up relative to the working directory.
+func newApp() *echo.Echo {
 	e := echo.New()
 	funcs := template.FuncMap{
 		"encode_json": func(v interface{}) string {
@@ -463,6 +492,7 @@ func main() {
 		if err != nil {
 			return err
 		}
+		events = upcomingEvents(events, time.Now())
 		for i, v := range events {
 			events[i] = sanitizeEvent(v)
 		}
@@ -473,26 +503,23 @@ func main() {
 		})
 	}, fillinUser)
 	e.GET("/debug/initReservation", func(c echo.Context) error {
-		initReservation()
+		if err := store.Load(); err != nil {
+			return err
+		}
 		return c.NoContent(204)
 	})
 	e.GET("/debug/initEvents", func(c echo.Context) error {
-		initEvents()
+		if err := store.Load(); err != nil {
+			return err
+		}
 		return c.NoContent(204)
 	})
 
 	e.GET("/initialize", func(c echo.Context) error {
-		cmd := exec.Command("../../db/init.sh")
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		err := cmd.Run()
-		if err != nil {
-			return nil
+		if err := store.Initialize(); err != nil {
+			return err
 		}
 
-		initReservation()
-		initEvents()
-
 		return c.NoContent(204)
 	})
 	e.POST("/api/users", func(c echo.Context) error {
@@ -503,42 +530,26 @@ func main() {
 		}
 		c.Bind(&params)
 
-		tx, err := db.Begin()
+		user, err := store.CreateUser(params.Nickname, params.LoginName, params.Password)
 		if err != nil {
-			return err
-		}
-
-		var user User
-		if err := tx.QueryRow("SELECT * FROM users WHERE login_name = ?", params.LoginName).Scan(&user.ID, &user.LoginName, &user.Nickname, &user.PassHash); err != sql.ErrNoRows {
-			tx.Rollback()
-			if err == nil {
+			if err == ErrDuplicated {
 				return resError(c, "duplicated", 409)
 			}
 			return err
 		}
 
-		res, err := tx.Exec("INSERT INTO users (login_name, pass_hash, nickname) VALUES (?, SHA2(?, 256), ?)", params.LoginName, params.Password, params.Nickname)
-		if err != nil {
-			tx.Rollback()
-			return resError(c, "", 0)
-		}
-		userID, err := res.LastInsertId()
-		if err != nil {
-			tx.Rollback()
-			return resError(c, "", 0)
-		}
-		if err := tx.Commit(); err != nil {
-			return err
-		}
-
 		return c.JSON(201, echo.Map{
-			"id":       userID,
-			"nickname": params.Nickname,
+			"id":       user.ID,
+			"nickname": user.Nickname,
 		})
 	})
 	e.GET("/api/users/:id", func(c echo.Context) error {
-		var user User
-		if err := db.QueryRow("SELECT id, nickname FROM users WHERE id = ?", c.Param("id")).Scan(&user.ID, &user.Nickname); err != nil {
+		userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return err
+		}
+		user, err := store.GetUser(userID)
+		if err != nil {
 			return err
 		}
 
@@ -551,32 +562,39 @@ func main() {
 		}
 
 		var relatedReservations []*Reservation
-		From(reservationStore).Where(func(c interface{}) bool {
-			r := c.(*Reservation)
-			if r.UserID != user.ID {
-				return false
-			}
-			return true
-		}).OrderByDescending(func(c interface{}) interface{} {
-			r := c.(*Reservation)
+		for _, r := range store.ReservationsByUser(user.ID) {
+			if !r.lapsedHold() {
+				relatedReservations = append(relatedReservations, r)
+			}
+		}
+		updatedAt := func(r *Reservation) int64 {
 			if r.CanceledAt != nil {
 				return r.CanceledAt.UnixNano()
-			} else {
-				return r.ReservedAt.UnixNano()
 			}
-		}).ToSlice(&relatedReservations)
+			return r.ReservedAt.UnixNano()
+		}
+		sort.SliceStable(relatedReservations, func(i, j int) bool {
+			return updatedAt(relatedReservations[i]) > updatedAt(relatedReservations[j])
+		})
 
-		var recentReservations []*Reservation
-		From(relatedReservations).Take(5).ToSlice(&recentReservations)
+		recentReservations := make([]*Reservation, 0, 5)
+		for _, reservation := range relatedReservations {
+			if len(recentReservations) == 5 {
+				break
+			}
+			// Copy, the stored reservation is shared with other requests.
+			r := *reservation
+			recentReservations = append(recentReservations, &r)
+		}
 
 		for _, reservation := range (recentReservations) {
 			sheet := getSheetFromId(reservation.SheetID)
 
-			event, err := getEvent(reservation.EventID, -1)
+			e, err := store.GetEvent(reservation.EventID)
 			if err != nil {
 				return err
 			}
-			price := event.Sheets[sheet.Rank].Price
+			event := fillEventSummary(e)
 			event.Sheets = nil
 			event.Total = 0
 			event.Remains = 0
@@ -584,63 +602,50 @@ func main() {
 			reservation.Event = event
 			reservation.SheetRank = sheet.Rank
 			reservation.SheetNum = sheet.Num
-			reservation.Price = price
 			reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
 			if reservation.CanceledAt != nil {
 				reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
 			}
+			if reservation.ExpiresAt != nil {
+				reservation.ExpiresAtUnix = reservation.ExpiresAt.Unix()
+			}
 		}
 
 		totalPrice := 0
 		for _,reservation := range(relatedReservations) {
-			if reservation.CanceledAt != nil {
+			if reservation.ExpiresAt != nil {
 				continue
 			}
-			sheet := getSheetFromId(reservation.SheetID)
-			event, err := getEvent(reservation.EventID, -1)
-			if err != nil {
-				log.Println(err)
-				return err
+			if reservation.CanceledAt != nil {
+				// Only the cancellation fee was kept.
+				totalPrice += int(reservation.CancelFee)
+				continue
 			}
-			curPrice := event.Price + sheet.Price
-
-			totalPrice += int(curPrice)
+			totalPrice += int(reservation.Price)
 		}
 
+		// relatedReservations is newest first, so the first time an event
+		// shows up is its most recent activity.
 		var eventIds []int64
-		From(relatedReservations).GroupBy(func(c interface{}) interface{}{
-			r := c.(*Reservation)
-			return r.EventID
-		}, func(c interface{}) interface{} {
-			return c
-		}).OrderByDescending(func(c interface{}) interface{} {
-			values := c.(Group).Group
-			maxTime := From(values).Select(func(c2 interface{}) interface{} {
-				r := c2.(*Reservation)
-				if r.CanceledAt != nil {
-					return r.CanceledAt.UnixNano()
-				} else {
-					return r.ReservedAt.UnixNano()
-				}
-			}).Max().(int64)
-
-			return maxTime
-		}).Take(5).Select(func(c interface{}) interface{} {
-			eventId := c.(Group).Key
-			return eventId
-		}).ToSlice(&eventIds)
-
+		seenEvents := make(map[int64]bool)
+		for _, reservation := range relatedReservations {
+			if len(eventIds) == 5 {
+				break
+			}
+			if seenEvents[reservation.EventID] {
+				continue
+			}
+			seenEvents[reservation.EventID] = true
+			eventIds = append(eventIds, reservation.EventID)
+		}
 
 		var recentEvents []*Event
 		for _, eventID := range(eventIds) {
-			event, err := getEvent(eventID, -1)
+			e, err := store.GetEvent(eventID)
 			if err != nil {
 				return err
 			}
-			for k := range event.Sheets {
-				event.Sheets[k].Detail = nil
-			}
-			recentEvents = append(recentEvents, event)
+			recentEvents = append(recentEvents, fillEventSummary(e))
 		}
 		if recentEvents == nil {
 			recentEvents = make([]*Event, 0)
@@ -661,19 +666,15 @@ func main() {
 		}
 		c.Bind(&params)
 
-		user := new(User)
-		if err := db.QueryRow("SELECT * FROM users WHERE login_name = ?", params.LoginName).Scan(&user.ID, &user.Nickname, &user.LoginName, &user.PassHash); err != nil {
+		user, err := store.GetUserByLoginName(params.LoginName)
+		if err != nil {
 			if err == sql.ErrNoRows {
 				return resError(c, "authentication_failed", 401)
 			}
 			return err
 		}
 
-		var passHash string
-		if err := db.QueryRow("SELECT SHA2(?, 256)", params.Password).Scan(&passHash); err != nil {
-			return err
-		}
-		if user.PassHash != passHash {
+		if user.PassHash != passwordHash(params.Password) {
 			return resError(c, "authentication_failed", 401)
 		}
 
@@ -720,22 +721,128 @@ func main() {
 		}
 		return c.JSON(200, sanitizeEvent(event))
 	})
-	e.POST("/api/events/:id/actions/reserve", func(c echo.Context) error {
+	// reserve books seats the customer did not choose; with a positive hold
+	// they stay unconfirmed holds until /actions/confirm.
+	reserve := func(hold time.Duration) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+			if err != nil {
+				return resError(c, "not_found", 404)
+			}
+			var params struct {
+				Rank      string `json:"sheet_rank"`
+				Count     int    `json:"count"`
+				PromoCode string `json:"promo_code"`
+			}
+			c.Bind(&params)
+			if params.Count == 0 {
+				params.Count = 1
+			}
+			if params.Count < 1 || params.Count > maxSeatsPerReservation {
+				return resError(c, "invalid_count", 400)
+			}
+
+			user, err := getLoginUser(c)
+			if err != nil {
+				return err
+			}
+
+			event, err := store.GetEvent(eventID)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return resError(c, "invalid_event", 404)
+				}
+				return err
+			} else if !event.PublicFg {
+				return resError(c, "invalid_event", 404)
+			}
+			if err := event.Schedule.CheckSale(time.Now()); err != nil {
+				return resScheduleError(c, err)
+			}
+
+			venue := getEventVenue(event)
+			if !validateRank(venue, params.Rank) {
+				return resError(c, "invalid_rank", 400)
+			}
+
+			promo, reason, err := findPromo(params.PromoCode, event.ID, params.Rank)
+			if err != nil {
+				return err
+			} else if reason != "" {
+				return resError(c, reason, 400)
+			}
+
+			vr, _ := venue.Rank(params.Rank)
+			reservations, err := store.ReserveSeats(event.ID, user.ID, vr.Sheets(), params.Count, event.Allocation.Allocator(params.Rank), hold, promo)
+			if err != nil {
+				switch err {
+				case ErrSoldOut:
+					return resError(c, "sold_out", 409)
+				case ErrLimitExceeded:
+					return resError(c, "limit_exceeded", 409)
+				case ErrPromoExhausted:
+					return resError(c, "promo_code_exhausted", 409)
+				case ErrPromoExpired:
+					return resError(c, "promo_code_expired", 400)
+				case ErrWriterBusy:
+					return resError(c, "busy", 503)
+				}
+				return err
+			}
+
+			booked := make([]echo.Map, len(reservations))
+			for i, reservation := range reservations {
+				sheet := getSheetFromId(reservation.SheetID)
+				booked[i] = echo.Map{
+					"id":         reservation.ID,
+					"sheet_rank": params.Rank,
+					"sheet_num":  sheet.Num,
+					"price":      reservation.Price,
+				}
+				if promo != nil {
+					booked[i]["discount"] = reservation.charged().Discount
+				}
+			}
+			res := echo.Map{
+				"id":           reservations[0].ID,
+				"sheet_rank":   params.Rank,
+				"sheet_num":    booked[0]["sheet_num"],
+				"reservations": booked,
+			}
+			if expiresAt := reservations[0].ExpiresAt; expiresAt != nil {
+				res["expires_at"] = expiresAt.Unix()
+			}
+			return c.JSON(202, res)
+		}
+	}
+	e.POST("/api/events/:id/actions/reserve", reserve(0), loginRequired, idempotent)
+	e.POST("/api/events/:id/actions/hold", reserve(holdTTL), loginRequired, idempotent)
+	e.POST("/api/events/:id/actions/confirm", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
 			return resError(c, "not_found", 404)
 		}
 		var params struct {
-			Rank string `json:"sheet_rank"`
+			ReservationIDs []int64 `json:"reservation_ids"`
 		}
 		c.Bind(&params)
+		if len(params.ReservationIDs) == 0 || len(params.ReservationIDs) > maxSeatsPerReservation {
+			return resError(c, "invalid_reservation", 400)
+		}
+		seen := make(map[int64]bool, len(params.ReservationIDs))
+		for _, id := range params.ReservationIDs {
+			if seen[id] {
+				return resError(c, "invalid_reservation", 400)
+			}
+			seen[id] = true
+		}
 
 		user, err := getLoginUser(c)
 		if err != nil {
 			return err
 		}
 
-		event, err := getEvent(eventID, user.ID)
+		event, err := store.GetEvent(eventID)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				return resError(c, "invalid_event", 404)
@@ -745,97 +852,193 @@ func main() {
 			return resError(c, "invalid_event", 404)
 		}
 
-		if !validateRank(params.Rank) {
-			return resError(c, "invalid_rank", 400)
+		reservations, err := store.ConfirmReservations(event.ID, user.ID, params.ReservationIDs)
+		if err != nil {
+			switch err {
+			case ErrNotReserved:
+				return resError(c, "not_reserved", 400)
+			case ErrNotPermitted:
+				return resError(c, "not_permitted", 403)
+			case ErrHoldExpired:
+				return resError(c, "hold_expired", 409)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
 		}
 
-		sheetIdL, sheetIdR := getSheetRange(params.Rank)
-		usedSheets := make([]bool, sheetIdR-sheetIdL)
-
-		var sheet *Sheet
-		var reservationID int64
-
-		reservationMutex.Lock()
-		{
-			defer reservationMutex.Unlock()
-			var reservations []*Reservation
-			From(reservationStore).Where(func(c interface{}) bool {
-				r := c.(*Reservation)
-				if r.EventID != event.ID {
-					return false
-				}
-				if r.CanceledAt != nil {
-					return false
-				}
-				return true
-			}).ToSlice(&reservations)
-
-			for _, reservation := range reservations {
-				sheetId := reservation.SheetID
-				if sheetIdL <= sheetId && sheetId < sheetIdR {
-					usedSheets[sheetId-sheetIdL] = true
-				}
+		confirmed := make([]echo.Map, len(reservations))
+		for i, reservation := range reservations {
+			sheet := getSheetFromId(reservation.SheetID)
+			confirmed[i] = echo.Map{
+				"id":         reservation.ID,
+				"sheet_rank": sheet.Rank,
+				"sheet_num":  sheet.Num,
 			}
+		}
+		return c.JSON(200, echo.Map{"reservations": confirmed})
+	}, loginRequired, idempotent)
+	// waitlistRank resolves the event and rank of a waitlist request, or
+	// writes the error response and returns a nil event.
+	waitlistRank := func(c echo.Context) (*Event, string, error) {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return nil, "", resError(c, "not_found", 404)
+		}
+		rank := c.Param("rank")
 
-			idxes := make([]int64, sheetIdR-sheetIdL)
-			for i := 0; i < len(idxes); i++ {
-				idxes[i] = int64(i) + sheetIdL
-			}
-			for i := len(idxes) - 1; i >= 0; i-- {
-				j := rand.Intn(i + 1)
-				idxes[i], idxes[j] = idxes[j], idxes[i]
+		event, err := store.GetEvent(eventID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, "", resError(c, "invalid_event", 404)
 			}
+			return nil, "", err
+		} else if !event.PublicFg {
+			return nil, "", resError(c, "invalid_event", 404)
+		}
+		if !validateRank(getEventVenue(event), rank) {
+			return nil, "", resError(c, "invalid_rank", 404)
+		}
+		return event, rank, nil
+	}
+	e.POST("/api/events/:id/sheets/:rank/waitlist", func(c echo.Context) error {
+		event, rank, err := waitlistRank(c)
+		if event == nil {
+			return err
+		}
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+		if err := event.Schedule.CheckSale(time.Now()); err != nil {
+			return resScheduleError(c, err)
+		}
 
-			useSheetId := int64(-1)
-			for i := 0; i < int(sheetIdR - sheetIdL); i++ {
-				id := idxes[i]
-				if !usedSheets[id-sheetIdL] {
-					useSheetId = id
-					break
-				}
-			}
+		// Only a sold-out rank has a queue; otherwise the customer can
+		// just reserve.
+		if fillEventSummary(event).Sheets[rank].Remains > 0 {
+			return resError(c, "not_sold_out", 409)
+		}
 
-			if useSheetId == -1 {
-				return resError(c, "sold_out", 409)
+		entry, err := store.JoinWaitlist(event.ID, rank, user.ID)
+		if err != nil {
+			switch err {
+			case ErrLimitExceeded:
+				return resError(c, "limit_exceeded", 409)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
 			}
-			sheet = getSheetFromId(useSheetId)
+			return err
+		}
+
+		length, position := store.WaitlistStatus(event.ID, rank, user.ID)
+		return c.JSON(200, echo.Map{
+			"id":         entry.ID,
+			"sheet_rank": rank,
+			"position":   position,
+			"waitlist":   length,
+		})
+	}, loginRequired, idempotent)
+	e.DELETE("/api/events/:id/sheets/:rank/waitlist", func(c echo.Context) error {
+		event, rank, err := waitlistRank(c)
+		if event == nil {
+			return err
+		}
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
 
-			reservation := &Reservation{}
+		if err := store.LeaveWaitlist(event.ID, rank, user.ID); err != nil {
+			switch err {
+			case ErrNotWaiting:
+				return resError(c, "not_waiting", 400)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+		return c.NoContent(204)
+	}, loginRequired, idempotent)
+	e.POST("/api/events/:id/sheets/:rank/:num/reservation", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		rank := c.Param("rank")
+		num := c.Param("num")
+		var params struct {
+			PromoCode string `json:"promo_code"`
+		}
+		c.Bind(&params)
 
-			reservation.ID = int64(len(reservationStore) + 1)
-			reservationID = reservation.ID
-			reservation.EventID = event.ID
-			reservation.SheetID = sheet.ID
-			reservation.UserID = user.ID
-			reservationTime := time.Now().UTC()
-			reservation.ReservedAt = &reservationTime
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
 
-			reservationStore = append(reservationStore, reservation)
+		event, err := store.GetEvent(eventID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "invalid_event", 404)
+			}
+			return err
+		} else if !event.PublicFg {
+			return resError(c, "invalid_event", 404)
+		}
+		if err := event.Schedule.CheckSale(time.Now()); err != nil {
+			return resScheduleError(c, err)
+		}
 
-			go func() {
-				res, err := db.Exec("INSERT INTO reservations (id, event_id, sheet_id, user_id, reserved_at) VALUES (?, ?, ?, ?, ?)",
-					reservation.ID, reservation.EventID, reservation.SheetID, reservation.UserID, reservation.ReservedAt.Format("2006-01-02 15:04:05.000000"))
+		venue := getEventVenue(event)
+		if !validateRank(venue, rank) {
+			return resError(c, "invalid_rank", 404)
+		}
 
-				if err != nil {
-					log.Println("error happened on Exec")
-					return
-				}
+		vr, _ := venue.Rank(rank)
+		intNum, _ := strconv.ParseInt(num, 10, 64)
+		sheet, ok := vr.Sheet(intNum)
+		if !ok || sheet.Retired {
+			return resError(c, "invalid_sheet", 404)
+		}
 
-				reservationID, err := res.LastInsertId()
-				if reservation.ID != reservationID {
-					log.Println("reservation ID mismatch")
-					return
-				}
-			}()
+		promo, reason, err := findPromo(params.PromoCode, event.ID, rank)
+		if err != nil {
+			return err
+		} else if reason != "" {
+			return resError(c, reason, 400)
+		}
 
+		// With the sheet as the only candidate, sold out means someone
+		// else got it first.
+		reservation, err := store.Reserve(event.ID, user.ID, []int64{sheet.ID}, promo)
+		if err != nil {
+			switch err {
+			case ErrSoldOut:
+				return resError(c, "already_reserved", 409)
+			case ErrLimitExceeded:
+				return resError(c, "limit_exceeded", 409)
+			case ErrPromoExhausted:
+				return resError(c, "promo_code_exhausted", 409)
+			case ErrPromoExpired:
+				return resError(c, "promo_code_expired", 400)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
 		}
 
-		return c.JSON(202, echo.Map{
-			"id":         reservationID,
-			"sheet_rank": params.Rank,
+		res := echo.Map{
+			"id":         reservation.ID,
+			"sheet_rank": rank,
 			"sheet_num":  sheet.Num,
-		})
-	}, loginRequired)
+		}
+		if promo != nil {
+			res["price"] = reservation.Price
+			res["discount"] = reservation.charged().Discount
+		}
+		return c.JSON(202, res)
+	}, loginRequired, idempotent)
 	e.DELETE("/api/events/:id/sheets/:rank/:num/reservation", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
@@ -849,7 +1052,7 @@ func main() {
 			return err
 		}
 
-		event, err := getEvent(eventID, user.ID)
+		event, err := store.GetEvent(eventID)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				return resError(c, "invalid_event", 404)
@@ -858,56 +1061,139 @@ func main() {
 		} else if !event.PublicFg {
 			return resError(c, "invalid_event", 404)
 		}
+		// Deadlines and fees are for reservations only; the store lets a
+		// hold go regardless.
+		now := time.Now()
+		terms := func() (*CancellationFee, error) {
+			if err := event.Schedule.CheckCancel(now); err != nil {
+				return nil, err
+			}
+			return event.Cancellation.Fee(event.Schedule, now)
+		}
 
-		if !validateRank(rank) {
+		venue := getEventVenue(event)
+		if !validateRank(venue, rank) {
 			return resError(c, "invalid_rank", 404)
 		}
 
-		sc, ok := SheetConfigs[rank]
+		vr, ok := venue.Rank(rank)
 		if !ok {
 			return resError(c, "invalid_sheet", 404)
 		}
 		intNum, _ := strconv.ParseInt(num, 10, 64)
-		if sc.Count < intNum {
+		sheet, ok := vr.Sheet(intNum)
+		if !ok {
 			return resError(c, "invalid_sheet", 404)
 		}
-		sheetId := sc.ID + intNum - 1
 
-		var reservations []*Reservation
-		From(reservationStore).Where(func(c interface{}) bool {
-			r := c.(*Reservation)
-			if r.EventID != event.ID {
-				return false
+		if _, err := store.CancelReservation(event.ID, sheet.ID, user.ID, terms); err != nil {
+			switch err {
+			case ErrSalesEnded:
+				return resScheduleError(c, err)
+			case ErrCancelClosed:
+				return resError(c, "cancellation_closed", 403)
+			case ErrNotReserved:
+				return resError(c, "not_reserved", 400)
+			case ErrNotPermitted:
+				return resError(c, "not_permitted", 403)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
 			}
-			if r.SheetID != sheetId {
-				return false
-			}
-			if r.CanceledAt != nil {
-				return false
+			return err
+		}
+
+		return c.NoContent(204)
+	}, loginRequired, idempotent)
+	e.POST("/api/reservations/:id/actions/transfer", func(c echo.Context) error {
+		reservationID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		var params struct {
+			LoginName string `json:"login_name"`
+		}
+		c.Bind(&params)
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+		recipient, err := store.GetUserByLoginName(params.LoginName)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "invalid_recipient", 400)
 			}
-			return true
-		}).ToSlice(&reservations)
+			return err
+		}
+		if recipient.ID == user.ID {
+			return resError(c, "invalid_recipient", 400)
+		}
 
-		if len(reservations) == 0 {
-			return resError(c, "not_reserved", 400)
+		reservation, err := store.GetReservation(reservationID)
+		if err != nil {
+			return resTransferError(c, err)
+		}
+		if transferClosed(reservation.EventID) {
+			return resError(c, "event_closed", 403)
 		}
-		reservation := reservations[0]
 
-		if reservation.UserID != user.ID {
-			return resError(c, "not_permitted", 403)
+		t, err := store.OfferTransfer(reservation.ID, user.ID, recipient.ID)
+		if err != nil {
+			return resTransferError(c, err)
+		}
+		return c.JSON(200, transferJSON(t))
+	}, loginRequired, idempotent)
+	e.GET("/api/transfers", func(c echo.Context) error {
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+		transfers := store.TransfersByUser(user.ID)
+		res := make([]echo.Map, len(transfers))
+		for i, t := range transfers {
+			res[i] = transferJSON(t)
+		}
+		return c.JSON(200, res)
+	}, loginRequired)
+	e.POST("/api/transfers/:id/actions/accept", func(c echo.Context) error {
+		transferID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
 		}
 
-		canceledAt := time.Now().UTC()
-		reservation.CanceledAt = &canceledAt
+		t, err := store.GetTransfer(transferID)
+		if err != nil {
+			return resTransferError(c, err)
+		}
+		if transferClosed(t.EventID) {
+			return resError(c, "event_closed", 403)
+		}
 
-		go func() {
-			if _, err := db.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", canceledAt.Format("2006-01-02 15:04:05.000000"), reservation.ID); err != nil {
-				log.Println("error happened on UPDATE reservations", err)
-			}
-		}()
+		if t, err = store.AcceptTransfer(t.ID, user.ID); err != nil {
+			return resTransferError(c, err)
+		}
+		return c.JSON(200, transferJSON(t))
+	}, loginRequired, idempotent)
+	e.POST("/api/transfers/:id/actions/cancel", func(c echo.Context) error {
+		transferID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
 
-		return c.NoContent(204)
-	}, loginRequired)
+		t, err := store.CancelTransfer(transferID, user.ID)
+		if err != nil {
+			return resTransferError(c, err)
+		}
+		return c.JSON(200, transferJSON(t))
+	}, loginRequired, idempotent)
 	e.GET("/admin/", func(c echo.Context) error {
 		var events []*Event
 		administrator := c.Get("administrator")
@@ -930,19 +1216,15 @@ func main() {
 		}
 		c.Bind(&params)
 
-		administrator := new(Administrator)
-		if err := db.QueryRow("SELECT * FROM administrators WHERE login_name = ?", params.LoginName).Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname, &administrator.PassHash); err != nil {
+		administrator, err := store.GetAdministratorByLoginName(params.LoginName)
+		if err != nil {
 			if err == sql.ErrNoRows {
 				return resError(c, "authentication_failed", 401)
 			}
 			return err
 		}
 
-		var passHash string
-		if err := db.QueryRow("SELECT SHA2(?, 256)", params.Password).Scan(&passHash); err != nil {
-			return err
-		}
-		if administrator.PassHash != passHash {
+		if administrator.PassHash != passwordHash(params.Password) {
 			return resError(c, "authentication_failed", 401)
 		}
 
@@ -966,36 +1248,177 @@ func main() {
 	}, adminLoginRequired)
 	e.POST("/admin/api/events", func(c echo.Context) error {
 		var params struct {
-			Title  string `json:"title"`
-			Public bool   `json:"public"`
-			Price  int    `json:"price"`
+			Title   string `json:"title"`
+			Public  bool   `json:"public"`
+			Price   int    `json:"price"`
+			VenueID int64  `json:"venue_id"`
+
+			Allocation   *SeatPolicy         `json:"allocation"`
+			Limits       *PurchaseLimits     `json:"limits"`
+			Schedule     *EventSchedule      `json:"schedule"`
+			Pricing      *PricingPolicy      `json:"pricing"`
+			Cancellation *CancellationPolicy `json:"cancellation"`
 		}
 		c.Bind(&params)
+		if err := params.Allocation.Validate(); err != nil {
+			return resError(c, "invalid_allocation", 400)
+		}
+		if err := params.Limits.Validate(); err != nil {
+			return resError(c, "invalid_limits", 400)
+		}
+		if err := params.Schedule.Validate(); err != nil {
+			return resError(c, "invalid_schedule", 400)
+		}
+		if err := params.Pricing.Validate(); err != nil {
+			return resError(c, "invalid_pricing", 400)
+		}
+		if err := params.Cancellation.Validate(); err != nil {
+			return resError(c, "invalid_cancellation", 400)
+		}
+		if params.VenueID == 0 {
+			params.VenueID = defaultVenueID
+		}
+		if _, err := store.GetVenue(params.VenueID); err != nil {
+			return resError(c, "invalid_venue", 400)
+		}
 
-		eventMutex.Lock()
-		event := &Event{}
-		{
-			defer eventMutex.Unlock()
+		event, err := store.CreateEvent(Event{
+			Title:    params.Title,
+			PublicFg: params.Public,
+			ClosedFg: false,
+			Price:    int64(params.Price),
+			VenueID:  params.VenueID,
 
-			event.ID = int64(len(eventStore) + 1)
-			event.Title = params.Title
-			event.PublicFg = params.Public
-			event.ClosedFg = false
-			event.Price = int64(params.Price)
+			Allocation:   params.Allocation,
+			Limits:       params.Limits,
+			Schedule:     params.Schedule,
+			Pricing:      params.Pricing,
+			Cancellation: params.Cancellation,
+		})
+		if err != nil {
+			if err == ErrWriterBusy {
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
 
-			eventStore = append(eventStore, event)
+		event = fillEventOtherFields(event, -1)
+		return c.JSON(200, event)
+	}, adminLoginRequired)
+	e.GET("/admin/api/venues", func(c echo.Context) error {
+		return c.JSON(200, store.ListVenues())
+	}, adminLoginRequired)
+	e.POST("/admin/api/venues", func(c echo.Context) error {
+		var params struct {
+			Name string `json:"name"`
+		}
+		c.Bind(&params)
+		if params.Name == "" {
+			return resError(c, "invalid_name", 400)
 		}
 
-		go func() {
-			_, err := db.Exec("INSERT INTO events (id, title, public_fg, closed_fg, price) VALUES (?, ?, ?, ?, ?)",
-				event.ID, event.Title, event.PublicFg, event.ClosedFg, event.Price)
-			if err != nil {
-				log.Println(err)
+		venue, err := store.CreateVenue(params.Name)
+		if err != nil {
+			if err == ErrWriterBusy {
+				return resError(c, "busy", 503)
 			}
-		}()
+			return err
+		}
+		return c.JSON(200, venue)
+	}, adminLoginRequired)
+	e.POST("/admin/api/venues/:id/sheets", func(c echo.Context) error {
+		venueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		var params struct {
+			Rank  string `json:"rank"`
+			Count int64  `json:"count"`
+			Price *int64 `json:"price"`
+		}
+		c.Bind(&params)
 
-		event = fillEventOtherFields(event, -1)
-		return c.JSON(200, event)
+		venue, err := store.GetVenue(venueID)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		if params.Rank == "" {
+			return resError(c, "invalid_rank", 400)
+		}
+		if params.Count < 1 || params.Count > 1000 {
+			return resError(c, "invalid_count", 400)
+		}
+		var price int64
+		if params.Price != nil {
+			price = *params.Price
+		} else if vr, ok := venue.Rank(params.Rank); ok {
+			price = vr.Price
+		} else {
+			return resError(c, "invalid_price", 400)
+		}
+		if price < 0 {
+			return resError(c, "invalid_price", 400)
+		}
+
+		venue, err = store.AddSheets(venueID, params.Rank, params.Count, price)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+		return c.JSON(200, venue)
+	}, adminLoginRequired)
+	e.DELETE("/admin/api/venues/:id/sheets/:rank/:num", func(c echo.Context) error {
+		venueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		num, err := strconv.ParseInt(c.Param("num"), 10, 64)
+		if err != nil {
+			return resError(c, "invalid_sheet", 404)
+		}
+
+		if err := store.RetireSheet(venueID, c.Param("rank"), num); err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "invalid_sheet", 404)
+			case ErrSheetReserved:
+				return resError(c, "sheet_reserved", 409)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+		return c.NoContent(204)
+	}, adminLoginRequired)
+	e.POST("/admin/api/venues/:id/ranks/:rank/price", func(c echo.Context) error {
+		venueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		var params struct {
+			Price *int64 `json:"price"`
+		}
+		c.Bind(&params)
+		if params.Price == nil || *params.Price < 0 {
+			return resError(c, "invalid_price", 400)
+		}
+
+		venue, err := store.SetRankPrice(venueID, c.Param("rank"), *params.Price)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+		return c.JSON(200, venue)
 	}, adminLoginRequired)
 	e.GET("/admin/api/events/:id", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
@@ -1026,33 +1449,414 @@ func main() {
 			params.Public = false
 		}
 
-		event, err := getEvent(eventID, -1)
+		updated, err := store.UpdateEvent(eventID, params.Public, params.Closed)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case errCannotEditClosedEvent:
+				return resError(c, "cannot_edit_closed_event", 400)
+			case errCannotClosePublicEvent:
+				return resError(c, "cannot_close_public_event", 400)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+
+		event := fillEventOtherFields(updated, -1)
+		c.JSON(200, event)
+		return nil
+	}, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/allocation", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		var policy SeatPolicy
+		c.Bind(&policy)
+		if err := policy.Validate(); err != nil {
+			return resError(c, "invalid_allocation", 400)
+		}
+
+		updated, err := store.SetEventAllocation(eventID, &policy)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case errCannotEditClosedEvent:
+				return resError(c, "cannot_edit_closed_event", 400)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+
+		event := fillEventOtherFields(updated, -1)
+		return c.JSON(200, event)
+	}, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/limits", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		var limits PurchaseLimits
+		c.Bind(&limits)
+		if err := limits.Validate(); err != nil {
+			return resError(c, "invalid_limits", 400)
+		}
+
+		updated, err := store.SetEventLimits(eventID, &limits)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case errCannotEditClosedEvent:
+				return resError(c, "cannot_edit_closed_event", 400)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+
+		event := fillEventOtherFields(updated, -1)
+		return c.JSON(200, event)
+	}, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/schedule", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		var schedule EventSchedule
+		c.Bind(&schedule)
+		if err := schedule.Validate(); err != nil {
+			return resError(c, "invalid_schedule", 400)
+		}
+
+		updated, err := store.SetEventSchedule(eventID, &schedule)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case errCannotEditClosedEvent:
+				return resError(c, "cannot_edit_closed_event", 400)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+
+		event := fillEventOtherFields(updated, -1)
+		return c.JSON(200, event)
+	}, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/pricing", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		var pricing PricingPolicy
+		c.Bind(&pricing)
+		if err := pricing.Validate(); err != nil {
+			return resError(c, "invalid_pricing", 400)
+		}
+
+		updated, err := store.SetEventPricing(eventID, &pricing)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case errCannotEditClosedEvent:
+				return resError(c, "cannot_edit_closed_event", 400)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+
+		event := fillEventOtherFields(updated, -1)
+		return c.JSON(200, event)
+	}, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/cancellation", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+
+		var policy CancellationPolicy
+		c.Bind(&policy)
+		if err := policy.Validate(); err != nil {
+			return resError(c, "invalid_cancellation", 400)
+		}
+
+		updated, err := store.SetEventCancellation(eventID, &policy)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case errCannotEditClosedEvent:
+				return resError(c, "cannot_edit_closed_event", 400)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+
+		event := fillEventOtherFields(updated, -1)
+		return c.JSON(200, event)
+	}, adminLoginRequired)
+	e.GET("/admin/api/events/:id/transitions", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		if _, err := store.GetEvent(eventID); err != nil {
 			if err == sql.ErrNoRows {
 				return resError(c, "not_found", 404)
 			}
 			return err
 		}
 
-		if event.ClosedFg {
-			return resError(c, "cannot_edit_closed_event", 400)
-		} else if event.PublicFg && params.Closed {
-			return resError(c, "cannot_close_public_event", 400)
+		transitions := store.ListTransitions(eventID)
+		res := make([]echo.Map, len(transitions))
+		for i, t := range transitions {
+			res[i] = transitionJSON(t)
+		}
+		return c.JSON(200, res)
+	}, adminLoginRequired)
+	e.POST("/admin/api/events/:id/transitions", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		administrator, err := getLoginAdministrator(c)
+		if err != nil {
+			return err
 		}
 
-		event.PublicFg = params.Public
-		event.ClosedFg = params.Closed
-		updateEvent(eventID, params.Public, params.Closed)
+		var params struct {
+			Public bool  `json:"public"`
+			Closed bool  `json:"closed"`
+			RunAt  int64 `json:"run_at"`
+		}
+		c.Bind(&params)
+		if params.RunAt <= 0 {
+			return resError(c, "invalid_transition", 400)
+		}
+		if params.Closed {
+			params.Public = false
+		}
 
-		go func() {
-			event, _ := getEvent(eventID, -1)
-			if _, err := db.Exec("UPDATE events SET public_fg = ?, closed_fg = ? WHERE id = ?", event.PublicFg, event.ClosedFg, event.ID); err != nil {
-				log.Println(err)
+		t, err := store.ScheduleTransition(eventID, params.Public, params.Closed, time.Unix(params.RunAt, 0), administrator.ID)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case errCannotEditClosedEvent:
+				return resError(c, "cannot_edit_closed_event", 400)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
 			}
-		}()
+			return err
+		}
+		return c.JSON(200, transitionJSON(t))
+	}, adminLoginRequired)
+	e.DELETE("/admin/api/events/:id/transitions/:transition_id", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		transitionID, err := strconv.ParseInt(c.Param("transition_id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
 
-		c.JSON(200, event)
-		return nil
+		if err := store.CancelTransition(eventID, transitionID); err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case ErrTransitionDone:
+				return resError(c, "transition_done", 409)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+		return c.NoContent(204)
+	}, adminLoginRequired)
+	e.GET("/admin/api/limits", func(c echo.Context) error {
+		return c.JSON(200, echo.Map{"max_active_reservations": store.ActiveLimit()})
+	}, adminLoginRequired)
+	e.POST("/admin/api/limits", func(c echo.Context) error {
+		var params struct {
+			MaxActiveReservations int `json:"max_active_reservations"`
+		}
+		c.Bind(&params)
+		if params.MaxActiveReservations < 0 {
+			return resError(c, "invalid_limits", 400)
+		}
+
+		if err := store.SetActiveLimit(params.MaxActiveReservations); err != nil {
+			if err == ErrWriterBusy {
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+		return c.JSON(200, echo.Map{"max_active_reservations": params.MaxActiveReservations})
+	}, adminLoginRequired)
+	e.GET("/admin/api/promo_codes", func(c echo.Context) error {
+		promos := store.ListPromoCodes()
+		res := make([]echo.Map, len(promos))
+		for i, p := range promos {
+			res[i] = promoJSON(p, store.PromoRedemptions(p.ID))
+		}
+		return c.JSON(200, res)
+	}, adminLoginRequired)
+	e.POST("/admin/api/promo_codes", func(c echo.Context) error {
+		var params struct {
+			Code           string   `json:"code"`
+			Kind           string   `json:"kind"`
+			Value          int64    `json:"value"`
+			EventIDs       []int64  `json:"event_ids"`
+			Ranks          []string `json:"ranks"`
+			MaxUses        int      `json:"max_uses"`
+			MaxUsesPerUser int      `json:"max_uses_per_user"`
+			ExpiresAt      int64    `json:"expires_at"`
+		}
+		c.Bind(&params)
+		promo := PromoCode{
+			Code:           normalizePromoCode(params.Code),
+			Kind:           params.Kind,
+			Value:          params.Value,
+			Scope:          PromoScope{EventIDs: params.EventIDs, Ranks: params.Ranks},
+			MaxUses:        params.MaxUses,
+			MaxUsesPerUser: params.MaxUsesPerUser,
+		}
+		if params.ExpiresAt < 0 {
+			return resError(c, "invalid_promo_code", 400)
+		} else if params.ExpiresAt > 0 {
+			expiresAt := time.Unix(params.ExpiresAt, 0).UTC()
+			promo.ExpiresAt = &expiresAt
+		}
+		if err := promo.Validate(); err != nil {
+			return resError(c, "invalid_promo_code", 400)
+		}
+
+		created, err := store.CreatePromoCode(promo)
+		if err != nil {
+			switch err {
+			case ErrDuplicated:
+				return resError(c, "duplicated", 409)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+		return c.JSON(200, promoJSON(created, nil))
+	}, adminLoginRequired)
+	e.GET("/admin/api/promo_codes/:id", func(c echo.Context) error {
+		promoID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		promo, err := store.GetPromoCode(promoID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "not_found", 404)
+			}
+			return err
+		}
+
+		redemptions := store.PromoRedemptions(promo.ID)
+		res := promoJSON(promo, redemptions)
+		list := make([]echo.Map, len(redemptions))
+		for i, r := range redemptions {
+			sheet := getSheetFromId(r.SheetID)
+			item := echo.Map{
+				"reservation_id": r.ID,
+				"event_id":       r.EventID,
+				"user_id":        r.UserID,
+				"sheet_rank":     sheet.Rank,
+				"sheet_num":      sheet.Num,
+				"price":          r.Price,
+				"discount":       r.charged().Discount,
+				"reserved_at":    r.ReservedAt.Unix(),
+			}
+			if r.CanceledAt != nil {
+				item["canceled_at"] = r.CanceledAt.Unix()
+			}
+			list[i] = item
+		}
+		res["redemptions"] = list
+		return c.JSON(200, res)
+	}, adminLoginRequired)
+	e.POST("/admin/api/promo_codes/:id/actions/disable", func(c echo.Context) error {
+		promoID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		promo, err := store.DisablePromoCode(promoID)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				return resError(c, "not_found", 404)
+			case ErrWriterBusy:
+				return resError(c, "busy", 503)
+			}
+			return err
+		}
+		return c.JSON(200, promoJSON(promo, store.PromoRedemptions(promo.ID)))
+	}, adminLoginRequired)
+	e.GET("/admin/api/reconcile", func(c echo.Context) error {
+		ms, ok := store.(*mysqlStore)
+		if !ok {
+			return resError(c, "not_supported", 404)
+		}
+		report, err := ms.Reconcile(repairNone)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, report)
+	}, adminLoginRequired)
+	e.GET("/admin/api/reconcile/last", func(c echo.Context) error {
+		ms, ok := store.(*mysqlStore)
+		if !ok {
+			return resError(c, "not_supported", 404)
+		}
+		report := ms.LastReconcile()
+		if report == nil {
+			return resError(c, "not_found", 404)
+		}
+		return c.JSON(200, report)
+	}, adminLoginRequired)
+	e.POST("/admin/api/reconcile", func(c echo.Context) error {
+		var params struct {
+			Repair string `json:"repair"`
+		}
+		c.Bind(&params)
+		if params.Repair != repairDB && params.Repair != repairMemory {
+			return resError(c, "invalid_repair", 400)
+		}
+
+		ms, ok := store.(*mysqlStore)
+		if !ok {
+			return resError(c, "not_supported", 404)
+		}
+		report, err := ms.Reconcile(params.Repair)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, report)
+	}, adminLoginRequired)
+	e.GET("/admin/api/writer", func(c echo.Context) error {
+		ms, ok := store.(*mysqlStore)
+		if !ok {
+			return resError(c, "not_supported", 404)
+		}
+		return c.JSON(200, ms.writer.Stats())
 	}, adminLoginRequired)
 	e.GET("/admin/api/reports/events/:id/sales", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
@@ -1060,25 +1864,20 @@ func main() {
 			return resError(c, "not_found", 404)
 		}
 
-		event, err := getEvent(eventID, -1)
+		event, err := store.GetEvent(eventID)
 		if err != nil {
 			return err
 		}
 
-		var reservations []*Reservation
-		From(reservationStore).Where(func(c interface{}) bool {
-			r := c.(*Reservation)
-			if r.EventID != event.ID {
-				return false
-			}
-			return true
-		}).OrderBy(func(c interface{}) interface{} {
-			r := c.(*Reservation)
-			return r.ReservedAt.UnixNano()
-		}).ToSlice(&reservations)
+		reservations := store.ReservationsByEvent(event.ID)
+		promoCodes := promoCodeNames()
 
 		var reports []Report
 		for _, reservation := range reservations {
+			if reservation.ExpiresAt != nil {
+				// Unconfirmed holds are not sales.
+				continue
+			}
 			sheet := getSheetFromId(reservation.SheetID)
 			report := Report{
 				ReservationID: reservation.ID,
@@ -1087,30 +1886,31 @@ func main() {
 				Num:           sheet.Num,
 				UserID:        reservation.UserID,
 				SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
-				Price:         event.Price + sheet.Price,
+				Price:         reservation.Price,
+				PromoCode:     promoCodes[reservation.PromoCodeID],
+				Discount:      reservation.charged().Discount,
 			}
 			if reservation.CanceledAt != nil {
 				report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
 			}
-			reports = append(reports, report)
+			reports = appendReport(reports, report, reservation)
 		}
 		return renderReportCSV(c, reports)
 	}, adminLoginRequired)
 	e.GET("/admin/api/reports/sales", func(c echo.Context) error {
-		var reservations []*Reservation
-		From(reservationStore).OrderBy(func(c interface{}) interface{} {
-			r := c.(*Reservation)
-			return r.ReservedAt.UnixNano()
-		}).ToSlice(&reservations)
+		reservations := store.AllReservations()
+		promoCodes := promoCodeNames()
 
-		events, _ := getEvents(true)
 		eventMap := make(map[int64]*Event)
-		for _, event := range events {
+		for _, event := range store.ListEvents() {
 			eventMap[event.ID] = event
 		}
 
 		var reports []Report
 		for _, reservation := range reservations {
+			if reservation.ExpiresAt != nil {
+				continue
+			}
 			event := eventMap[reservation.EventID]
 			sheet := getSheetFromId(reservation.SheetID)
 
@@ -1121,17 +1921,191 @@ func main() {
 				Num:           sheet.Num,
 				UserID:        reservation.UserID,
 				SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
-				Price:         event.Price + sheet.Price,
+				Price:         reservation.Price,
+				PromoCode:     promoCodes[reservation.PromoCodeID],
+				Discount:      reservation.charged().Discount,
 			}
 			if reservation.CanceledAt != nil {
 				report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
 			}
-			reports = append(reports, report)
+			reports = appendReport(reports, report, reservation)
 		}
 		return renderReportCSV(c, reports)
 	}, adminLoginRequired)
+	e.GET("/admin/api/reservations/:id/transfers", func(c echo.Context) error {
+		reservationID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return resError(c, "not_found", 404)
+		}
+		if _, err := store.GetReservation(reservationID); err != nil {
+			if err == sql.ErrNoRows {
+				return resError(c, "not_found", 404)
+			}
+			return err
+		}
+
+		transfers := store.TransfersByReservation(reservationID)
+		res := make([]echo.Map, len(transfers))
+		for i, t := range transfers {
+			res[i] = transferJSON(t)
+		}
+		return c.JSON(200, res)
+	}, adminLoginRequired)
+
+	return e
+}
+
+// sweepHolds releases expired holds every interval, so their seats go back
+// on sale.
+func sweepHolds(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := store.ReleaseExpiredHolds()
+		if err != nil {
+			log.Println("hold sweeper:", err)
+		}
+		if n > 0 {
+			log.Printf("hold sweeper: released %d holds", n)
+		}
+	}
+}
+
+// runTransitions applies scheduled event transitions as they come due.
+func runTransitions(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := store.ApplyDueTransitions()
+		if err != nil {
+			log.Println("transitions:", err)
+		}
+		if n > 0 {
+			log.Printf("transitions: ran %d", n)
+		}
+	}
+}
+
+// promoJSON describes a promo code with how often it is in use: uses counts
+// the redemptions still active, discount what they took off in total.
+func promoJSON(p *PromoCode, redemptions []*Reservation) echo.Map {
+	uses := 0
+	var discount int64
+	for _, r := range redemptions {
+		if r.CanceledAt == nil {
+			uses++
+			discount += r.charged().Discount
+		}
+	}
+	res := echo.Map{
+		"id":                p.ID,
+		"code":              p.Code,
+		"kind":              p.Kind,
+		"value":             p.Value,
+		"event_ids":         p.Scope.EventIDs,
+		"ranks":             p.Scope.Ranks,
+		"max_uses":          p.MaxUses,
+		"max_uses_per_user": p.MaxUsesPerUser,
+		"disabled":          p.Disabled,
+		"created_at":        p.CreatedAt.Unix(),
+		"uses":              uses,
+		"discount_total":    discount,
+	}
+	if p.ExpiresAt != nil {
+		res["expires_at"] = p.ExpiresAt.Unix()
+	}
+	return res
+}
+
+// transferJSON describes a transfer with what its two users need to tell
+// it apart: the event, the sheet and each other's nickname.
+func transferJSON(t *TicketTransfer) echo.Map {
+	status := "pending"
+	switch {
+	case t.Accepted:
+		status = "accepted"
+	case t.DoneAt != nil:
+		status = "canceled"
+	}
+	res := echo.Map{
+		"id":             t.ID,
+		"reservation_id": t.ReservationID,
+		"event_id":       t.EventID,
+		"from_user_id":   t.FromUserID,
+		"to_user_id":     t.ToUserID,
+		"status":         status,
+		"created_at":     t.CreatedAt.Unix(),
+	}
+	if t.DoneAt != nil {
+		res["done_at"] = t.DoneAt.Unix()
+	}
+	if e, err := store.GetEvent(t.EventID); err == nil {
+		res["event_title"] = e.Title
+	}
+	if r, err := store.GetReservation(t.ReservationID); err == nil {
+		if sheet := getSheetFromId(r.SheetID); sheet != nil {
+			res["sheet_rank"] = sheet.Rank
+			res["sheet_num"] = sheet.Num
+		}
+	}
+	if u, err := store.GetUser(t.FromUserID); err == nil {
+		res["from_nickname"] = u.Nickname
+	}
+	if u, err := store.GetUser(t.ToUserID); err == nil {
+		res["to_nickname"] = u.Nickname
+	}
+	return res
+}
 
-	e.Start(":8080")
+// transferClosed reports whether tickets of the event can no longer change
+// hands because it is closed or over.
+func transferClosed(eventID int64) bool {
+	e, err := store.GetEvent(eventID)
+	return err != nil || e.ClosedFg || e.Schedule.Over(time.Now())
+}
+
+func transitionJSON(t *EventTransition) echo.Map {
+	status := "pending"
+	switch {
+	case t.Canceled:
+		status = "canceled"
+	case t.Error != "":
+		status = "failed"
+	case t.DoneAt != nil:
+		status = "applied"
+	}
+	res := echo.Map{
+		"id":           t.ID,
+		"event_id":     t.EventID,
+		"public":       t.PublicFg,
+		"closed":       t.ClosedFg,
+		"run_at":       t.RunAt.Unix(),
+		"scheduled_by": t.ScheduledBy,
+		"created_at":   t.CreatedAt.Unix(),
+		"status":       status,
+	}
+	if t.DoneAt != nil {
+		res["done_at"] = t.DoneAt.Unix()
+	}
+	if t.Error != "" {
+		res["error"] = t.Error
+	}
+	return res
+}
+
+// shutdown stops accepting requests, waits for in-flight handlers and then
+// closes the store, all within timeout. It reports false when some writes are
+// left behind; they are still in the journal and get replayed on the next
+// start.
+func shutdown(e *echo.Echo, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := e.Shutdown(ctx); err != nil {
+		log.Println("shutdown: http server:", err)
+	}
+
+	if err := store.Close(ctx); err != nil {
+		return false
+	}
+	log.Println("shutdown: all writes flushed")
+	return true
 }
 
 type Report struct {
@@ -1143,15 +2117,47 @@ type Report struct {
 	SoldAt        string
 	CanceledAt    string
 	Price         int64
+	PromoCode     string
+	Discount      int64
+	// Type is "sale", or "refund" for the line a cancellation adds.
+	Type      string
+	CancelFee int64
+}
+
+// appendReport adds the sale of r, and if r was canceled the refund after
+// it. The refund is dated when r was canceled and pays back the price less
+// the cancellation fee, so the prices of both lines add up to the fee.
+func appendReport(reports []Report, sale Report, r *Reservation) []Report {
+	sale.Type = "sale"
+	reports = append(reports, sale)
+	if r.CanceledAt == nil {
+		return reports
+	}
+	refund := sale
+	refund.Type = "refund"
+	refund.SoldAt = sale.CanceledAt
+	refund.Price = -(r.Price - r.CancelFee)
+	refund.Discount = 0
+	refund.CancelFee = r.CancelFee
+	return append(reports, refund)
+}
+
+// promoCodeNames maps promo code ids to the codes, for reports.
+func promoCodeNames() map[int64]string {
+	names := make(map[int64]string)
+	for _, p := range store.ListPromoCodes() {
+		names[p.ID] = p.Code
+	}
+	return names
 }
 
 func renderReportCSV(c echo.Context, reports []Report) error {
 	sort.Slice(reports, func(i, j int) bool { return strings.Compare(reports[i].SoldAt, reports[j].SoldAt) < 0 })
 
-	body := bytes.NewBufferString("reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at\n")
+	body := bytes.NewBufferString("reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at,promo_code,discount,type,cancel_fee\n")
 	for _, v := range reports {
-		body.WriteString(fmt.Sprintf("%d,%d,%s,%d,%d,%d,%s,%s\n",
-			v.ReservationID, v.EventID, v.Rank, v.Num, v.Price, v.UserID, v.SoldAt, v.CanceledAt))
+		body.WriteString(fmt.Sprintf("%d,%d,%s,%d,%d,%d,%s,%s,%s,%d,%s,%d\n",
+			v.ReservationID, v.EventID, v.Rank, v.Num, v.Price, v.UserID, v.SoldAt, v.CanceledAt, v.PromoCode, v.Discount, v.Type, v.CancelFee))
 	}
 
 	c.Response().Header().Set("Content-Type", `text/csv; charset=UTF-8`)
@@ -1160,6 +2166,61 @@ func renderReportCSV(c echo.Context, reports []Report) error {
 	return err
 }
 
+// findPromo looks up a promo code for a sheet of rank at the event. reason
+// is the error to answer with if the code cannot be used; an empty code
+// gives no promo and no reason.
+func findPromo(code string, eventID int64, rank string) (promo *PromoCode, reason string, err error) {
+	if code == "" {
+		return nil, "", nil
+	}
+	if promo, err = store.FindPromoCode(code); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "invalid_promo_code", nil
+		}
+		return nil, "", err
+	}
+	switch promo.Check(eventID, rank, time.Now()) {
+	case ErrPromoExpired:
+		return nil, "promo_code_expired", nil
+	case ErrPromoNotApplicable:
+		return nil, "promo_code_not_applicable", nil
+	}
+	return promo, "", nil
+}
+
+// resScheduleError answers a request the event's schedule does not allow
+// right now.
+func resScheduleError(c echo.Context, err error) error {
+	switch err {
+	case ErrSalesNotStarted:
+		return resError(c, "sales_not_started", 403)
+	case ErrSalesEnded:
+		return resError(c, "sales_ended", 403)
+	}
+	return err
+}
+
+// resTransferError answers a transfer request the store turned down.
+func resTransferError(c echo.Context, err error) error {
+	switch err {
+	case sql.ErrNoRows:
+		return resError(c, "not_found", 404)
+	case ErrNotReserved:
+		return resError(c, "not_reserved", 400)
+	case ErrNotPermitted:
+		return resError(c, "not_permitted", 403)
+	case ErrTransferPending:
+		return resError(c, "transfer_pending", 409)
+	case ErrTransferDone:
+		return resError(c, "transfer_done", 409)
+	case ErrLimitExceeded:
+		return resError(c, "limit_exceeded", 409)
+	case ErrWriterBusy:
+		return resError(c, "busy", 503)
+	}
+	return err
+}
+
 func resError(c echo.Context, e string, status int) error {
 	if e == "" {
 		e = "unknown"
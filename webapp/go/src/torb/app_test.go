@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Templates and static files are found relative to webapp/go.
+	if err := os.Chdir("../.."); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// testApp is the whole app on a file store, so the API can be tested
+// without MySQL.
+type testApp struct {
+	t      *testing.T
+	path   string
+	store  *fileStore
+	server *httptest.Server
+}
+
+func startTestApp(t *testing.T, path string) *testApp {
+	a := &testApp{t: t, path: path, store: openTestStore(t, path)}
+	a.server = httptest.NewServer(newApp())
+	return a
+}
+
+// restart stops the app and starts it again on the same journal.
+func (a *testApp) restart() {
+	a.stop()
+	next := startTestApp(a.t, a.path)
+	a.store, a.server = next.store, next.server
+}
+
+func (a *testApp) stop() {
+	a.server.Close()
+	if err := a.store.Close(context.Background()); err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+// client is a browser session with its own cookies.
+func (a *testApp) client() *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+// do sends body as JSON and decodes the response into out, if given. It
+// returns the status code.
+func (a *testApp) do(c *http.Client, method, path string, body, out interface{}) int {
+	a.t.Helper()
+	code, _ := a.doWithHeader(c, nil, method, path, body, out)
+	return code
+}
+
+// doWithHeader is do with extra request headers. It returns the response
+// headers as well.
+func (a *testApp) doWithHeader(c *http.Client, header http.Header, method, path string, body, out interface{}) (int, http.Header) {
+	a.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			a.t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, a.server.URL+path, &buf)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.Do(req)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			a.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return res.StatusCode, res.Header
+}
+
+func (a *testApp) signUp(login string) (*http.Client, int64) {
+	a.t.Helper()
+	c := a.client()
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	if code := a.do(c, "POST", "/api/users", map[string]string{"nickname": login, "login_name": login, "password": "pw-" + login}, &user); code != 201 {
+		a.t.Fatalf("sign up %s: %d", login, code)
+	}
+	if code := a.do(c, "POST", "/api/actions/login", map[string]string{"login_name": login, "password": "pw-" + login}, nil); code != 200 {
+		a.t.Fatalf("login %s: %d", login, code)
+	}
+	return c, user.ID
+}
+
+func (a *testApp) createEvent(title string) int64 {
+	a.t.Helper()
+	admin := a.client()
+	if code := a.do(admin, "POST", "/admin/api/actions/login", map[string]string{"login_name": "admin", "password": "admin"}, nil); code != 200 {
+		a.t.Fatalf("admin login: %d", code)
+	}
+	var event struct {
+		ID int64 `json:"id"`
+	}
+	if code := a.do(admin, "POST", "/admin/api/events", map[string]interface{}{"title": title, "public": true, "price": 1000}, &event); code != 200 {
+		a.t.Fatalf("create event: %d", code)
+	}
+	return event.ID
+}
+
+type testReservation struct {
+	ID        int64  `json:"id"`
+	SheetRank string `json:"sheet_rank"`
+	SheetNum  int64  `json:"sheet_num"`
+}
+
+type testError struct {
+	Error string `json:"error"`
+}
+
+func (a *testApp) remains(c *http.Client, eventID int64, rank string) int {
+	a.t.Helper()
+	var event struct {
+		Sheets map[string]struct {
+			Remains int `json:"remains"`
+		} `json:"sheets"`
+	}
+	if code := a.do(c, "GET", fmt.Sprintf("/api/events/%d", eventID), nil, &event); code != 200 {
+		a.t.Fatalf("get event: %d", code)
+	}
+	return event.Sheets[rank].Remains
+}
+
+func TestLogin(t *testing.T) {
+	a := startTestApp(t, filepath.Join(t.TempDir(), "journal"))
+	defer a.stop()
+
+	c, userID := a.signUp("alice")
+	var me struct {
+		ID       int64  `json:"id"`
+		Nickname string `json:"nickname"`
+	}
+	if code := a.do(c, "GET", fmt.Sprintf("/api/users/%d", userID), nil, &me); code != 200 || me.ID != userID || me.Nickname != "alice" {
+		t.Errorf("own page: %d %+v", code, me)
+	}
+
+	var e testError
+	if code := a.do(a.client(), "POST", "/api/actions/login", map[string]string{"login_name": "alice", "password": "wrong"}, &e); code != 401 || e.Error != "authentication_failed" {
+		t.Errorf("wrong password: %d %q", code, e.Error)
+	}
+	if code := a.do(a.client(), "POST", "/api/users", map[string]string{"nickname": "x", "login_name": "alice", "password": "x"}, &e); code != 409 || e.Error != "duplicated" {
+		t.Errorf("duplicate sign up: %d %q", code, e.Error)
+	}
+	if code := a.do(a.client(), "GET", fmt.Sprintf("/api/users/%d", userID), nil, &e); code != 401 || e.Error != "login_required" {
+		t.Errorf("page without login: %d %q", code, e.Error)
+	}
+}
+
+func TestReserveAndCancel(t *testing.T) {
+	a := startTestApp(t, filepath.Join(t.TempDir(), "journal"))
+	defer a.stop()
+
+	eventID := a.createEvent("concert")
+	alice, _ := a.signUp("alice")
+	bob, _ := a.signUp("bob")
+
+	var r testReservation
+	if code := a.do(alice, "POST", fmt.Sprintf("/api/events/%d/actions/reserve", eventID), map[string]string{"sheet_rank": "S"}, &r); code != 202 || r.SheetRank != "S" {
+		t.Fatalf("reserve: %d %+v", code, r)
+	}
+	if got := a.remains(alice, eventID, "S"); got != 49 {
+		t.Errorf("remains after reserve = %d, want 49", got)
+	}
+
+	cancelPath := fmt.Sprintf("/api/events/%d/sheets/S/%d/reservation", eventID, r.SheetNum)
+	var e testError
+	if code := a.do(bob, "DELETE", cancelPath, nil, &e); code != 403 || e.Error != "not_permitted" {
+		t.Errorf("cancel someone else's: %d %q", code, e.Error)
+	}
+	if code := a.do(alice, "DELETE", cancelPath, nil, nil); code != 204 {
+		t.Fatalf("cancel: %d", code)
+	}
+	if code := a.do(alice, "DELETE", cancelPath, nil, &e); code != 400 || e.Error != "not_reserved" {
+		t.Errorf("cancel twice: %d %q", code, e.Error)
+	}
+	if got := a.remains(alice, eventID, "S"); got != 50 {
+		t.Errorf("remains after cancel = %d, want 50", got)
+	}
+}
+
+func TestTransferAcceptUnderLimits(t *testing.T) {
+	a := startTestApp(t, filepath.Join(t.TempDir(), "journal"))
+	defer a.stop()
+
+	eventID := a.createEvent("concert")
+	admin := a.client()
+	if code := a.do(admin, "POST", "/admin/api/actions/login", map[string]string{"login_name": "admin", "password": "admin"}, nil); code != 200 {
+		t.Fatalf("admin login: %d", code)
+	}
+	if code := a.do(admin, "POST", fmt.Sprintf("/admin/api/events/%d/actions/limits", eventID), map[string]int{"event": 1}, nil); code != 200 {
+		t.Fatalf("set limits: %d", code)
+	}
+	alice, _ := a.signUp("alice")
+	bob, _ := a.signUp("bob")
+
+	reservePath := fmt.Sprintf("/api/events/%d/actions/reserve", eventID)
+	var given, own testReservation
+	if code := a.do(alice, "POST", reservePath, map[string]string{"sheet_rank": "S"}, &given); code != 202 {
+		t.Fatalf("alice reserve: %d", code)
+	}
+	if code := a.do(bob, "POST", reservePath, map[string]string{"sheet_rank": "A"}, &own); code != 202 {
+		t.Fatalf("bob reserve: %d", code)
+	}
+
+	var tr struct {
+		ID     int64  `json:"id"`
+		Status string `json:"status"`
+	}
+	if code := a.do(alice, "POST", fmt.Sprintf("/api/reservations/%d/actions/transfer", given.ID), map[string]string{"login_name": "bob"}, &tr); code != 200 || tr.Status != "pending" {
+		t.Fatalf("offer: %d %+v", code, tr)
+	}
+
+	// Bob holds as many as the event allows, so he cannot take another.
+	acceptPath := fmt.Sprintf("/api/transfers/%d/actions/accept", tr.ID)
+	var e testError
+	if code := a.do(bob, "POST", acceptPath, nil, &e); code != 409 || e.Error != "limit_exceeded" {
+		t.Errorf("accept at the limit: %d %q", code, e.Error)
+	}
+	if code := a.do(bob, "DELETE", fmt.Sprintf("/api/events/%d/sheets/A/%d/reservation", eventID, own.SheetNum), nil, nil); code != 204 {
+		t.Fatalf("bob cancel: %d", code)
+	}
+	if code := a.do(bob, "POST", acceptPath, nil, &tr); code != 200 || tr.Status != "accepted" {
+		t.Errorf("accept under the limit: %d %+v", code, tr)
+	}
+	if code := a.do(bob, "DELETE", fmt.Sprintf("/api/events/%d/sheets/S/%d/reservation", eventID, given.SheetNum), nil, nil); code != 204 {
+		t.Errorf("cancel the accepted reservation: %d", code)
+	}
+}
+
+func TestRestartReplaysJournal(t *testing.T) {
+	a := startTestApp(t, filepath.Join(t.TempDir(), "journal"))
+	defer func() { a.stop() }()
+
+	eventID := a.createEvent("concert")
+	alice, aliceID := a.signUp("alice")
+
+	var kept, canceled testReservation
+	if code := a.do(alice, "POST", fmt.Sprintf("/api/events/%d/actions/reserve", eventID), map[string]string{"sheet_rank": "A"}, &kept); code != 202 {
+		t.Fatalf("reserve: %d", code)
+	}
+	if code := a.do(alice, "POST", fmt.Sprintf("/api/events/%d/actions/reserve", eventID), map[string]string{"sheet_rank": "A"}, &canceled); code != 202 {
+		t.Fatalf("reserve: %d", code)
+	}
+	if code := a.do(alice, "DELETE", fmt.Sprintf("/api/events/%d/sheets/A/%d/reservation", eventID, canceled.SheetNum), nil, nil); code != 204 {
+		t.Fatalf("cancel: %d", code)
+	}
+
+	a.restart()
+
+	// Log in afresh: the user has to come back from the journal too.
+	c := a.client()
+	if code := a.do(c, "POST", "/api/actions/login", map[string]string{"login_name": "alice", "password": "pw-alice"}, nil); code != 200 {
+		t.Fatalf("login after restart: %d", code)
+	}
+	if got := a.remains(c, eventID, "A"); got != 149 {
+		t.Errorf("remains after restart = %d, want 149", got)
+	}
+	var me struct {
+		RecentReservations []struct {
+			ID         int64 `json:"id"`
+			CanceledAt int64 `json:"canceled_at"`
+		} `json:"recent_reservations"`
+	}
+	if code := a.do(c, "GET", fmt.Sprintf("/api/users/%d", aliceID), nil, &me); code != 200 {
+		t.Fatalf("own page: %d", code)
+	}
+	state := make(map[int64]bool)
+	for _, r := range me.RecentReservations {
+		state[r.ID] = r.CanceledAt != 0
+	}
+	if gone, ok := state[kept.ID]; !ok || gone {
+		t.Errorf("reservation %d after restart: found %v, canceled %v", kept.ID, ok, gone)
+	}
+	if gone, ok := state[canceled.ID]; !ok || !gone {
+		t.Errorf("reservation %d after restart: found %v, canceled %v", canceled.ID, ok, gone)
+	}
+
+	var r testReservation
+	if code := a.do(c, "POST", fmt.Sprintf("/api/events/%d/actions/reserve", eventID), map[string]string{"sheet_rank": "A"}, &r); code != 202 || r.ID <= canceled.ID {
+		t.Errorf("reserve after restart: %d, id %d after %d", code, r.ID, canceled.ID)
+	}
+	checkReservationInvariants(t, a.store, eventID)
+}
+
+func TestIdempotentReserve(t *testing.T) {
+	a := startTestApp(t, filepath.Join(t.TempDir(), "journal"))
+	defer a.stop()
+
+	eventID := a.createEvent("concert")
+	alice, _ := a.signUp("alice")
+	bob, _ := a.signUp("bob")
+
+	// The cache outlives the app, so keys are made unique to the test.
+	key := http.Header{"Idempotency-Key": {t.Name()}}
+	path := fmt.Sprintf("/api/events/%d/actions/reserve", eventID)
+	var first, again testReservation
+	code, header := a.doWithHeader(alice, key, "POST", path, map[string]string{"sheet_rank": "S"}, &first)
+	if code != 202 || header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("reserve: %d, replayed %q", code, header.Get("Idempotent-Replayed"))
+	}
+	code, header = a.doWithHeader(alice, key, "POST", path, map[string]string{"sheet_rank": "S"}, &again)
+	if code != 202 || header.Get("Idempotent-Replayed") != "true" || again != first {
+		t.Errorf("retry: %d, replayed %q, %+v after %+v", code, header.Get("Idempotent-Replayed"), again, first)
+	}
+	if got := a.remains(alice, eventID, "S"); got != 49 {
+		t.Errorf("remains after retry = %d, want 49", got)
+	}
+
+	var e testError
+	if code, _ := a.doWithHeader(alice, key, "POST", path, map[string]string{"sheet_rank": "A"}, &e); code != 422 || e.Error != "idempotency_key_reused" {
+		t.Errorf("key reused for another request: %d %q", code, e.Error)
+	}
+
+	// Keys are per user.
+	var other testReservation
+	if code, _ := a.doWithHeader(bob, key, "POST", path, map[string]string{"sheet_rank": "S"}, &other); code != 202 || other.ID == first.ID {
+		t.Errorf("same key, other user: %d %+v", code, other)
+	}
+	if got := a.remains(alice, eventID, "S"); got != 48 {
+		t.Errorf("remains = %d, want 48", got)
+	}
+}
+
+// TestSharedIdempotencyClaim needs a MySQL with the torb schema, named by
+// TEST_MYSQL_DSN. Two sharedIdempotency values on it stand for two
+// processes.
+func TestSharedIdempotencyClaim(t *testing.T) {
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("TEST_MYSQL_DSN not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const userID = 1
+	key := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	defer db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND idem_key = ?", userID, key)
+	one := newSharedIdempotency(db, time.Minute)
+	two := newSharedIdempotency(db, time.Minute)
+	ctx := context.Background()
+
+	if stored, err := one.claim(ctx, userID, key, "fp"); err != nil || stored != nil {
+		t.Fatalf("first claim: %v %v", stored, err)
+	}
+	if _, err := two.claim(ctx, userID, key, "other"); err != errIdempotencyKeyReused {
+		t.Errorf("claim for another request: %v, want %v", err, errIdempotencyKeyReused)
+	}
+
+	// The second process waits for the first to finish and replays it.
+	replayed := make(chan *idempotencyEntry)
+	go func() {
+		stored, err := two.claim(ctx, userID, key, "fp")
+		if err != nil {
+			t.Error(err)
+		}
+		replayed <- stored
+	}()
+	time.Sleep(2 * idempotencyPoll)
+	one.finish(userID, key, 202, "application/json", []byte(`{"id":1}`))
+	if stored := <-replayed; stored == nil || stored.status != 202 || string(stored.body) != `{"id":1}` {
+		t.Errorf("second claim replayed %+v", stored)
+	}
+
+	// A claim whose process went away is taken over once its lease is up.
+	lost := key + "-lost"
+	defer db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND idem_key = ?", userID, lost)
+	one.lease = time.Millisecond
+	if stored, err := one.claim(ctx, userID, lost, "fp"); err != nil || stored != nil {
+		t.Fatalf("first claim: %v %v", stored, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if stored, err := two.claim(ctx, userID, lost, "fp"); err != nil || stored != nil {
+		t.Errorf("claim after the lease: %v %v", stored, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrCancelClosed        = errors.New("cancellation closed")
+	errInvalidCancellation = errors.New("invalid cancellation policy")
+)
+
+// CancellationPolicy says until when reservations of an event can be
+// canceled and what is kept of their price. Both count seconds before the
+// event starts, so the policy only applies once the event's schedule has a
+// start. It is stored as JSON in events.cancellation.
+type CancellationPolicy struct {
+	// ClosesBefore stops cancellations that many seconds before the start.
+	ClosesBefore int64             `json:"closes_before,omitempty"`
+	Fees         []CancellationFee `json:"fees,omitempty"`
+}
+
+// CancellationFee keeps Percent of the price plus Amount when a reservation
+// is canceled no more than Before seconds before the event starts. Of the
+// fees that apply the one with the smallest Before counts.
+type CancellationFee struct {
+	Before  int64 `json:"before"`
+	Percent int64 `json:"percent,omitempty"`
+	Amount  int64 `json:"amount,omitempty"`
+}
+
+func (p *CancellationPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.ClosesBefore < 0 {
+		return errInvalidCancellation
+	}
+	for _, f := range p.Fees {
+		if f.Before <= 0 || f.Percent < 0 || f.Percent > 100 || f.Amount < 0 {
+			return errInvalidCancellation
+		}
+	}
+	return nil
+}
+
+func (p *CancellationPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+func (p CancellationPolicy) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
+func (p *CancellationPolicy) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, p)
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	}
+	return fmt.Errorf("cannot scan %T into CancellationPolicy", src)
+}
+
+// Fee returns the fee for canceling at now a reservation of an event on
+// schedule, nil if it is free, or ErrCancelClosed if it is too late.
+func (p *CancellationPolicy) Fee(schedule *EventSchedule, now time.Time) (*CancellationFee, error) {
+	if p == nil || schedule == nil || schedule.StartsAt == 0 {
+		return nil, nil
+	}
+	left := schedule.StartsAt - now.Unix()
+	if p.ClosesBefore > 0 && left < p.ClosesBefore {
+		return nil, ErrCancelClosed
+	}
+	var fee *CancellationFee
+	for i, f := range p.Fees {
+		if left <= f.Before && (fee == nil || f.Before < fee.Before) {
+			fee = &p.Fees[i]
+		}
+	}
+	return fee, nil
+}
+
+// cancelTerms gives the fee for canceling a reservation now, nil if it is
+// free, or the error that stops it.
+type cancelTerms func() (*CancellationFee, error)
+
+// feeFor is what canceling r keeps of its price. Holds, sheets offered off
+// the waitlist included, are not paid for yet: they can be let go at any
+// time and keep nothing.
+func (t cancelTerms) feeFor(r *Reservation) (int64, error) {
+	if t == nil || r.ExpiresAt != nil {
+		return 0, nil
+	}
+	fee, err := t()
+	if err != nil {
+		return 0, err
+	}
+	return fee.Of(r.Price), nil
+}
+
+// Of is what the fee keeps of price; it never keeps more than all of it.
+func (f *CancellationFee) Of(price int64) int64 {
+	if f == nil {
+		return 0
+	}
+	fee := price*f.Percent/100 + f.Amount
+	if fee > price {
+		fee = price
+	}
+	return fee
+}
@@ -0,0 +1,1327 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clusterStore lets several app instances share one MySQL. Mutations are
+// written to MySQL synchronously, each together with a row in the changes
+// table, and every instance (the writer included) applies its in-memory
+// changes by polling that table in id order.
+//
+// Auto-increment ids are handed out before commit, so a change can become
+// visible after one with a higher id. The poller therefore stops at a gap
+// and only skips it once it is older than gapTimeout, which is never less
+// than MySQL's lock wait timeout, so the transaction that took the id has
+// most likely committed or rolled back by then. Skipped ids are looked for
+// again on every poll, and if one does show up memory is reloaded.
+type clusterStore struct {
+	*memoryStore
+	mysqlAccounts
+	db *sql.DB
+
+	pollInterval time.Duration
+	gapTimeout   time.Duration
+	waitTries    int
+	retention    time.Duration
+
+	pollMu     sync.Mutex
+	lastChange int64
+	gapSince   time.Time
+	lastPolled time.Time
+	// skipped holds the change ids the poller gave up waiting for, with
+	// when it did.
+	skipped map[int64]time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newClusterStore(db *sql.DB) *clusterStore {
+	s := &clusterStore{
+		memoryStore:   newMemoryStore(nil, nopSink{}),
+		mysqlAccounts: mysqlAccounts{db},
+		db:            db,
+		pollInterval:  time.Duration(GetenvInt("CLUSTER_POLL_INTERVAL_MS", 100)) * time.Millisecond,
+		gapTimeout:    time.Duration(GetenvInt("CLUSTER_GAP_TIMEOUT_MS", 5000)) * time.Millisecond,
+		waitTries:     GetenvInt("CLUSTER_WAIT_TRIES", 5),
+		retention:     time.Duration(GetenvInt("CLUSTER_CHANGE_RETENTION_SEC", 3600)) * time.Second,
+		skipped:       make(map[int64]time.Time),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	var lockWait int64
+	if err := db.QueryRow("SELECT @@innodb_lock_wait_timeout").Scan(&lockWait); err != nil {
+		log.Println("cluster: cannot read innodb_lock_wait_timeout:", err)
+	} else if min := time.Duration(lockWait+1) * time.Second; s.gapTimeout < min {
+		s.gapTimeout = min
+	}
+	go s.run()
+	return s
+}
+
+// Load rebuilds memory from MySQL. The change log position is read first, so
+// anything committed while loading is applied again by the poller, which is
+// harmless.
+func (s *clusterStore) Load() error {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+	return s.load()
+}
+
+func (s *clusterStore) load() error {
+	var last int64
+	if err := s.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM changes").Scan(&last); err != nil {
+		return err
+	}
+	inflight, err := recentGaps(s.db, last, time.Now().UTC().Add(-s.gapTimeout))
+	if err != nil {
+		return err
+	}
+	catalog, err := loadVenueCatalog(s.db)
+	if err != nil {
+		return err
+	}
+	s.setVenues(catalog)
+	if err := backfillPrices(s.db); err != nil {
+		return err
+	}
+	reservations, err := loadReservations(s.db)
+	if err != nil {
+		return err
+	}
+	events, err := loadEvents(s.db)
+	if err != nil {
+		return err
+	}
+	waitlist, err := loadWaitlist(s.db)
+	if err != nil {
+		return err
+	}
+	transitions, err := loadTransitions(s.db)
+	if err != nil {
+		return err
+	}
+	promos, err := loadPromoCodes(s.db)
+	if err != nil {
+		return err
+	}
+	transfers, err := loadTransfers(s.db)
+	if err != nil {
+		return err
+	}
+	activeLimit, err := loadActiveLimit(s.db)
+	if err != nil {
+		return err
+	}
+	s.reservations.Replace(reservations)
+	s.events.Replace(events)
+	s.waitlist.Replace(waitlist)
+	s.transitions.Replace(transitions)
+	s.promos.Replace(promos)
+	s.transfers.Replace(transfers)
+	atomic.StoreInt64(&s.activeLimit, int64(activeLimit))
+	s.lastChange = last
+	s.gapSince = time.Time{}
+	s.lastPolled = time.Now()
+	s.skipped = make(map[int64]time.Time)
+	for _, id := range inflight {
+		s.skipped[id] = s.lastPolled
+	}
+	return nil
+}
+
+// recentGaps returns the ids up to last missing from the changes logged
+// since, which belong to transactions that may still commit.
+func recentGaps(db *sql.DB, last int64, since time.Time) ([]int64, error) {
+	rows, err := db.Query("SELECT id FROM changes WHERE id <= ? AND created_at >= ? ORDER BY id ASC", last, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gaps []int64
+	var prev int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		for prev != 0 && prev+1 < id {
+			prev++
+			gaps = append(gaps, prev)
+		}
+		prev = id
+	}
+	return gaps, rows.Err()
+}
+
+func (s *clusterStore) Initialize() error {
+	if err := runInitScript(); err != nil {
+		return err
+	}
+	return s.Load()
+}
+
+func (s *clusterStore) Close(ctx context.Context) error {
+	close(s.stop)
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *clusterStore) run() {
+	defer close(s.done)
+
+	poll := time.NewTicker(s.pollInterval)
+	defer poll.Stop()
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-poll.C:
+			if err := s.poll(); err != nil {
+				log.Println("cluster: poll failed:", err)
+			}
+		case <-prune.C:
+			if _, err := s.db.Exec("DELETE FROM changes WHERE created_at < ?", time.Now().UTC().Add(-s.retention)); err != nil {
+				log.Println("cluster: prune failed:", err)
+			}
+		}
+	}
+}
+
+// poll applies every change committed since the last one seen.
+func (s *clusterStore) poll() error {
+	s.pollMu.Lock()
+	defer s.pollMu.Unlock()
+
+	// Changes older than the retention period may have been pruned, and a
+	// smaller max id means the database was reinitialized. Either way the
+	// log can no longer be trusted to bring memory up to date.
+	if time.Since(s.lastPolled) > s.retention/2 {
+		log.Println("cluster: change log fell behind, reloading")
+		return s.load()
+	}
+	if late, err := s.lateChange(); err != nil {
+		return err
+	} else if late != 0 {
+		log.Printf("cluster: skipped change %d committed late, reloading", late)
+		return s.load()
+	}
+	var max int64
+	if err := s.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM changes").Scan(&max); err != nil {
+		return err
+	}
+	if max < s.lastChange {
+		log.Println("cluster: change log was reset, reloading")
+		return s.load()
+	}
+	s.lastPolled = time.Now()
+	if max == s.lastChange {
+		return nil
+	}
+	return s.fetch()
+}
+
+// lateChange returns a skipped change id that has shown up since, or 0.
+// Skipped ids older than the retention period are forgotten.
+func (s *clusterStore) lateChange() (int64, error) {
+	if len(s.skipped) == 0 {
+		return 0, nil
+	}
+	args := make([]interface{}, 0, len(s.skipped))
+	for id, at := range s.skipped {
+		if time.Since(at) > s.retention {
+			delete(s.skipped, id)
+			continue
+		}
+		args = append(args, id)
+	}
+	if len(args) == 0 {
+		return 0, nil
+	}
+	var late int64
+	if err := s.db.QueryRow("SELECT COALESCE(MIN(id), 0) FROM changes WHERE id IN "+placeholders(1, len(args)), args...).Scan(&late); err != nil {
+		return 0, err
+	}
+	return late, nil
+}
+
+// fetch applies the changes after the last one seen, stopping at a gap
+// until it is older than gapTimeout. The caller holds pollMu.
+func (s *clusterStore) fetch() error {
+	rows, err := s.db.Query("SELECT id, op, data FROM changes WHERE id > ? ORDER BY id ASC", s.lastChange)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec journalRecord
+		var data []byte
+		if err := rows.Scan(&rec.Seq, &rec.Op, &data); err != nil {
+			return err
+		}
+		rec.Data = data
+
+		if rec.Seq != s.lastChange+1 {
+			if s.gapSince.IsZero() {
+				s.gapSince = time.Now()
+			}
+			if time.Since(s.gapSince) < s.gapTimeout {
+				return nil
+			}
+			log.Printf("cluster: skipping changes %d-%d", s.lastChange+1, rec.Seq-1)
+			for id := s.lastChange + 1; id < rec.Seq; id++ {
+				s.skipped[id] = time.Now()
+			}
+		}
+		s.gapSince = time.Time{}
+
+		if ok, err := s.apply(&rec); err != nil {
+			return err
+		} else if !ok {
+			log.Println("cluster: unknown op", rec.Op)
+		}
+		s.lastChange = rec.Seq
+	}
+	return rows.Err()
+}
+
+// waitFor fetches changes until the change id has been applied, so a client
+// sees its own write on the next request. As id is known to be committed it
+// skips the checks poll makes. Fetches back off up to the poll interval; if
+// id has not been applied after waitTries of them, an earlier change is
+// holding it up and memory is reloaded instead, which takes id in.
+func (s *clusterStore) waitFor(id int64) {
+	backoff := time.Millisecond
+	for try := 0; ; try++ {
+		s.pollMu.Lock()
+		applied := s.lastChange >= id
+		if !applied && try < s.waitTries {
+			if err := s.fetch(); err != nil {
+				log.Println("cluster: fetch failed:", err)
+			}
+			applied = s.lastChange >= id
+		} else if !applied {
+			log.Printf("cluster: change %d held up, reloading", id)
+			if err := s.load(); err != nil {
+				log.Println("cluster: reload failed:", err)
+			}
+			applied = true
+		}
+		s.pollMu.Unlock()
+		if applied {
+			return
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > s.pollInterval {
+			backoff = s.pollInterval
+		}
+	}
+}
+
+// mutate runs fn in a transaction and waits until the change it logged has
+// been applied locally.
+func (s *clusterStore) mutate(fn func(tx *sql.Tx) (int64, error)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	changeID, err := fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.waitFor(changeID)
+	return nil
+}
+
+// logChange should be the last statement of a transaction, to keep the time
+// between taking a change id and committing it short.
+func logChange(tx *sql.Tx, op string, record interface{}) (int64, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("INSERT INTO changes (op, data, created_at) VALUES (?, ?, ?)", op, data, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *clusterStore) CreateEvent(e Event) (*Event, error) {
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		res, err := tx.Exec("INSERT INTO events (title, public_fg, closed_fg, price, venue_id, allocation, limits, schedule, pricing, cancellation) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", e.Title, e.PublicFg, e.ClosedFg, e.Price, e.VenueID, e.Allocation, e.Limits, e.Schedule, e.Pricing, e.Cancellation)
+		if err != nil {
+			return 0, err
+		}
+		if e.ID, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opEventCreate, eventRecord{
+			ID:       e.ID,
+			Title:    e.Title,
+			PublicFg: e.PublicFg,
+			ClosedFg: e.ClosedFg,
+			Price:    e.Price,
+			VenueID:  e.VenueID,
+
+			Allocation:   e.Allocation,
+			Limits:       e.Limits,
+			Schedule:     e.Schedule,
+			Pricing:      e.Pricing,
+			Cancellation: e.Cancellation,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *clusterStore) UpdateEvent(id int64, public, closed bool) (*Event, error) {
+	var e Event
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := tx.QueryRow("SELECT id, title, public_fg, closed_fg, price, venue_id, allocation, limits, schedule, pricing, cancellation FROM events WHERE id = ? FOR UPDATE", id).Scan(&e.ID, &e.Title, &e.PublicFg, &e.ClosedFg, &e.Price, &e.VenueID, &e.Allocation, &e.Limits, &e.Schedule, &e.Pricing, &e.Cancellation); err != nil {
+			return 0, err
+		}
+		if err := setEventFlags(&e, public, closed); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE events SET public_fg = ?, closed_fg = ? WHERE id = ?", e.PublicFg, e.ClosedFg, e.ID); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opEventUpdate, eventRecord{ID: e.ID, PublicFg: e.PublicFg, ClosedFg: e.ClosedFg})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *clusterStore) SetEventAllocation(id int64, policy *SeatPolicy) (*Event, error) {
+	var e Event
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := tx.QueryRow("SELECT id, title, public_fg, closed_fg, price, venue_id, limits, schedule, pricing, cancellation FROM events WHERE id = ? FOR UPDATE", id).Scan(&e.ID, &e.Title, &e.PublicFg, &e.ClosedFg, &e.Price, &e.VenueID, &e.Limits, &e.Schedule, &e.Pricing, &e.Cancellation); err != nil {
+			return 0, err
+		}
+		if e.ClosedFg {
+			return 0, errCannotEditClosedEvent
+		}
+		e.Allocation = policy
+		if _, err := tx.Exec("UPDATE events SET allocation = ? WHERE id = ?", e.Allocation, e.ID); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opEventSeats, eventRecord{ID: e.ID, Allocation: e.Allocation})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *clusterStore) SetEventLimits(id int64, limits *PurchaseLimits) (*Event, error) {
+	var e Event
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := tx.QueryRow("SELECT id, title, public_fg, closed_fg, price, venue_id, allocation, schedule, pricing, cancellation FROM events WHERE id = ? FOR UPDATE", id).Scan(&e.ID, &e.Title, &e.PublicFg, &e.ClosedFg, &e.Price, &e.VenueID, &e.Allocation, &e.Schedule, &e.Pricing, &e.Cancellation); err != nil {
+			return 0, err
+		}
+		if e.ClosedFg {
+			return 0, errCannotEditClosedEvent
+		}
+		e.Limits = limits
+		if _, err := tx.Exec("UPDATE events SET limits = ? WHERE id = ?", e.Limits, e.ID); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opEventLimits, eventRecord{ID: e.ID, Limits: e.Limits})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *clusterStore) SetActiveLimit(max int) error {
+	return s.mutate(func(tx *sql.Tx) (int64, error) {
+		if _, err := tx.Exec("INSERT INTO settings (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)", settingActiveLimit, strconv.Itoa(max)); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opActiveLimit, activeLimitRecord{Max: max})
+	})
+}
+
+func (s *clusterStore) SetEventSchedule(id int64, schedule *EventSchedule) (*Event, error) {
+	var e Event
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := tx.QueryRow("SELECT id, title, public_fg, closed_fg, price, venue_id, allocation, limits, pricing, cancellation FROM events WHERE id = ? FOR UPDATE", id).Scan(&e.ID, &e.Title, &e.PublicFg, &e.ClosedFg, &e.Price, &e.VenueID, &e.Allocation, &e.Limits, &e.Pricing, &e.Cancellation); err != nil {
+			return 0, err
+		}
+		if e.ClosedFg {
+			return 0, errCannotEditClosedEvent
+		}
+		e.Schedule = schedule
+		if _, err := tx.Exec("UPDATE events SET schedule = ? WHERE id = ?", e.Schedule, e.ID); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opEventSchedule, eventRecord{ID: e.ID, Schedule: e.Schedule})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *clusterStore) SetEventPricing(id int64, pricing *PricingPolicy) (*Event, error) {
+	var e Event
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := tx.QueryRow("SELECT id, title, public_fg, closed_fg, price, venue_id, allocation, limits, schedule, cancellation FROM events WHERE id = ? FOR UPDATE", id).Scan(&e.ID, &e.Title, &e.PublicFg, &e.ClosedFg, &e.Price, &e.VenueID, &e.Allocation, &e.Limits, &e.Schedule, &e.Cancellation); err != nil {
+			return 0, err
+		}
+		if e.ClosedFg {
+			return 0, errCannotEditClosedEvent
+		}
+		e.Pricing = pricing
+		if _, err := tx.Exec("UPDATE events SET pricing = ? WHERE id = ?", e.Pricing, e.ID); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opEventPricing, eventRecord{ID: e.ID, Pricing: e.Pricing})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *clusterStore) SetEventCancellation(id int64, policy *CancellationPolicy) (*Event, error) {
+	var e Event
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := tx.QueryRow("SELECT id, title, public_fg, closed_fg, price, venue_id, allocation, limits, schedule, pricing FROM events WHERE id = ? FOR UPDATE", id).Scan(&e.ID, &e.Title, &e.PublicFg, &e.ClosedFg, &e.Price, &e.VenueID, &e.Allocation, &e.Limits, &e.Schedule, &e.Pricing); err != nil {
+			return 0, err
+		}
+		if e.ClosedFg {
+			return 0, errCannotEditClosedEvent
+		}
+		e.Cancellation = policy
+		if _, err := tx.Exec("UPDATE events SET cancellation = ? WHERE id = ?", e.Cancellation, e.ID); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opEventCancellation, eventRecord{ID: e.ID, Cancellation: e.Cancellation})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (s *clusterStore) ScheduleTransition(eventID int64, public, closed bool, runAt time.Time, adminID int64) (*EventTransition, error) {
+	t := &EventTransition{
+		EventID:     eventID,
+		PublicFg:    public,
+		ClosedFg:    closed,
+		RunAt:       runAt.UTC().Truncate(time.Microsecond),
+		ScheduledBy: adminID,
+		CreatedAt:   time.Now().UTC().Truncate(time.Microsecond),
+	}
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		var closedFg bool
+		if err := tx.QueryRow("SELECT closed_fg FROM events WHERE id = ? FOR UPDATE", eventID).Scan(&closedFg); err != nil {
+			return 0, err
+		}
+		if closedFg {
+			return 0, errCannotEditClosedEvent
+		}
+		res, err := tx.Exec("INSERT INTO event_transitions (event_id, public_fg, closed_fg, run_at, scheduled_by, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			t.EventID, t.PublicFg, t.ClosedFg, t.RunAt.Format("2006-01-02 15:04:05.000000"), t.ScheduledBy, t.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+		if err != nil {
+			return 0, err
+		}
+		if t.ID, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opTransitionAdd, transitionRecord{
+			ID:          t.ID,
+			EventID:     t.EventID,
+			PublicFg:    t.PublicFg,
+			ClosedFg:    t.ClosedFg,
+			RunAt:       t.RunAt,
+			ScheduledBy: t.ScheduledBy,
+			CreatedAt:   t.CreatedAt,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// lockTransition locks a transition of the event and fails with
+// ErrTransitionDone if it already ran or was canceled.
+func lockTransition(tx *sql.Tx, eventID, id int64) (*EventTransition, error) {
+	var t EventTransition
+	err := tx.QueryRow("SELECT id, event_id, public_fg, closed_fg, done_at FROM event_transitions WHERE id = ? AND event_id = ? FOR UPDATE", id, eventID).Scan(&t.ID, &t.EventID, &t.PublicFg, &t.ClosedFg, &t.DoneAt)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Pending() {
+		return nil, ErrTransitionDone
+	}
+	return &t, nil
+}
+
+func (s *clusterStore) CancelTransition(eventID, id int64) error {
+	return s.mutate(func(tx *sql.Tx) (int64, error) {
+		if _, err := lockTransition(tx, eventID, id); err != nil {
+			return 0, err
+		}
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		if _, err := tx.Exec("UPDATE event_transitions SET done_at = ?, canceled_fg = 1 WHERE id = ?", now.Format("2006-01-02 15:04:05.000000"), id); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opTransitionEnd, transitionEndRecord{ID: id, DoneAt: now, Canceled: true})
+	})
+}
+
+// ApplyDueTransitions goes by what memory says is due, but each transition
+// is locked and checked in MySQL, so when several instances find it due only
+// one runs it.
+func (s *clusterStore) ApplyDueTransitions() (int, error) {
+	ran := 0
+	for _, due := range s.transitions.Due(time.Now()) {
+		err := s.mutate(func(tx *sql.Tx) (int64, error) {
+			t, err := lockTransition(tx, due.EventID, due.ID)
+			if err != nil {
+				return 0, err
+			}
+			var e Event
+			if err := tx.QueryRow("SELECT id, public_fg, closed_fg FROM events WHERE id = ? FOR UPDATE", t.EventID).Scan(&e.ID, &e.PublicFg, &e.ClosedFg); err != nil {
+				return 0, err
+			}
+
+			now := time.Now().UTC().Truncate(time.Microsecond)
+			rec := transitionEndRecord{ID: t.ID, DoneAt: now}
+			if err := setEventFlags(&e, t.PublicFg, t.ClosedFg); err != nil {
+				rec.Error = err.Error()
+			} else {
+				if _, err := tx.Exec("UPDATE events SET public_fg = ?, closed_fg = ? WHERE id = ?", e.PublicFg, e.ClosedFg, e.ID); err != nil {
+					return 0, err
+				}
+				rec.Event = &eventRecord{ID: e.ID, PublicFg: e.PublicFg, ClosedFg: e.ClosedFg}
+			}
+			if _, err := tx.Exec("UPDATE event_transitions SET done_at = ?, error_message = ? WHERE id = ?", now.Format("2006-01-02 15:04:05.000000"), rec.Error, t.ID); err != nil {
+				return 0, err
+			}
+			return logChange(tx, opTransitionEnd, rec)
+		})
+		if err == ErrTransitionDone {
+			// Another instance got there first.
+			continue
+		}
+		if err != nil {
+			return ran, err
+		}
+		ran++
+	}
+	return ran, nil
+}
+
+// lockEvent serializes reservation changes of an event across instances.
+func lockEvent(tx *sql.Tx, eventID int64) error {
+	var id int64
+	return tx.QueryRow("SELECT id FROM events WHERE id = ? FOR UPDATE", eventID).Scan(&id)
+}
+
+// Reserve picks the sheet from memory, which may not have seen another
+// instance's latest reservation yet; the unique key on a sheet's active
+// reservation catches that, and the next candidate is tried. Once memory has
+// no free candidate left the decision falls back to what MySQL says.
+func (s *clusterStore) Reserve(eventID, userID int64, candidates []int64, promo *PromoCode) (*Reservation, error) {
+	var dbActive map[int64]bool
+	tried := make(map[int64]bool)
+	for {
+		active := s.reservations.ActiveByEvent(eventID)
+		sheetID := int64(-1)
+		for _, id := range candidates {
+			used := dbActive[id]
+			if dbActive == nil {
+				_, used = active[id]
+			}
+			if !used && !tried[id] {
+				sheetID = id
+				break
+			}
+		}
+		if sheetID == -1 {
+			if dbActive != nil {
+				return nil, ErrSoldOut
+			}
+			var err error
+			if dbActive, err = activeSheets(s.db, eventID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		rs, conflict, err := s.insertReservations(eventID, userID, []int64{sheetID}, 0, promo)
+		if conflict != 0 {
+			tried[conflict] = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return rs[0], nil
+	}
+}
+
+// ReserveSeats picks the group from memory like Reserve. A sheet that turns
+// out to be taken is remembered and the group is picked again.
+func (s *clusterStore) ReserveSeats(eventID, userID int64, sheets []*Sheet, count int, alloc SeatAllocator, hold time.Duration, promo *PromoCode) ([]*Reservation, error) {
+	var dbActive map[int64]bool
+	tried := make(map[int64]bool)
+	for {
+		active := s.reservations.ActiveByEvent(eventID)
+		sheetIDs := pickSeats(sheets, count, func(id int64) bool {
+			if tried[id] {
+				return true
+			}
+			if dbActive != nil {
+				return dbActive[id]
+			}
+			_, used := active[id]
+			return used
+		}, alloc)
+		if sheetIDs == nil {
+			if dbActive != nil {
+				return nil, ErrSoldOut
+			}
+			var err error
+			if dbActive, err = activeSheets(s.db, eventID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		rs, conflict, err := s.insertReservations(eventID, userID, sheetIDs, hold, promo)
+		if conflict != 0 {
+			tried[conflict] = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return rs, nil
+	}
+}
+
+// insertReservations reserves the sheets in one transaction, as holds if
+// hold is set. When a sheet is already taken it rolls back and reports that
+// sheet.
+func (s *clusterStore) insertReservations(eventID, userID int64, sheetIDs []int64, hold time.Duration, promo *PromoCode) ([]*Reservation, int64, error) {
+	var rs []*Reservation
+	var conflict int64
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		rank := sheetRank(sheetIDs[0])
+		if err := checkLimitsTx(tx, eventID, userID, rank, len(sheetIDs), s.userLimits(eventID)); err != nil {
+			return 0, err
+		}
+		if err := checkPromoTx(tx, promo, userID, len(sheetIDs)); err != nil {
+			return 0, err
+		}
+
+		// Priced by what memory has reserved, which may trail the others.
+		prices := s.seatPrices(eventID, sheetIDs, s.ReservedCounts(eventID)[rank])
+		var promoID int64
+		if promo != nil {
+			promoID = promo.ID
+		}
+		reservedAt := time.Now().UTC().Truncate(time.Microsecond)
+		var expiresAt *time.Time
+		if hold > 0 {
+			t := reservedAt.Add(hold)
+			expiresAt = &t
+		}
+		rs = make([]*Reservation, 0, len(sheetIDs))
+		for i, sheetID := range sheetIDs {
+			b := prices[i]
+			if promo != nil {
+				b = promo.apply(b)
+			}
+			res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at, expires_at, price, base_price, rank_price, adjustment, discount, promo_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				eventID, sheetID, userID, reservedAt.Format("2006-01-02 15:04:05.000000"), dbTime(expiresAt), b.Total(), b.Base, b.Rank, b.Adjustment, b.Discount, promoID)
+			if err != nil {
+				if isDuplicateEntry(err) {
+					conflict = sheetID
+				}
+				return 0, err
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return 0, err
+			}
+			r := &Reservation{ID: id, EventID: eventID, SheetID: sheetID, UserID: userID, ReservedAt: &reservedAt, ExpiresAt: expiresAt, PromoCodeID: promoID}
+			r.charge(b)
+			rs = append(rs, r)
+		}
+		op, record := reservationsRecord(rs)
+		return logChange(tx, op, record)
+	})
+	if err != nil {
+		return nil, conflict, err
+	}
+	return rs, 0, nil
+}
+
+func (s *clusterStore) ConfirmReservations(eventID, userID int64, ids []int64) ([]*Reservation, error) {
+	var rs []*Reservation
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := lockEvent(tx, eventID); err != nil {
+			return 0, err
+		}
+
+		now := time.Now().UTC()
+		rs = make([]*Reservation, len(ids))
+		var record confirmRecord
+		for i, id := range ids {
+			var r Reservation
+			var b PriceBreakdown
+			if err := tx.QueryRow("SELECT id, event_id, sheet_id, user_id, reserved_at, canceled_at, expires_at, price, base_price, rank_price, adjustment, discount, promo_id FROM reservations WHERE id = ? AND event_id = ?", id, eventID).
+				Scan(&r.ID, &r.EventID, &r.SheetID, &r.UserID, &r.ReservedAt, &r.CanceledAt, &r.ExpiresAt, &r.Price, &b.Base, &b.Rank, &b.Adjustment, &b.Discount, &r.PromoCodeID); err != nil {
+				if err == sql.ErrNoRows {
+					return 0, ErrNotReserved
+				}
+				return 0, err
+			}
+			if r.UserID != userID {
+				return 0, ErrNotPermitted
+			}
+			if r.CanceledAt != nil {
+				if r.ExpiresAt != nil {
+					return 0, ErrHoldExpired
+				}
+				return 0, ErrNotReserved
+			}
+			if r.ExpiresAt != nil {
+				if !now.Before(*r.ExpiresAt) {
+					return 0, ErrHoldExpired
+				}
+				r.ExpiresAt = nil
+				record.IDs = append(record.IDs, r.ID)
+			}
+			r.Breakdown = &b
+			rs[i] = &r
+		}
+		if len(record.IDs) == 0 {
+			return 0, nil
+		}
+
+		args := make([]interface{}, len(record.IDs))
+		for i, id := range record.IDs {
+			args[i] = id
+		}
+		if _, err := tx.Exec("UPDATE reservations SET expires_at = NULL WHERE id IN "+placeholders(1, len(args)), args...); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opConfirm, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// ReleaseExpiredHolds looks for expired holds in MySQL, so every instance
+// sweeps the whole cluster; releasing the same hold twice is a no-op.
+func (s *clusterStore) ReleaseExpiredHolds() (int, error) {
+	now := time.Now().UTC()
+	rows, err := s.db.Query("SELECT id, event_id FROM reservations WHERE expires_at <= ? AND canceled_at IS NULL", now.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		return 0, err
+	}
+	type hold struct{ id, eventID int64 }
+	var holds []hold
+	for rows.Next() {
+		var h hold
+		if err := rows.Scan(&h.id, &h.eventID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		holds = append(holds, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, h := range holds {
+		changed := false
+		var next *Reservation
+		err := s.mutate(func(tx *sql.Tx) (int64, error) {
+			if err := lockEvent(tx, h.eventID); err != nil {
+				return 0, err
+			}
+			var r Reservation
+			if err := tx.QueryRow("SELECT id, event_id, sheet_id, expires_at FROM reservations WHERE id = ? AND canceled_at IS NULL", h.id).Scan(&r.ID, &r.EventID, &r.SheetID, &r.ExpiresAt); err != nil {
+				if err == sql.ErrNoRows {
+					return 0, nil
+				}
+				return 0, err
+			}
+			if r.ExpiresAt == nil || now.Before(*r.ExpiresAt) {
+				return 0, nil
+			}
+			if _, err := tx.Exec("UPDATE reservations SET canceled_at = expires_at WHERE id = ?", h.id); err != nil {
+				return 0, err
+			}
+			changed = true
+			var changeID int64
+			var err error
+			changeID, next, err = s.logFreed(tx, &r, cancelRecord{ID: h.id, CanceledAt: *r.ExpiresAt})
+			return changeID, err
+		})
+		if err != nil {
+			return released, err
+		}
+		if changed {
+			released++
+		}
+		if next != nil {
+			notifyOffer(next)
+		}
+	}
+	return released, nil
+}
+
+func (s *clusterStore) CancelReservation(eventID, sheetID, userID int64, terms cancelTerms) (*Reservation, error) {
+	r := &Reservation{}
+	var next *Reservation
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := lockEvent(tx, eventID); err != nil {
+			return 0, err
+		}
+		if err := tx.QueryRow("SELECT id, event_id, sheet_id, user_id, reserved_at, expires_at, price FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL LIMIT 1", eventID, sheetID).
+			Scan(&r.ID, &r.EventID, &r.SheetID, &r.UserID, &r.ReservedAt, &r.ExpiresAt, &r.Price); err != nil {
+			if err == sql.ErrNoRows {
+				return 0, ErrNotReserved
+			}
+			return 0, err
+		}
+		if r.UserID != userID {
+			return 0, ErrNotPermitted
+		}
+
+		var err error
+		if r.CancelFee, err = terms.feeFor(r); err != nil {
+			return 0, err
+		}
+
+		canceledAt := time.Now().UTC().Truncate(time.Microsecond)
+		if _, err := tx.Exec("UPDATE reservations SET canceled_at = ?, cancel_fee = ? WHERE id = ?", canceledAt.Format("2006-01-02 15:04:05.000000"), r.CancelFee, r.ID); err != nil {
+			return 0, err
+		}
+		r.CanceledAt = &canceledAt
+		var changeID int64
+		changeID, next, err = s.logFreed(tx, r, cancelRecord{ID: r.ID, CanceledAt: canceledAt, Fee: r.CancelFee})
+		return changeID, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if next != nil {
+		notifyOffer(next)
+	}
+	return r, nil
+}
+
+// logFreed logs the cancellation of a reservation canceled in tx, ending
+// its pending transfer with it. If the event is still on sale and someone
+// waits for the sheet's rank, the first of them gets it as a hold, which is
+// returned.
+func (s *clusterStore) logFreed(tx *sql.Tx, freed *Reservation, canceled cancelRecord) (int64, *Reservation, error) {
+	var err error
+	if canceled.TransferID, err = endPendingTransfer(tx, freed.ID, canceled.CanceledAt); err != nil {
+		return 0, nil, err
+	}
+	var public bool
+	if err := tx.QueryRow("SELECT public_fg FROM events WHERE id = ?", freed.EventID).Scan(&public); err != nil {
+		return 0, nil, err
+	}
+	var entryID, userID int64
+	if public {
+		err := tx.QueryRow("SELECT id, user_id FROM waitlist WHERE event_id = ? AND `rank` = ? ORDER BY id ASC LIMIT 1 FOR UPDATE", freed.EventID, sheetRank(freed.SheetID)).Scan(&entryID, &userID)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, nil, err
+		}
+	}
+	if entryID == 0 {
+		changeID, err := logChange(tx, opCancel, canceled)
+		return changeID, nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM waitlist WHERE id = ?", entryID); err != nil {
+		return 0, nil, err
+	}
+
+	// The freed sheet is not taken any more, so the hold is priced as if
+	// it were back on sale. Memory has not seen it freed yet.
+	reserved := s.ReservedCounts(freed.EventID)[sheetRank(freed.SheetID)]
+	if s.reservations.ActiveOn(freed.EventID, freed.SheetID) != nil {
+		reserved--
+	}
+	b := s.sheetPrice(freed.EventID, freed.SheetID, reserved)
+
+	reservedAt := time.Now().UTC().Truncate(time.Microsecond)
+	expiresAt := reservedAt.Add(holdTTL)
+	res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at, expires_at, price, base_price, rank_price, adjustment) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		freed.EventID, freed.SheetID, userID, reservedAt.Format("2006-01-02 15:04:05.000000"), dbTime(&expiresAt), b.Total(), b.Base, b.Rank, b.Adjustment)
+	if err != nil {
+		return 0, nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, nil, err
+	}
+	hold := &Reservation{ID: id, EventID: freed.EventID, SheetID: freed.SheetID, UserID: userID, ReservedAt: &reservedAt, ExpiresAt: &expiresAt}
+	hold.charge(b)
+	changeID, err := logChange(tx, opOffer, offerRecord{Canceled: canceled, WaitlistID: entryID, Hold: newReserveRecord(hold)})
+	return changeID, hold, err
+}
+
+func (s *clusterStore) CreatePromoCode(p PromoCode) (*PromoCode, error) {
+	p.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		res, err := tx.Exec("INSERT INTO promo_codes (code, kind, value, scope, max_uses, max_uses_per_user, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			p.Code, p.Kind, p.Value, p.Scope, p.MaxUses, p.MaxUsesPerUser, dbTime(p.ExpiresAt), p.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+		if err != nil {
+			if isDuplicateEntry(err) {
+				return 0, ErrDuplicated
+			}
+			return 0, err
+		}
+		if p.ID, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opPromoCreate, newPromoRecord(&p))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *clusterStore) DisablePromoCode(id int64) (*PromoCode, error) {
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		var disabled bool
+		if err := tx.QueryRow("SELECT disabled_fg FROM promo_codes WHERE id = ? FOR UPDATE", id).Scan(&disabled); err != nil {
+			return 0, err
+		}
+		if disabled {
+			return 0, nil
+		}
+		if _, err := tx.Exec("UPDATE promo_codes SET disabled_fg = 1 WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opPromoDisable, promoDisableRecord{ID: id})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetPromoCode(id)
+}
+
+// lockTransfer locks a transfer and fails with ErrTransferDone if it was
+// accepted or canceled already.
+func lockTransfer(tx *sql.Tx, id int64) (*TicketTransfer, error) {
+	var t TicketTransfer
+	err := tx.QueryRow("SELECT id, reservation_id, event_id, from_user_id, to_user_id, done_at FROM transfers WHERE id = ? FOR UPDATE", id).Scan(&t.ID, &t.ReservationID, &t.EventID, &t.FromUserID, &t.ToUserID, &t.DoneAt)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Pending() {
+		return nil, ErrTransferDone
+	}
+	return &t, nil
+}
+
+// lockTransferable locks a reservation that is about to change hands and
+// fails with ErrNotReserved unless it is active and confirmed.
+func lockTransferable(tx *sql.Tx, id int64) (*Reservation, error) {
+	var r Reservation
+	err := tx.QueryRow("SELECT id, event_id, sheet_id, user_id, canceled_at, expires_at FROM reservations WHERE id = ? FOR UPDATE", id).Scan(&r.ID, &r.EventID, &r.SheetID, &r.UserID, &r.CanceledAt, &r.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotReserved
+	} else if err != nil {
+		return nil, err
+	}
+	if r.CanceledAt != nil || r.ExpiresAt != nil {
+		return nil, ErrNotReserved
+	}
+	return &r, nil
+}
+
+func (s *clusterStore) OfferTransfer(reservationID, fromUserID, toUserID int64) (*TicketTransfer, error) {
+	t := &TicketTransfer{
+		ReservationID: reservationID,
+		FromUserID:    fromUserID,
+		ToUserID:      toUserID,
+		CreatedAt:     time.Now().UTC().Truncate(time.Microsecond),
+	}
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		r, err := lockTransferable(tx, reservationID)
+		if err != nil {
+			return 0, err
+		}
+		if r.UserID != fromUserID {
+			return 0, ErrNotPermitted
+		}
+		var pending int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM transfers WHERE reservation_id = ? AND done_at IS NULL", reservationID).Scan(&pending); err != nil {
+			return 0, err
+		}
+		if pending > 0 {
+			return 0, ErrTransferPending
+		}
+		t.EventID = r.EventID
+		res, err := tx.Exec("INSERT INTO transfers (reservation_id, event_id, from_user_id, to_user_id, created_at) VALUES (?, ?, ?, ?, ?)",
+			t.ReservationID, t.EventID, t.FromUserID, t.ToUserID, t.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+		if err != nil {
+			return 0, err
+		}
+		if t.ID, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opTransferOffer, newTransferRecord(t))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *clusterStore) AcceptTransfer(id, userID int64) (*TicketTransfer, error) {
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		t, err := lockTransfer(tx, id)
+		if err != nil {
+			return 0, err
+		}
+		if t.ToUserID != userID {
+			return 0, ErrNotPermitted
+		}
+		if err := lockEvent(tx, t.EventID); err != nil {
+			return 0, err
+		}
+		r, err := lockTransferable(tx, t.ReservationID)
+		if err != nil {
+			return 0, err
+		}
+		if r.UserID != t.FromUserID {
+			return 0, ErrNotPermitted
+		}
+		if err := checkLimitsTx(tx, t.EventID, userID, sheetRank(r.SheetID), 1, s.userLimits(t.EventID)); err != nil {
+			return 0, err
+		}
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		if _, err := tx.Exec("UPDATE reservations SET user_id = ? WHERE id = ?", userID, r.ID); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE transfers SET done_at = ?, accepted_fg = 1 WHERE id = ?", now.Format("2006-01-02 15:04:05.000000"), id); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opTransferEnd, transferEndRecord{ID: id, DoneAt: now, Accepted: true, ReservationID: r.ID, UserID: userID})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetTransfer(id)
+}
+
+func (s *clusterStore) CancelTransfer(id, userID int64) (*TicketTransfer, error) {
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		t, err := lockTransfer(tx, id)
+		if err != nil {
+			return 0, err
+		}
+		if t.FromUserID != userID && t.ToUserID != userID {
+			return 0, ErrNotPermitted
+		}
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		if _, err := tx.Exec("UPDATE transfers SET done_at = ? WHERE id = ?", now.Format("2006-01-02 15:04:05.000000"), id); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opTransferEnd, transferEndRecord{ID: id, DoneAt: now})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetTransfer(id)
+}
+
+// lockVenue serializes catalog changes of a venue across instances.
+func lockVenue(tx *sql.Tx, venueID int64) error {
+	var id int64
+	return tx.QueryRow("SELECT id FROM venues WHERE id = ? FOR UPDATE", venueID).Scan(&id)
+}
+
+func (s *clusterStore) CreateVenue(name string) (*Venue, error) {
+	var id int64
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		res, err := tx.Exec("INSERT INTO venues (name) VALUES (?)", name)
+		if err != nil {
+			return 0, err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opVenueCreate, venueRecord{ID: id, Name: name})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetVenue(id)
+}
+
+func (s *clusterStore) AddSheets(venueID int64, rank string, count, price int64) (*Venue, error) {
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := lockVenue(tx, venueID); err != nil {
+			return 0, err
+		}
+		record := sheetsRecord{VenueID: venueID, Rank: rank, Price: price}
+		if err := tx.QueryRow("SELECT COALESCE(MAX(num), 0) + 1 FROM sheets WHERE venue_id = ? AND `rank` = ?", venueID, rank).Scan(&record.FirstNum); err != nil {
+			return 0, err
+		}
+		for i := int64(0); i < count; i++ {
+			res, err := tx.Exec("INSERT INTO sheets (venue_id, `rank`, num, price) VALUES (?, ?, ?, ?)", venueID, rank, record.FirstNum+i, price)
+			if err != nil {
+				return 0, err
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return 0, err
+			}
+			record.IDs = append(record.IDs, id)
+		}
+		return logChange(tx, opSheetsAdd, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetVenue(venueID)
+}
+
+func (s *clusterStore) RetireSheet(venueID int64, rank string, num int64) error {
+	return s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := lockVenue(tx, venueID); err != nil {
+			return 0, err
+		}
+		var id int64
+		var retired bool
+		if err := tx.QueryRow("SELECT id, retired_fg FROM sheets WHERE venue_id = ? AND `rank` = ? AND num = ? FOR UPDATE", venueID, rank, num).Scan(&id, &retired); err != nil {
+			return 0, err
+		}
+		var reserved int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM reservations WHERE sheet_id = ? AND canceled_at IS NULL", id).Scan(&reserved); err != nil {
+			return 0, err
+		}
+		if reserved > 0 {
+			return 0, ErrSheetReserved
+		}
+		if !retired {
+			if _, err := tx.Exec("UPDATE sheets SET retired_fg = 1 WHERE id = ?", id); err != nil {
+				return 0, err
+			}
+		}
+		return logChange(tx, opSheetRetire, sheetRetireRecord{ID: id})
+	})
+}
+
+func (s *clusterStore) SetRankPrice(venueID int64, rank string, price int64) (*Venue, error) {
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := lockVenue(tx, venueID); err != nil {
+			return 0, err
+		}
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM sheets WHERE venue_id = ? AND `rank` = ?", venueID, rank).Scan(&n); err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, sql.ErrNoRows
+		}
+		if _, err := tx.Exec("UPDATE sheets SET price = ? WHERE venue_id = ? AND `rank` = ?", price, venueID, rank); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opRankPrice, rankPriceRecord{VenueID: venueID, Rank: rank, Price: price})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetVenue(venueID)
+}
+
+func (s *clusterStore) JoinWaitlist(eventID int64, rank string, userID int64) (*WaitlistEntry, error) {
+	e := &WaitlistEntry{EventID: eventID, Rank: rank, UserID: userID}
+	err := s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := lockEvent(tx, eventID); err != nil {
+			return 0, err
+		}
+		err := tx.QueryRow("SELECT id, created_at FROM waitlist WHERE event_id = ? AND `rank` = ? AND user_id = ?", eventID, rank, userID).Scan(&e.ID, &e.CreatedAt)
+		if err == nil {
+			return 0, nil
+		} else if err != sql.ErrNoRows {
+			return 0, err
+		}
+		if err := checkLimitsTx(tx, eventID, userID, rank, 1, s.userLimits(eventID)); err != nil {
+			return 0, err
+		}
+
+		e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+		res, err := tx.Exec("INSERT INTO waitlist (event_id, `rank`, user_id, created_at) VALUES (?, ?, ?, ?)", eventID, rank, userID, e.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+		if err != nil {
+			return 0, err
+		}
+		if e.ID, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opWaitlistJoin, waitlistRecord{ID: e.ID, EventID: e.EventID, Rank: e.Rank, UserID: e.UserID, CreatedAt: e.CreatedAt})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (s *clusterStore) LeaveWaitlist(eventID int64, rank string, userID int64) error {
+	return s.mutate(func(tx *sql.Tx) (int64, error) {
+		if err := lockEvent(tx, eventID); err != nil {
+			return 0, err
+		}
+		var id int64
+		if err := tx.QueryRow("SELECT id FROM waitlist WHERE event_id = ? AND `rank` = ? AND user_id = ?", eventID, rank, userID).Scan(&id); err != nil {
+			if err == sql.ErrNoRows {
+				return 0, ErrNotWaiting
+			}
+			return 0, err
+		}
+		if _, err := tx.Exec("DELETE FROM waitlist WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+		return logChange(tx, opWaitlistDrop, waitlistDropRecord{ID: id})
+	})
+}
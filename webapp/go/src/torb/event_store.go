@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// EventStore holds all events indexed by ID - 1; IDs that were never used
+// (MySQL can skip auto-increment values) are nil. Events are copy-on-write:
+// a published *Event is never modified, updates store a new copy, so a
+// pointer obtained under the read lock stays valid and consistent.
+type EventStore struct {
+	mu     sync.RWMutex
+	events []*Event
+}
+
+func newEventStore() *EventStore {
+	return &EventStore{events: make([]*Event, 0)}
+}
+
+// Replace takes over a freshly loaded list of events.
+func (s *EventStore) Replace(events []*Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replace(events)
+}
+
+func (s *EventStore) replace(events []*Event) {
+	s.events = events
+}
+
+// Put stores e at its ID, growing the list as needed. Used when replaying.
+func (s *EventStore) Put(e *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for int64(len(s.events)) < e.ID {
+		s.events = append(s.events, nil)
+	}
+	s.events[e.ID-1] = e
+}
+
+func (s *EventStore) Get(eventID int64) (*Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if eventID <= 0 || len(s.events) <= int(eventID)-1 || s.events[eventID-1] == nil {
+		return nil, sql.ErrNoRows
+	}
+	return s.events[eventID-1], nil
+}
+
+func (s *EventStore) List() []*Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	events := make([]*Event, 0, len(s.events))
+	for _, e := range s.events {
+		if e != nil {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func (s *EventStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.events)
+}
+
+// Create assigns the next ID to e and stores it. As with ReservationStore,
+// persist runs under the write lock and a failure leaves the store untouched.
+func (s *EventStore) Create(e Event, persist func(e *Event) error) (*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.ID = int64(len(s.events) + 1)
+	if err := persist(&e); err != nil {
+		return nil, err
+	}
+	s.events = append(s.events, &e)
+	return &e, nil
+}
+
+// Update applies fn to a copy of the event and publishes the copy.
+func (s *EventStore) Update(eventID int64, fn func(e *Event) error, persist func(e *Event) error) (*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if eventID <= 0 || len(s.events) <= int(eventID)-1 || s.events[eventID-1] == nil {
+		return nil, sql.ErrNoRows
+	}
+	e := *s.events[eventID-1]
+	if err := fn(&e); err != nil {
+		return nil, err
+	}
+	if err := persist(&e); err != nil {
+		return nil, err
+	}
+	s.events[eventID-1] = &e
+	return &e, nil
+}
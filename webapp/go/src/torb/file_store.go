@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	opUserCreate          = "user_create"
+	opAdministratorCreate = "administrator_create"
+)
+
+type userRecord struct {
+	ID        int64  `json:"id"`
+	Nickname  string `json:"nickname"`
+	LoginName string `json:"login_name"`
+	PassHash  string `json:"pass_hash"`
+}
+
+// fileStore runs the whole app without MySQL. Its journal is the database:
+// it is never truncated and Load rebuilds memory by replaying it.
+type fileStore struct {
+	*memoryStore
+
+	mu                    sync.RWMutex
+	users                 map[int64]*User
+	usersByLoginName      map[string]*User
+	administrators        map[int64]*Administrator
+	administratorsByLogin map[string]*Administrator
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	journal, err := openJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{memoryStore: newMemoryStore(journal, nopSink{})}, nil
+}
+
+func (s *fileStore) Load() error {
+	s.reservations.Replace(newReservationStore())
+	s.waitlist.Replace(newWaitlistStore())
+	s.transitions.Replace(newTransitionStore())
+	s.promos.Replace(newPromoStore())
+	s.transfers.Replace(newTransferStore())
+	s.events.Replace(make([]*Event, 0))
+	s.setVenues(newVenueCatalog(map[int64]string{}, nil))
+	atomic.StoreInt64(&s.activeLimit, 0)
+	s.mu.Lock()
+	s.users = make(map[int64]*User)
+	s.usersByLoginName = make(map[string]*User)
+	s.administrators = make(map[int64]*Administrator)
+	s.administratorsByLogin = make(map[string]*Administrator)
+	s.mu.Unlock()
+
+	n, err := s.journal.Replay(s.apply)
+	if err != nil {
+		return err
+	}
+	log.Printf("file store: loaded %d records from %s", n, s.journal.path)
+
+	if len(s.ListVenues()) == 0 {
+		if err := s.seedDefaultVenue(); err != nil {
+			return err
+		}
+	}
+	s.mu.RLock()
+	noAdministrators := len(s.administrators) == 0
+	s.mu.RUnlock()
+	if noAdministrators {
+		return s.createAdministrator(Getenv("ADMIN_NICKNAME", "admin"), Getenv("ADMIN_LOGIN_NAME", "admin"), Getenv("ADMIN_PASSWORD", "admin"))
+	}
+	return nil
+}
+
+// seedDefaultVenue journals the layout db/init.sh loads into MySQL, so a
+// fresh file store sells the same sheets.
+func (s *fileStore) seedDefaultVenue() error {
+	venue, err := s.CreateVenue("default")
+	if err != nil {
+		return err
+	}
+	for _, sheets := range groupSheetsByRank(defaultVenueSheets()) {
+		if _, err := s.AddSheets(venue.ID, sheets[0].Rank, int64(len(sheets)), sheets[0].Price); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func groupSheetsByRank(sheets []*Sheet) [][]*Sheet {
+	var groups [][]*Sheet
+	for i, sheet := range sheets {
+		if i == 0 || sheet.Rank != sheets[i-1].Rank {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], sheet)
+	}
+	return groups
+}
+
+func (s *fileStore) apply(rec *journalRecord) error {
+	if ok, err := s.memoryStore.apply(rec); ok || err != nil {
+		return err
+	}
+	switch rec.Op {
+	case opUserCreate:
+		var r userRecord
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			return err
+		}
+		s.putUser(&User{ID: r.ID, Nickname: r.Nickname, LoginName: r.LoginName, PassHash: r.PassHash})
+	case opAdministratorCreate:
+		var r userRecord
+		if err := json.Unmarshal(rec.Data, &r); err != nil {
+			return err
+		}
+		s.putAdministrator(&Administrator{ID: r.ID, Nickname: r.Nickname, LoginName: r.LoginName, PassHash: r.PassHash})
+	default:
+		log.Println("file store: unknown op", rec.Op)
+	}
+	return nil
+}
+
+func (s *fileStore) Initialize() error {
+	if err := s.journal.Reset(); err != nil {
+		return err
+	}
+	return s.Load()
+}
+
+func (s *fileStore) Close(ctx context.Context) error {
+	return s.journal.Close()
+}
+
+func (s *fileStore) putUser(u *User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.ID] = u
+	s.usersByLoginName[u.LoginName] = u
+}
+
+func (s *fileStore) putAdministrator(a *Administrator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.administrators[a.ID] = a
+	s.administratorsByLogin[a.LoginName] = a
+}
+
+func (s *fileStore) CreateUser(nickname, loginName, password string) (*User, error) {
+	var user *User
+	err := s.mutate(func(seq *int64) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if _, ok := s.usersByLoginName[loginName]; ok {
+			return ErrDuplicated
+		}
+		user = &User{
+			ID:        int64(len(s.users) + 1),
+			Nickname:  nickname,
+			LoginName: loginName,
+			PassHash:  passwordHash(password),
+		}
+		if err := s.persist(seq, opUserCreate, userRecord{ID: user.ID, Nickname: user.Nickname, LoginName: user.LoginName, PassHash: user.PassHash}); err != nil {
+			return err
+		}
+		s.users[user.ID] = user
+		s.usersByLoginName[user.LoginName] = user
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	u := *user
+	return &u, nil
+}
+
+func (s *fileStore) createAdministrator(nickname, loginName, password string) error {
+	return s.mutate(func(seq *int64) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if _, ok := s.administratorsByLogin[loginName]; ok {
+			return ErrDuplicated
+		}
+		a := &Administrator{
+			ID:        int64(len(s.administrators) + 1),
+			Nickname:  nickname,
+			LoginName: loginName,
+			PassHash:  passwordHash(password),
+		}
+		if err := s.persist(seq, opAdministratorCreate, userRecord{ID: a.ID, Nickname: a.Nickname, LoginName: a.LoginName, PassHash: a.PassHash}); err != nil {
+			return err
+		}
+		s.administrators[a.ID] = a
+		s.administratorsByLogin[a.LoginName] = a
+		return nil
+	})
+}
+
+func (s *fileStore) GetUser(id int64) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &User{ID: u.ID, Nickname: u.Nickname}, nil
+}
+
+func (s *fileStore) GetUserByLoginName(loginName string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.usersByLoginName[loginName]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	user := *u
+	return &user, nil
+}
+
+func (s *fileStore) GetAdministrator(id int64) (*Administrator, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.administrators[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &Administrator{ID: a.ID, Nickname: a.Nickname}, nil
+}
+
+func (s *fileStore) GetAdministratorByLoginName(loginName string) (*Administrator, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.administratorsByLogin[loginName]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	administrator := *a
+	return &administrator, nil
+}
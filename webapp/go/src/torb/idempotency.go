@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/labstack/echo"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IdempotencyCache remembers the first response a user got for an
+// Idempotency-Key so that a retried request is answered from the cache
+// instead of running again. Entries live in process memory for ttl, which
+// is enough for the file store, a single process by design. The MySQL
+// stores set shared, so that a retry landing on another process sharing
+// the database is answered the same.
+type IdempotencyCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+
+	shared *sharedIdempotency
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	done        chan struct{}
+	expires     time.Time
+
+	status      int
+	contentType string
+	body        []byte
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func newIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{ttl: ttl, entries: make(map[string]*idempotencyEntry)}
+}
+
+// begin returns the entry for key. owner is true when the caller created it
+// and has to finish it.
+func (ic *IdempotencyCache) begin(key, fingerprint string) (entry *idempotencyEntry, owner bool) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(ic.lastSweep) > ic.ttl/10 {
+		for k, e := range ic.entries {
+			if e.status != 0 && now.After(e.expires) {
+				delete(ic.entries, k)
+			}
+		}
+		ic.lastSweep = now
+	}
+
+	if e, ok := ic.entries[key]; ok && (e.status == 0 || now.Before(e.expires)) {
+		return e, false
+	}
+	e := &idempotencyEntry{fingerprint: fingerprint, done: make(chan struct{})}
+	ic.entries[key] = e
+	return e, true
+}
+
+// finish stores the response, or forgets the key when there is nothing worth
+// replaying, and wakes up requests waiting on it.
+func (ic *IdempotencyCache) finish(key string, e *idempotencyEntry, status int, contentType string, body []byte) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if status == 0 || status >= 500 {
+		delete(ic.entries, key)
+	} else {
+		e.status = status
+		e.contentType = contentType
+		e.body = body
+		e.expires = time.Now().Add(ic.ttl)
+	}
+	close(e.done)
+}
+
+var errIdempotencyKeyReused = errors.New("idempotency key reused")
+
+// idempotencyPoll is how often a request polls for a key another process
+// is still working on.
+const idempotencyPoll = 100 * time.Millisecond
+
+// sharedIdempotency keeps idempotency keys, with the fingerprint of the
+// request and the response to replay, in MySQL. A process claims a key by
+// inserting it with a lease; whoever finds it pending polls until it is
+// finished, or takes it over once the lease has run out because the
+// process that claimed it went away.
+type sharedIdempotency struct {
+	db    *sql.DB
+	ttl   time.Duration
+	lease time.Duration
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func newSharedIdempotency(db *sql.DB, ttl time.Duration) *sharedIdempotency {
+	return &sharedIdempotency{db: db, ttl: ttl, lease: time.Duration(GetenvInt("IDEMPOTENCY_LEASE_SEC", 30)) * time.Second}
+}
+
+// sweep deletes expired keys now and then.
+func (si *sharedIdempotency) sweep(now time.Time) {
+	si.mu.Lock()
+	if now.Sub(si.lastSweep) <= si.ttl/10 {
+		si.mu.Unlock()
+		return
+	}
+	si.lastSweep = now
+	si.mu.Unlock()
+	if _, err := si.db.Exec("DELETE FROM idempotency_keys WHERE expires_at < ?", now.Format("2006-01-02 15:04:05.000000")); err != nil {
+		log.Println("idempotency: could not sweep expired keys:", err)
+	}
+}
+
+// claim returns nil when the caller got the key and has to finish it, or
+// the stored response to replay.
+func (si *sharedIdempotency) claim(ctx context.Context, userID int64, key, fingerprint string) (*idempotencyEntry, error) {
+	si.sweep(time.Now().UTC())
+	for {
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		leased := now.Add(si.lease).Format("2006-01-02 15:04:05.000000")
+		_, err := si.db.ExecContext(ctx, "INSERT INTO idempotency_keys (user_id, idem_key, fingerprint, expires_at) VALUES (?, ?, ?, ?)", userID, key, fingerprint, leased)
+		if err == nil {
+			return nil, nil
+		}
+		if !isDuplicateEntry(err) {
+			return nil, err
+		}
+
+		var e idempotencyEntry
+		err = si.db.QueryRowContext(ctx, "SELECT fingerprint, status, content_type, body, expires_at FROM idempotency_keys WHERE user_id = ? AND idem_key = ?", userID, key).
+			Scan(&e.fingerprint, &e.status, &e.contentType, &e.body, &e.expires)
+		if err == sql.ErrNoRows {
+			// Forgotten in between; claim it again.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !now.Before(e.expires) {
+			res, err := si.db.ExecContext(ctx, "UPDATE idempotency_keys SET fingerprint = ?, status = 0, content_type = '', body = NULL, expires_at = ? WHERE user_id = ? AND idem_key = ? AND expires_at = ?",
+				fingerprint, leased, userID, key, e.expires.Format("2006-01-02 15:04:05.000000"))
+			if err != nil {
+				return nil, err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return nil, err
+			} else if n == 1 {
+				return nil, nil
+			}
+			continue
+		}
+		if e.fingerprint != fingerprint {
+			return nil, errIdempotencyKeyReused
+		}
+		if e.status != 0 {
+			return &e, nil
+		}
+		select {
+		case <-time.After(idempotencyPoll):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// finish stores the response for ttl, or forgets the key as
+// IdempotencyCache.finish does.
+func (si *sharedIdempotency) finish(userID int64, key string, status int, contentType string, body []byte) {
+	var err error
+	if status == 0 || status >= 500 {
+		_, err = si.db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND idem_key = ?", userID, key)
+	} else {
+		expires := time.Now().UTC().Add(si.ttl).Format("2006-01-02 15:04:05.000000")
+		_, err = si.db.Exec("UPDATE idempotency_keys SET status = ?, content_type = ?, body = ?, expires_at = ? WHERE user_id = ? AND idem_key = ?", status, contentType, body, expires, userID, key)
+	}
+	if err != nil {
+		// A lost response only costs the retry a second run; the lease
+		// runs out and the key can be claimed again.
+		log.Printf("idempotency: could not store key %q for user %d: %v", key, userID, err)
+	}
+}
+
+var idempotencyCache = newIdempotencyCache(time.Duration(GetenvInt("IDEMPOTENCY_TTL_SEC", 86400)) * time.Second)
+
+// idempotent replays the stored response when a logged in user repeats a
+// request with the same Idempotency-Key. 5xx responses and errors are not
+// stored, so those can be retried for real. Reusing a key for a different
+// request is rejected.
+func idempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get("Idempotency-Key")
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > 255 {
+			return resError(c, "invalid_idempotency_key", 400)
+		}
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		body, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+		h := sha256.New()
+		io.WriteString(h, c.Request().Method+" "+c.Request().URL.Path+"\n")
+		h.Write(body)
+		fingerprint := hex.EncodeToString(h.Sum(nil))
+
+		cacheKey := strconv.FormatInt(user.ID, 10) + ":" + key
+		for {
+			entry, owner := idempotencyCache.begin(cacheKey, fingerprint)
+			if !owner {
+				if entry.fingerprint != fingerprint {
+					return resError(c, "idempotency_key_reused", 422)
+				}
+				select {
+				case <-entry.done:
+				case <-c.Request().Context().Done():
+					return c.Request().Context().Err()
+				}
+				if entry.status == 0 {
+					// The first attempt failed and was forgotten; run again.
+					continue
+				}
+				c.Response().Header().Set("Idempotent-Replayed", "true")
+				return c.Blob(entry.status, entry.contentType, entry.body)
+			}
+
+			if shared := idempotencyCache.shared; shared != nil {
+				stored, err := shared.claim(c.Request().Context(), user.ID, key, fingerprint)
+				if err != nil {
+					idempotencyCache.finish(cacheKey, entry, 0, "", nil)
+					if err == errIdempotencyKeyReused {
+						return resError(c, "idempotency_key_reused", 422)
+					}
+					return err
+				}
+				if stored != nil {
+					idempotencyCache.finish(cacheKey, entry, stored.status, stored.contentType, stored.body)
+					c.Response().Header().Set("Idempotent-Replayed", "true")
+					return c.Blob(stored.status, stored.contentType, stored.body)
+				}
+			}
+
+			rec := &responseRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = rec
+			err := next(c)
+			c.Response().Writer = rec.ResponseWriter
+
+			status := 0
+			if err == nil && c.Response().Committed {
+				status = c.Response().Status
+			}
+			contentType := c.Response().Header().Get(echo.HeaderContentType)
+			idempotencyCache.finish(cacheKey, entry, status, contentType, rec.body.Bytes())
+			if shared := idempotencyCache.shared; shared != nil {
+				shared.finish(user.ID, key, status, contentType, rec.body.Bytes())
+			}
+			return err
+		}
+	}
+}
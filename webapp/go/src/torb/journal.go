@@ -0,0 +1,671 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Journal is an append-only, fsync'd log of every mutation made to the
+// in-memory stores. A record is appended before the client gets its response.
+// The MySQL store drops the records up to the oldest one not yet in MySQL, so
+// whatever is left on startup has to be replayed; the file store never
+// truncates it and replays all of it.
+//
+// Records MySQL refused outright are moved to a dead-letter file next to the
+// journal (path + ".dead") for an operator to look at, so one bad record
+// neither blocks truncation nor startup.
+type Journal struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+	seq  int64
+	size int64
+
+	// With writes tracked, unwritten maps every record the writer has not
+	// finished with to where it starts in the file, and order holds their
+	// seqs oldest first. Both are nil for the file store.
+	unwritten map[int64]int64
+	order     []int64
+	// compactBytes is how much of the file has to be written already
+	// before the rest is copied to a fresh one.
+	compactBytes int64
+
+	syncMu sync.Mutex
+	synced int64
+
+	deadMu sync.Mutex
+}
+
+type journalRecord struct {
+	Seq  int64           `json:"seq"`
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"data"`
+}
+
+// deadRecord is a line of the dead-letter file. Line holds a journal line
+// that could not even be parsed.
+type deadRecord struct {
+	journalRecord
+	Line  string    `json:"line,omitempty"`
+	Error string    `json:"error"`
+	At    time.Time `json:"at"`
+}
+
+const (
+	opReserve           = "reserve"
+	opReserveBatch      = "reserve_batch"
+	opCancel            = "cancel"
+	opConfirm           = "confirm"
+	opOffer             = "offer"
+	opEventCreate       = "event_create"
+	opEventUpdate       = "event_update"
+	opEventSeats        = "event_seats"
+	opEventLimits       = "event_limits"
+	opEventSchedule     = "event_schedule"
+	opEventPricing      = "event_pricing"
+	opEventCancellation = "event_cancellation"
+	opActiveLimit       = "active_limit"
+	opVenueCreate       = "venue_create"
+	opSheetsAdd         = "sheets_add"
+	opSheetRetire       = "sheet_retire"
+	opRankPrice         = "rank_price"
+	opWaitlistJoin      = "waitlist_join"
+	opTransitionAdd     = "transition_add"
+	opTransitionEnd     = "transition_done"
+	opWaitlistDrop      = "waitlist_drop"
+	opPromoCreate       = "promo_create"
+	opPromoDisable      = "promo_disable"
+	opTransferOffer     = "transfer_offer"
+	opTransferEnd       = "transfer_done"
+)
+
+type reserveRecord struct {
+	ID         int64     `json:"id"`
+	EventID    int64     `json:"event_id"`
+	SheetID    int64     `json:"sheet_id"`
+	UserID     int64     `json:"user_id"`
+	ReservedAt time.Time `json:"reserved_at"`
+	Price      int64     `json:"price,omitempty"`
+	// Breakdown is missing from reservations journaled before it was kept.
+	Breakdown   *PriceBreakdown `json:"breakdown,omitempty"`
+	PromoCodeID int64           `json:"promo_code_id,omitempty"`
+
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (r reserveRecord) reservation() *Reservation {
+	reservedAt := r.ReservedAt
+	return &Reservation{
+		ID:         r.ID,
+		EventID:    r.EventID,
+		SheetID:    r.SheetID,
+		UserID:     r.UserID,
+		ReservedAt: &reservedAt,
+		ExpiresAt:  r.ExpiresAt,
+		Price:      r.Price,
+		Breakdown:  r.Breakdown,
+
+		PromoCodeID: r.PromoCodeID,
+	}
+}
+
+// reserveBatchRecord holds reservations made together, so they are
+// journaled and written all or nothing.
+type reserveBatchRecord struct {
+	Reservations []reserveRecord `json:"reservations"`
+}
+
+// cancelRecord cancels a reservation, ending its pending transfer, if any,
+// at the same time.
+type cancelRecord struct {
+	ID         int64     `json:"id"`
+	CanceledAt time.Time `json:"canceled_at"`
+	Fee        int64     `json:"fee,omitempty"`
+	TransferID int64     `json:"transfer_id,omitempty"`
+}
+
+// confirmRecord turns holds into reservations.
+type confirmRecord struct {
+	IDs []int64 `json:"ids"`
+}
+
+// offerRecord cancels a reservation and hands its sheet to the first
+// customer on the waitlist as a hold, in one step.
+type offerRecord struct {
+	Canceled   cancelRecord  `json:"canceled"`
+	WaitlistID int64         `json:"waitlist_id"`
+	Hold       reserveRecord `json:"hold"`
+}
+
+type eventRecord struct {
+	ID       int64  `json:"id"`
+	Title    string `json:"title,omitempty"`
+	PublicFg bool   `json:"public"`
+	ClosedFg bool   `json:"closed"`
+	Price    int64  `json:"price,omitempty"`
+	VenueID  int64  `json:"venue_id,omitempty"`
+
+	Allocation   *SeatPolicy         `json:"allocation,omitempty"`
+	Limits       *PurchaseLimits     `json:"limits,omitempty"`
+	Schedule     *EventSchedule      `json:"schedule,omitempty"`
+	Pricing      *PricingPolicy      `json:"pricing,omitempty"`
+	Cancellation *CancellationPolicy `json:"cancellation,omitempty"`
+}
+
+// activeLimitRecord sets the global cap on active reservations per user.
+type activeLimitRecord struct {
+	Max int `json:"max"`
+}
+
+type venueRecord struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// sheetsRecord adds len(IDs) sheets numbered from FirstNum.
+type sheetsRecord struct {
+	VenueID  int64   `json:"venue_id"`
+	Rank     string  `json:"rank"`
+	Price    int64   `json:"price"`
+	FirstNum int64   `json:"first_num"`
+	IDs      []int64 `json:"ids"`
+}
+
+func (r sheetsRecord) sheets() []*Sheet {
+	sheets := make([]*Sheet, len(r.IDs))
+	for i, id := range r.IDs {
+		sheets[i] = &Sheet{ID: id, VenueID: r.VenueID, Rank: r.Rank, Num: r.FirstNum + int64(i), Price: r.Price}
+	}
+	return sheets
+}
+
+type sheetRetireRecord struct {
+	ID int64 `json:"id"`
+}
+
+type rankPriceRecord struct {
+	VenueID int64  `json:"venue_id"`
+	Rank    string `json:"rank"`
+	Price   int64  `json:"price"`
+}
+
+type waitlistRecord struct {
+	ID        int64     `json:"id"`
+	EventID   int64     `json:"event_id"`
+	Rank      string    `json:"rank"`
+	UserID    int64     `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (r waitlistRecord) entry() *WaitlistEntry {
+	return &WaitlistEntry{ID: r.ID, EventID: r.EventID, Rank: r.Rank, UserID: r.UserID, CreatedAt: r.CreatedAt}
+}
+
+type waitlistDropRecord struct {
+	ID int64 `json:"id"`
+}
+
+type transitionRecord struct {
+	ID          int64     `json:"id"`
+	EventID     int64     `json:"event_id"`
+	PublicFg    bool      `json:"public"`
+	ClosedFg    bool      `json:"closed"`
+	RunAt       time.Time `json:"run_at"`
+	ScheduledBy int64     `json:"scheduled_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (r transitionRecord) transition() *EventTransition {
+	return &EventTransition{ID: r.ID, EventID: r.EventID, PublicFg: r.PublicFg, ClosedFg: r.ClosedFg, RunAt: r.RunAt, ScheduledBy: r.ScheduledBy, CreatedAt: r.CreatedAt}
+}
+
+type promoRecord struct {
+	ID             int64      `json:"id"`
+	Code           string     `json:"code"`
+	Kind           string     `json:"kind"`
+	Value          int64      `json:"value"`
+	Scope          PromoScope `json:"scope"`
+	MaxUses        int        `json:"max_uses,omitempty"`
+	MaxUsesPerUser int        `json:"max_uses_per_user,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+func newPromoRecord(p *PromoCode) promoRecord {
+	return promoRecord{
+		ID:             p.ID,
+		Code:           p.Code,
+		Kind:           p.Kind,
+		Value:          p.Value,
+		Scope:          p.Scope,
+		MaxUses:        p.MaxUses,
+		MaxUsesPerUser: p.MaxUsesPerUser,
+		ExpiresAt:      p.ExpiresAt,
+		CreatedAt:      p.CreatedAt,
+	}
+}
+
+func (r promoRecord) promo() *PromoCode {
+	return &PromoCode{
+		ID:             r.ID,
+		Code:           r.Code,
+		Kind:           r.Kind,
+		Value:          r.Value,
+		Scope:          r.Scope,
+		MaxUses:        r.MaxUses,
+		MaxUsesPerUser: r.MaxUsesPerUser,
+		ExpiresAt:      r.ExpiresAt,
+		CreatedAt:      r.CreatedAt,
+	}
+}
+
+type promoDisableRecord struct {
+	ID int64 `json:"id"`
+}
+
+type transferRecord struct {
+	ID            int64     `json:"id"`
+	ReservationID int64     `json:"reservation_id"`
+	EventID       int64     `json:"event_id"`
+	FromUserID    int64     `json:"from_user_id"`
+	ToUserID      int64     `json:"to_user_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func newTransferRecord(t *TicketTransfer) transferRecord {
+	return transferRecord{ID: t.ID, ReservationID: t.ReservationID, EventID: t.EventID, FromUserID: t.FromUserID, ToUserID: t.ToUserID, CreatedAt: t.CreatedAt}
+}
+
+func (r transferRecord) transfer() *TicketTransfer {
+	return &TicketTransfer{ID: r.ID, ReservationID: r.ReservationID, EventID: r.EventID, FromUserID: r.FromUserID, ToUserID: r.ToUserID, CreatedAt: r.CreatedAt}
+}
+
+// transferEndRecord finishes a transfer. One that was accepted carries the
+// reservation's new holder along, so the two are never replayed apart,
+// unless MySQL allocates and the reservation was moved there already.
+type transferEndRecord struct {
+	ID            int64     `json:"id"`
+	DoneAt        time.Time `json:"done_at"`
+	Accepted      bool      `json:"accepted,omitempty"`
+	ReservationID int64     `json:"reservation_id,omitempty"`
+	UserID        int64     `json:"user_id,omitempty"`
+}
+
+// transitionEndRecord finishes a transition. One that was applied carries
+// the event update along, so the two are never replayed apart.
+type transitionEndRecord struct {
+	ID       int64        `json:"id"`
+	DoneAt   time.Time    `json:"done_at"`
+	Canceled bool         `json:"canceled,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Event    *eventRecord `json:"event,omitempty"`
+}
+
+// decodeRecord turns a journal record into the typed record for its op, or
+// nil for an op it does not know.
+func decodeRecord(rec *journalRecord) (interface{}, error) {
+	var v interface{}
+	switch rec.Op {
+	case opReserve:
+		v = &reserveRecord{}
+	case opReserveBatch:
+		v = &reserveBatchRecord{}
+	case opCancel:
+		v = &cancelRecord{}
+	case opConfirm:
+		v = &confirmRecord{}
+	case opOffer:
+		v = &offerRecord{}
+	case opEventCreate, opEventUpdate, opEventSeats, opEventLimits, opEventSchedule, opEventPricing, opEventCancellation:
+		v = &eventRecord{}
+	case opVenueCreate:
+		v = &venueRecord{}
+	case opSheetsAdd:
+		v = &sheetsRecord{}
+	case opSheetRetire:
+		v = &sheetRetireRecord{}
+	case opRankPrice:
+		v = &rankPriceRecord{}
+	case opActiveLimit:
+		v = &activeLimitRecord{}
+	case opWaitlistJoin:
+		v = &waitlistRecord{}
+	case opWaitlistDrop:
+		v = &waitlistDropRecord{}
+	case opTransitionAdd:
+		v = &transitionRecord{}
+	case opTransitionEnd:
+		v = &transitionEndRecord{}
+	case opPromoCreate:
+		v = &promoRecord{}
+	case opPromoDisable:
+		v = &promoDisableRecord{}
+	case opTransferOffer:
+		v = &transferRecord{}
+	case opTransferEnd:
+		v = &transferEndRecord{}
+	default:
+		return nil, nil
+	}
+	if err := json.Unmarshal(rec.Data, v); err != nil {
+		return nil, err
+	}
+	// Hand out values, the same types the stores enqueue.
+	switch r := v.(type) {
+	case *reserveRecord:
+		return *r, nil
+	case *reserveBatchRecord:
+		return *r, nil
+	case *cancelRecord:
+		return *r, nil
+	case *confirmRecord:
+		return *r, nil
+	case *offerRecord:
+		return *r, nil
+	case *eventRecord:
+		if r.VenueID == 0 {
+			r.VenueID = defaultVenueID
+		}
+		return *r, nil
+	case *venueRecord:
+		return *r, nil
+	case *sheetsRecord:
+		return *r, nil
+	case *sheetRetireRecord:
+		return *r, nil
+	case *rankPriceRecord:
+		return *r, nil
+	case *activeLimitRecord:
+		return *r, nil
+	case *waitlistRecord:
+		return *r, nil
+	case *waitlistDropRecord:
+		return *r, nil
+	case *transitionRecord:
+		return *r, nil
+	case *transitionEndRecord:
+		return *r, nil
+	case *promoRecord:
+		return *r, nil
+	case *promoDisableRecord:
+		return *r, nil
+	case *transferRecord:
+		return *r, nil
+	case *transferEndRecord:
+		return *r, nil
+	}
+	return nil, nil
+}
+
+func openJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Journal{f: f, path: path, size: fi.Size()}, nil
+}
+
+// TrackWrites makes the journal remember which records are not in MySQL yet,
+// so Done can drop the ones before them. Call it before the first Append.
+func (j *Journal) TrackWrites() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.unwritten = make(map[int64]int64)
+	j.order = nil
+	j.compactBytes = int64(GetenvInt("JOURNAL_COMPACT_BYTES", 4<<20))
+}
+
+// Append writes a record without waiting for it to hit the disk. Callers
+// append while still holding the store lock, so the journal order matches the
+// order the mutations were applied in memory, and call Sync after unlocking.
+func (j *Journal) Append(op string, v interface{}) (int64, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	rec := journalRecord{Seq: j.seq + 1, Op: op, Data: data}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	j.seq = rec.Seq
+	if j.unwritten != nil {
+		j.unwritten[rec.Seq] = j.size
+		j.order = append(j.order, rec.Seq)
+	}
+	j.size += int64(len(line)) + 1
+	return rec.Seq, nil
+}
+
+// Sync blocks until the record seq is durable. Concurrent callers share a
+// single fsync.
+func (j *Journal) Sync(seq int64) error {
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+
+	if j.synced >= seq {
+		return nil
+	}
+
+	j.mu.Lock()
+	cur, f := j.seq, j.f
+	j.mu.Unlock()
+
+	if err := f.Sync(); err != nil {
+		j.mu.Lock()
+		compacted := j.f != f
+		j.mu.Unlock()
+		// Compacting syncs the new file before swapping it in, and what it
+		// left behind is in MySQL already.
+		if !compacted {
+			return err
+		}
+	}
+	j.synced = cur
+	return nil
+}
+
+// Done marks the record seq as handled by the writer, err being why MySQL
+// refused it; a refused record goes to the dead-letter file. Every record
+// before the oldest one still unwritten is dropped from the journal: all of
+// them once nothing is left, otherwise by compacting once enough of the file
+// is behind it.
+func (j *Journal) Done(seq int64, op string, data interface{}, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err != nil {
+		rec := journalRecord{Seq: seq, Op: op}
+		var merr error
+		if rec.Data, merr = json.Marshal(data); merr != nil {
+			log.Printf("journal: cannot dead-letter %s record: %v", op, merr)
+		} else if derr := j.DeadLetter(&rec, err); derr != nil {
+			log.Printf("journal: cannot dead-letter %s record: %v", op, derr)
+		}
+	}
+	if j.unwritten == nil {
+		return
+	}
+	delete(j.unwritten, seq)
+	for len(j.order) > 0 {
+		if _, ok := j.unwritten[j.order[0]]; ok {
+			break
+		}
+		j.order = j.order[1:]
+	}
+
+	if len(j.order) == 0 {
+		if j.size > 0 {
+			if err := j.truncate(); err != nil {
+				log.Println("journal: truncate failed:", err)
+			}
+		}
+		return
+	}
+	if from := j.unwritten[j.order[0]]; from >= j.compactBytes {
+		if err := j.compact(from); err != nil {
+			log.Println("journal: compaction failed:", err)
+		}
+	}
+}
+
+// DeadLetter appends rec to the dead-letter file along with why it could not
+// be written. It does not take the journal lock, so it may be called while
+// replaying.
+func (j *Journal) DeadLetter(rec *journalRecord, cause error) error {
+	line, err := json.Marshal(deadRecord{journalRecord: *rec, Error: cause.Error(), At: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return j.appendDead(line, rec.Op, cause)
+}
+
+func (j *Journal) deadLetterLine(raw []byte, cause error) error {
+	line, err := json.Marshal(deadRecord{Line: string(raw), Error: cause.Error(), At: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return j.appendDead(line, "unparsable", cause)
+}
+
+func (j *Journal) appendDead(line []byte, op string, cause error) error {
+	j.deadMu.Lock()
+	defer j.deadMu.Unlock()
+
+	f, err := os.OpenFile(j.path+".dead", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	log.Printf("journal: moved %s record to %s.dead: %v", op, j.path, cause)
+	return f.Sync()
+}
+
+// Replay calls fn for every complete record in the journal. A torn last line
+// is the record of a request that never got its response, so it is skipped.
+func (j *Journal) Replay(fn func(rec *journalRecord) error) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(j.f)
+	n := 0
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Println("journal: dropping incomplete trailing record")
+				if err := j.f.Truncate(offset); err != nil {
+					return n, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		var rec journalRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if derr := j.deadLetterLine(line, err); derr != nil {
+				return n, err
+			}
+			offset += int64(len(line))
+			continue
+		}
+		if err := fn(&rec); err != nil {
+			return n, err
+		}
+		if rec.Seq > j.seq {
+			j.seq = rec.Seq
+		}
+		offset += int64(len(line))
+		n++
+	}
+	j.size = offset
+	return n, nil
+}
+
+// Reset drops everything in the journal. Used after a successful replay and
+// when the database is reinitialized.
+func (j *Journal) Reset() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.unwritten != nil {
+		j.unwritten = make(map[int64]int64)
+		j.order = nil
+	}
+	return j.truncate()
+}
+
+// truncate empties the journal.
+func (j *Journal) truncate() error {
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	return j.f.Sync()
+}
+
+// compact copies the journal from offset from on to a new file and swaps it
+// in. The records before from are all in MySQL.
+func (j *Journal) compact(from int64) error {
+	tail := make([]byte, j.size-from)
+	if _, err := j.f.ReadAt(tail, from); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(tail); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		f.Close()
+		return err
+	}
+
+	j.f.Close()
+	j.f = f
+	j.size -= from
+	for seq := range j.unwritten {
+		j.unwritten[seq] -= from
+	}
+	return nil
+}
+
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
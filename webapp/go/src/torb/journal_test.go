@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// journalSeqs returns the seqs of the records left in the journal.
+func journalSeqs(t *testing.T, j *Journal) []int64 {
+	var seqs []int64
+	if _, err := j.Replay(func(rec *journalRecord) error {
+		seqs = append(seqs, rec.Seq)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func TestJournalKeepsUnwritten(t *testing.T) {
+	j, err := openJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	j.TrackWrites()
+	j.compactBytes = 1
+
+	for i := 0; i < 4; i++ {
+		if _, err := j.Append(opCancel, cancelRecord{ID: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2 is not written yet: only 1 may go, although 3 is done too.
+	j.Done(1, opCancel, nil, nil)
+	j.Done(3, opCancel, nil, nil)
+	if got, want := journalSeqs(t, j), []int64{2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("journal holds %v, want %v", got, want)
+	}
+
+	j.Done(2, opCancel, nil, nil)
+	if got, want := journalSeqs(t, j), []int64{4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("journal holds %v, want %v", got, want)
+	}
+
+	// Records appended after compacting are tracked in the new file.
+	if _, err := j.Append(opCancel, cancelRecord{ID: 5}); err != nil {
+		t.Fatal(err)
+	}
+	j.Done(4, opCancel, nil, nil)
+	if got, want := journalSeqs(t, j), []int64{5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("journal holds %v, want %v", got, want)
+	}
+	if err := j.Sync(5); err != nil {
+		t.Fatal(err)
+	}
+
+	j.Done(5, opCancel, nil, nil)
+	if got := journalSeqs(t, j); len(got) != 0 {
+		t.Fatalf("journal holds %v, want nothing", got)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrLimitExceeded = errors.New("purchase limit exceeded")
+	errInvalidLimits = errors.New("invalid limits")
+)
+
+// PurchaseLimits caps how many active reservations, holds included, one
+// user may have for an event: Event over all its ranks, Ranks per rank. Zero
+// or missing means no cap. It is stored as JSON in events.limits.
+type PurchaseLimits struct {
+	Event int            `json:"event,omitempty"`
+	Ranks map[string]int `json:"ranks,omitempty"`
+}
+
+func (l *PurchaseLimits) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.Event < 0 {
+		return errInvalidLimits
+	}
+	for _, n := range l.Ranks {
+		if n < 0 {
+			return errInvalidLimits
+		}
+	}
+	return nil
+}
+
+func (l *PurchaseLimits) String() string {
+	if l == nil {
+		return ""
+	}
+	b, _ := json.Marshal(l)
+	return string(b)
+}
+
+func (l PurchaseLimits) Value() (driver.Value, error) {
+	return json.Marshal(l)
+}
+
+func (l *PurchaseLimits) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, l)
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	}
+	return fmt.Errorf("cannot scan %T into PurchaseLimits", src)
+}
+
+// userHoldings counts a user's active reservations: in total, for one
+// event and for one rank of it.
+type userHoldings struct {
+	Total, Event, Rank int
+}
+
+// userLimits is everything that caps one reservation request: the global
+// limit on active reservations per user and the event's own limits.
+type userLimits struct {
+	Active int
+	Event  *PurchaseLimits
+}
+
+func (l userLimits) none() bool {
+	return l.Active == 0 && l.Event == nil
+}
+
+// allows reports whether a user holding h may add n reservations of rank.
+func (l userLimits) allows(h userHoldings, rank string, n int) bool {
+	if l.Active > 0 && h.Total+n > l.Active {
+		return false
+	}
+	if l.Event == nil {
+		return true
+	}
+	if l.Event.Event > 0 && h.Event+n > l.Event.Event {
+		return false
+	}
+	if max := l.Event.Ranks[rank]; max > 0 && h.Rank+n > max {
+		return false
+	}
+	return true
+}
+
+// checkLimitsTx enforces limits inside a transaction that is about to
+// reserve n sheets of rank. Locking the user's row serializes their
+// reservations across events and app instances until the transaction ends.
+func checkLimitsTx(tx *sql.Tx, eventID, userID int64, rank string, n int, limits userLimits) error {
+	if limits.none() {
+		return nil
+	}
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&id); err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT r.event_id, s.`rank` FROM reservations r JOIN sheets s ON s.id = r.sheet_id WHERE r.user_id = ? AND r.canceled_at IS NULL", userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var h userHoldings
+	for rows.Next() {
+		var e int64
+		var r string
+		if err := rows.Scan(&e, &r); err != nil {
+			return err
+		}
+		h.Total++
+		if e == eventID {
+			h.Event++
+			if r == rank {
+				h.Rank++
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !limits.allows(h, rank, n) {
+		return ErrLimitExceeded
+	}
+	return nil
+}
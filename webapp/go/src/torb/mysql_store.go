@@ -0,0 +1,1007 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mysqlStore keeps events and reservations in memory and MySQL as the
+// durable copy: mutations are journaled locally and written behind by the
+// DBWriter. Users and administrators are read straight from MySQL.
+//
+// With dbAllocation set, reservations are instead written synchronously, so
+// every reservation ID comes from MySQL, and the unique key on (event_id,
+// sheet_id, active) decides who gets a sheet: several processes can sell
+// from the same database without double-selling. Cancellations, holds
+// offered off the waitlist, confirmations and transfers are written in
+// MySQL first as well, and memory follows what it committed. New waitlist
+// entries, transitions, promo codes and transfers are inserted right away so
+// MySQL hands out their IDs too.
+// Without it a conflicting row written behind is dropped by the writer's
+// ON DUPLICATE KEY clause; the writer counts and logs it, and a reconcile
+// shows what is missing.
+type mysqlStore struct {
+	*memoryStore
+	mysqlAccounts
+	db           *sql.DB
+	writer       *DBWriter
+	dbAllocation bool
+
+	lastReconcile      *ReconcileReport
+	lastReconcileMutex sync.Mutex
+}
+
+func newMySQLStore(db *sql.DB, journalPath string, dbAllocation bool) (*mysqlStore, error) {
+	journal, err := openJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &mysqlStore{db: db, mysqlAccounts: mysqlAccounts{db}, dbAllocation: dbAllocation}
+	s.writer = newDBWriter(db, journal)
+	n, err := journal.Replay(s.replayJournalRecord)
+	if err != nil {
+		return nil, errors.New("journal replay failed: " + err.Error())
+	}
+	if n > 0 {
+		log.Printf("journal: replayed %d records", n)
+	}
+	if err := journal.Reset(); err != nil {
+		return nil, err
+	}
+	journal.TrackWrites()
+
+	s.memoryStore = newMemoryStore(journal, s.writer)
+	if dbAllocation {
+		s.newID = s.insertNew
+	}
+	return s, nil
+}
+
+// insertNew inserts a new waitlist entry, transition, promo code or transfer
+// and returns the ID MySQL gave it. A customer another process put on the
+// waitlist already keeps the entry they have.
+func (s *mysqlStore) insertNew(record interface{}) (int64, error) {
+	var res sql.Result
+	var err error
+	switch r := record.(type) {
+	case waitlistRecord:
+		res, err = s.db.Exec("INSERT INTO waitlist (event_id, `rank`, user_id, created_at) VALUES (?, ?, ?, ?)",
+			r.EventID, r.Rank, r.UserID, r.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+		if isDuplicateEntry(err) {
+			var id int64
+			err = s.db.QueryRow("SELECT id FROM waitlist WHERE event_id = ? AND `rank` = ? AND user_id = ?", r.EventID, r.Rank, r.UserID).Scan(&id)
+			return id, err
+		}
+	case transitionRecord:
+		res, err = s.db.Exec("INSERT INTO event_transitions (event_id, public_fg, closed_fg, run_at, scheduled_by, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			r.EventID, r.PublicFg, r.ClosedFg, r.RunAt.Format("2006-01-02 15:04:05.000000"), r.ScheduledBy, r.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+	case promoRecord:
+		res, err = s.db.Exec("INSERT INTO promo_codes (code, kind, value, scope, max_uses, max_uses_per_user, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			r.Code, r.Kind, r.Value, r.Scope, r.MaxUses, r.MaxUsesPerUser, dbTime(r.ExpiresAt), r.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+		if isDuplicateEntry(err) {
+			return 0, ErrDuplicated
+		}
+	case transferRecord:
+		res, err = s.db.Exec("INSERT INTO transfers (reservation_id, event_id, from_user_id, to_user_id, created_at) VALUES (?, ?, ?, ?, ?)",
+			r.ReservationID, r.EventID, r.FromUserID, r.ToUserID, r.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+	default:
+		return 0, errors.New("no table for new record")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// replayJournalRecord writes a record left over from the last run. The
+// writer's statements are idempotent, so records that did make it to MySQL
+// are harmless. A record MySQL refuses is dead-lettered rather than holding
+// up the start; only an unreachable MySQL stops it.
+func (s *mysqlStore) replayJournalRecord(rec *journalRecord) error {
+	v, err := decodeRecord(rec)
+	if err != nil {
+		return s.writer.journal.DeadLetter(rec, err)
+	}
+	if v == nil {
+		log.Println("journal: unknown op", rec.Op)
+		return s.writer.journal.DeadLetter(rec, errors.New("unknown op"))
+	}
+	op := &writeOp{op: rec.Op, data: v}
+	if err := s.writer.writeWithRetry([]*writeOp{op})[op]; err != nil {
+		if isTransientDBError(err) {
+			return err
+		}
+		return s.writer.journal.DeadLetter(rec, err)
+	}
+	return nil
+}
+
+func (s *mysqlStore) Load() error {
+	catalog, err := loadVenueCatalog(s.db)
+	if err != nil {
+		return err
+	}
+	s.setVenues(catalog)
+
+	if err := backfillPrices(s.db); err != nil {
+		return err
+	}
+	reservations, err := loadReservations(s.db)
+	if err != nil {
+		return err
+	}
+	events, err := loadEvents(s.db)
+	if err != nil {
+		return err
+	}
+	waitlist, err := loadWaitlist(s.db)
+	if err != nil {
+		return err
+	}
+	transitions, err := loadTransitions(s.db)
+	if err != nil {
+		return err
+	}
+	promos, err := loadPromoCodes(s.db)
+	if err != nil {
+		return err
+	}
+	transfers, err := loadTransfers(s.db)
+	if err != nil {
+		return err
+	}
+	activeLimit, err := loadActiveLimit(s.db)
+	if err != nil {
+		return err
+	}
+	s.reservations.Replace(reservations)
+	s.events.Replace(events)
+	s.waitlist.Replace(waitlist)
+	s.transitions.Replace(transitions)
+	s.promos.Replace(promos)
+	s.transfers.Replace(transfers)
+	atomic.StoreInt64(&s.activeLimit, int64(activeLimit))
+	return nil
+}
+
+// backfillPrices gives reservations made before prices were recorded the
+// event's and the sheet's price as they are now, the best there is to go
+// on.
+func backfillPrices(db *sql.DB) error {
+	_, err := db.Exec("UPDATE reservations r JOIN events e ON e.id = r.event_id JOIN sheets s ON s.id = r.sheet_id SET r.price = e.price + s.price, r.base_price = e.price, r.rank_price = s.price, r.adjustment = 0 WHERE r.price IS NULL")
+	return err
+}
+
+// reservationColumns are the columns scanReservation reads, in order.
+const reservationColumns = "id, event_id, sheet_id, user_id, reserved_at, canceled_at, expires_at, price, base_price, rank_price, adjustment, discount, promo_id, cancel_fee"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReservation(row rowScanner) (*Reservation, error) {
+	var r Reservation
+	var b PriceBreakdown
+	if err := row.Scan(
+		&r.ID,
+		&r.EventID,
+		&r.SheetID,
+		&r.UserID,
+		&r.ReservedAt,
+		&r.CanceledAt,
+		&r.ExpiresAt,
+		&r.Price,
+		&b.Base,
+		&b.Rank,
+		&b.Adjustment,
+		&b.Discount,
+		&r.PromoCodeID,
+		&r.CancelFee); err != nil {
+		return nil, err
+	}
+	r.Breakdown = &b
+	return &r, nil
+}
+
+func loadReservations(db *sql.DB) (*ReservationStore, error) {
+	rows, err := db.Query("SELECT " + reservationColumns + " FROM reservations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	store := newReservationStore()
+
+	for rows.Next() {
+		reservation, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+		store.Add(reservation)
+	}
+
+	return store, rows.Err()
+}
+
+func loadEvents(db *sql.DB) ([]*Event, error) {
+	rows, err := db.Query("SELECT id, title, public_fg, closed_fg, price, venue_id, allocation, limits, schedule, pricing, cancellation FROM events ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*Event, 0)
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.VenueID, &event.Allocation, &event.Limits, &event.Schedule, &event.Pricing, &event.Cancellation); err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+func loadWaitlist(db *sql.DB) (*WaitlistStore, error) {
+	rows, err := db.Query("SELECT id, event_id, `rank`, user_id, created_at FROM waitlist ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	store := newWaitlistStore()
+	for rows.Next() {
+		var e WaitlistEntry
+		if err := rows.Scan(&e.ID, &e.EventID, &e.Rank, &e.UserID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		store.Add(&e)
+	}
+	return store, rows.Err()
+}
+
+func loadTransitions(db *sql.DB) (*TransitionStore, error) {
+	rows, err := db.Query("SELECT id, event_id, public_fg, closed_fg, run_at, scheduled_by, created_at, done_at, canceled_fg, error_message FROM event_transitions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	store := newTransitionStore()
+	for rows.Next() {
+		var t EventTransition
+		if err := rows.Scan(&t.ID, &t.EventID, &t.PublicFg, &t.ClosedFg, &t.RunAt, &t.ScheduledBy, &t.CreatedAt, &t.DoneAt, &t.Canceled, &t.Error); err != nil {
+			return nil, err
+		}
+		store.Put(&t)
+	}
+	return store, rows.Err()
+}
+
+func loadTransfers(db *sql.DB) (*TransferStore, error) {
+	rows, err := db.Query("SELECT id, reservation_id, event_id, from_user_id, to_user_id, created_at, done_at, accepted_fg FROM transfers")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	store := newTransferStore()
+	for rows.Next() {
+		var t TicketTransfer
+		if err := rows.Scan(&t.ID, &t.ReservationID, &t.EventID, &t.FromUserID, &t.ToUserID, &t.CreatedAt, &t.DoneAt, &t.Accepted); err != nil {
+			return nil, err
+		}
+		store.Put(&t)
+	}
+	return store, rows.Err()
+}
+
+func loadPromoCodes(db *sql.DB) (*PromoStore, error) {
+	rows, err := db.Query("SELECT id, code, kind, value, scope, max_uses, max_uses_per_user, expires_at, disabled_fg, created_at FROM promo_codes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	store := newPromoStore()
+	for rows.Next() {
+		var p PromoCode
+		if err := rows.Scan(&p.ID, &p.Code, &p.Kind, &p.Value, &p.Scope, &p.MaxUses, &p.MaxUsesPerUser, &p.ExpiresAt, &p.Disabled, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		store.Put(&p)
+	}
+	return store, rows.Err()
+}
+
+// settingActiveLimit is the settings row holding ActiveLimit.
+const settingActiveLimit = "max_active_reservations"
+
+func loadActiveLimit(db *sql.DB) (int, error) {
+	var value string
+	if err := db.QueryRow("SELECT value FROM settings WHERE name = ?", settingActiveLimit).Scan(&value); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+func (s *mysqlStore) Reserve(eventID, userID int64, candidates []int64, promo *PromoCode) (*Reservation, error) {
+	if !s.dbAllocation {
+		return s.memoryStore.Reserve(eventID, userID, candidates, promo)
+	}
+
+	// Memory does not see what other processes cancel, so once it has no
+	// free candidate left the decision falls back to what MySQL says.
+	var dbActive map[int64]bool
+	tried := make(map[int64]bool)
+	retries := 0
+	for {
+		active := s.reservations.ActiveByEvent(eventID)
+		sheetID := int64(-1)
+		for _, id := range candidates {
+			used := dbActive[id]
+			if dbActive == nil {
+				_, used = active[id]
+			}
+			if !used && !tried[id] {
+				sheetID = id
+				break
+			}
+		}
+		if sheetID == -1 {
+			if dbActive != nil {
+				return nil, ErrSoldOut
+			}
+			var err error
+			if dbActive, err = activeSheets(s.db, eventID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		reservedAt := time.Now().UTC().Truncate(time.Microsecond)
+		rs, conflict, err := s.insertReservations(eventID, userID, []int64{sheetID}, reservedAt, nil, promo)
+		if err != nil {
+			if conflict != 0 {
+				// Someone else holds the sheet, most likely another
+				// process. Learn about it and try the next candidate.
+				tried[sheetID] = true
+				if err := s.loadActiveReservation(eventID, sheetID); err != nil {
+					log.Println("allocation: could not load conflicting reservation:", err)
+				}
+				continue
+			}
+			if isTransientDBError(err) && retries < s.writer.maxRetries {
+				retries++
+				continue
+			}
+			return nil, err
+		}
+		s.addAllocated(rs[0])
+		return rs[0], nil
+	}
+}
+
+// addAllocated puts a reservation as MySQL has it into memory. Memory does
+// not see what other processes do, so a different reservation it still has
+// active on the sheet is read back first: MySQL knows better.
+func (s *mysqlStore) addAllocated(r *Reservation) {
+	if r.CanceledAt == nil {
+		if old := s.reservations.ActiveOn(r.EventID, r.SheetID); old != nil && old.ID != r.ID {
+			if err := s.refresh(old.ID); err != nil {
+				log.Println("allocation: could not refresh reservation:", err)
+			}
+		}
+	}
+	s.reservations.Put(r)
+}
+
+// refresh reads reservations back from MySQL into memory.
+func (s *mysqlStore) refresh(ids ...int64) error {
+	for _, id := range ids {
+		r, err := scanReservation(s.db.QueryRow("SELECT "+reservationColumns+" FROM reservations WHERE id = ?", id))
+		if err != nil {
+			return err
+		}
+		s.addAllocated(r)
+	}
+	return nil
+}
+
+// ReserveSeats inserts the whole group in one transaction. A sheet that
+// turns out to be taken is remembered and the group is picked again.
+func (s *mysqlStore) ReserveSeats(eventID, userID int64, sheets []*Sheet, count int, alloc SeatAllocator, hold time.Duration, promo *PromoCode) ([]*Reservation, error) {
+	if !s.dbAllocation {
+		return s.memoryStore.ReserveSeats(eventID, userID, sheets, count, alloc, hold, promo)
+	}
+
+	var dbActive map[int64]bool
+	tried := make(map[int64]bool)
+	retries := 0
+	for {
+		active := s.reservations.ActiveByEvent(eventID)
+		sheetIDs := pickSeats(sheets, count, func(id int64) bool {
+			if tried[id] {
+				return true
+			}
+			if dbActive != nil {
+				return dbActive[id]
+			}
+			_, used := active[id]
+			return used
+		}, alloc)
+		if sheetIDs == nil {
+			if dbActive != nil {
+				return nil, ErrSoldOut
+			}
+			var err error
+			if dbActive, err = activeSheets(s.db, eventID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		reservedAt := time.Now().UTC().Truncate(time.Microsecond)
+		var expiresAt *time.Time
+		if hold > 0 {
+			t := reservedAt.Add(hold)
+			expiresAt = &t
+		}
+		rs, conflict, err := s.insertReservations(eventID, userID, sheetIDs, reservedAt, expiresAt, promo)
+		if err != nil {
+			if conflict != 0 {
+				tried[conflict] = true
+				if err := s.loadActiveReservation(eventID, conflict); err != nil {
+					log.Println("allocation: could not load conflicting reservation:", err)
+				}
+				continue
+			}
+			if isTransientDBError(err) && retries < s.writer.maxRetries {
+				retries++
+				continue
+			}
+			return nil, err
+		}
+		for _, r := range rs {
+			s.addAllocated(r)
+		}
+		return rs, nil
+	}
+}
+
+// insertReservations inserts one reservation per sheet in a transaction,
+// discounted by promo if it is not nil. When a sheet is already taken it
+// rolls back and reports that sheet.
+func (s *mysqlStore) insertReservations(eventID, userID int64, sheetIDs []int64, reservedAt time.Time, expiresAt *time.Time, promo *PromoCode) ([]*Reservation, int64, error) {
+	// Disabling a code is written behind, so memory knows first.
+	if err := s.checkPromo(promo); err != nil {
+		return nil, 0, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	rank := sheetRank(sheetIDs[0])
+	if err := checkLimitsTx(tx, eventID, userID, rank, len(sheetIDs), s.userLimits(eventID)); err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+	if err := checkPromoTx(tx, promo, userID, len(sheetIDs)); err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+	// Priced by what memory has reserved, which may trail other processes.
+	prices := s.seatPrices(eventID, sheetIDs, s.ReservedCounts(eventID)[rank])
+	var promoID int64
+	if promo != nil {
+		promoID = promo.ID
+	}
+	rs := make([]*Reservation, 0, len(sheetIDs))
+	for i, sheetID := range sheetIDs {
+		b := prices[i]
+		if promo != nil {
+			b = promo.apply(b)
+		}
+		res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at, expires_at, price, base_price, rank_price, adjustment, discount, promo_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			eventID, sheetID, userID, reservedAt.Format("2006-01-02 15:04:05.000000"), dbTime(expiresAt), b.Total(), b.Base, b.Rank, b.Adjustment, b.Discount, promoID)
+		if err != nil {
+			tx.Rollback()
+			if isDuplicateEntry(err) {
+				return nil, sheetID, err
+			}
+			return nil, 0, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return nil, 0, err
+		}
+		r := &Reservation{ID: id, EventID: eventID, SheetID: sheetID, UserID: userID, ReservedAt: &reservedAt, ExpiresAt: expiresAt, PromoCodeID: promoID}
+		r.charge(b)
+		rs = append(rs, r)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	return rs, 0, nil
+}
+
+// dbTime formats an optional time for a DATETIME(6) column.
+func dbTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Format("2006-01-02 15:04:05.000000")
+}
+
+// activeSheets reads the sheets with an active reservation for the event.
+func activeSheets(db *sql.DB, eventID int64) (map[int64]bool, error) {
+	rows, err := db.Query("SELECT sheet_id FROM reservations WHERE event_id = ? AND canceled_at IS NULL", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	active := make(map[int64]bool)
+	for rows.Next() {
+		var sheetID int64
+		if err := rows.Scan(&sheetID); err != nil {
+			return nil, err
+		}
+		active[sheetID] = true
+	}
+	return active, rows.Err()
+}
+
+func (s *mysqlStore) loadActiveReservation(eventID, sheetID int64) error {
+	r, err := scanReservation(s.db.QueryRow("SELECT "+reservationColumns+" FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL", eventID, sheetID))
+	if err != nil {
+		return err
+	}
+	s.addAllocated(r)
+	return nil
+}
+
+// inTx runs fn in a transaction. Deadlocks, lock wait timeouts and a
+// duplicate key, which means another process got in first, are retried as
+// often as the writer retries a batch.
+func (s *mysqlStore) inTx(fn func(tx *sql.Tx) error) error {
+	for retries := 0; ; retries++ {
+		tx, err := s.db.Begin()
+		if err == nil {
+			if err = fn(tx); err != nil {
+				tx.Rollback()
+			} else {
+				err = tx.Commit()
+			}
+		}
+		if err == nil || retries >= s.writer.maxRetries || !(isTransientDBError(err) || isDuplicateEntry(err)) {
+			return err
+		}
+	}
+}
+
+// lockReservation reads a reservation for update.
+func lockReservation(tx *sql.Tx, query string, args ...interface{}) (*Reservation, error) {
+	return scanReservation(tx.QueryRow("SELECT "+reservationColumns+" FROM reservations WHERE "+query+" FOR UPDATE", args...))
+}
+
+// endPendingTransfer ends the transfer pending on a reservation canceled in
+// tx, if there is one, and returns its ID.
+func endPendingTransfer(tx *sql.Tx, reservationID int64, doneAt time.Time) (int64, error) {
+	var id int64
+	err := tx.QueryRow("SELECT id FROM transfers WHERE reservation_id = ? AND done_at IS NULL LIMIT 1 FOR UPDATE", reservationID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE transfers SET done_at = ? WHERE id = ?", doneAt.Format("2006-01-02 15:04:05.000000"), id)
+	return id, err
+}
+
+// ConfirmReservations confirms in MySQL first when it allocates, so that a
+// hold another process has released cannot be confirmed from memory.
+func (s *mysqlStore) ConfirmReservations(eventID, userID int64, ids []int64) ([]*Reservation, error) {
+	if !s.dbAllocation {
+		return s.memoryStore.ConfirmReservations(eventID, userID, ids)
+	}
+
+	var rs []*Reservation
+	err := s.inTx(func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		rs = make([]*Reservation, len(ids))
+		var confirmed []interface{}
+		for i, id := range ids {
+			r, err := lockReservation(tx, "id = ? AND event_id = ?", id, eventID)
+			if err == sql.ErrNoRows {
+				return ErrNotReserved
+			} else if err != nil {
+				return err
+			}
+			if r.UserID != userID {
+				return ErrNotPermitted
+			}
+			if r.CanceledAt != nil {
+				if r.ExpiresAt != nil {
+					return ErrHoldExpired
+				}
+				return ErrNotReserved
+			}
+			if r.ExpiresAt != nil {
+				if !now.Before(*r.ExpiresAt) {
+					return ErrHoldExpired
+				}
+				r.ExpiresAt = nil
+				confirmed = append(confirmed, r.ID)
+			}
+			rs[i] = r
+		}
+		if len(confirmed) == 0 {
+			return nil
+		}
+		_, err := tx.Exec("UPDATE reservations SET expires_at = NULL WHERE id IN "+placeholders(1, len(confirmed)), confirmed...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		s.addAllocated(r)
+	}
+	return rs, nil
+}
+
+// ReleaseExpiredHolds looks for expired holds in MySQL when it allocates,
+// so holds made by other processes are swept too.
+func (s *mysqlStore) ReleaseExpiredHolds() (int, error) {
+	if !s.dbAllocation {
+		return s.memoryStore.ReleaseExpiredHolds()
+	}
+
+	now := time.Now().UTC()
+	rows, err := s.db.Query("SELECT id FROM reservations WHERE expires_at <= ? AND canceled_at IS NULL", now.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, id := range ids {
+		r, next, err := s.free(func(tx *sql.Tx) (*Reservation, error) {
+			r, err := lockReservation(tx, "id = ? AND canceled_at IS NULL", id)
+			if err == sql.ErrNoRows {
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			if r.ExpiresAt == nil || now.Before(*r.ExpiresAt) {
+				return nil, nil
+			}
+			if _, err := tx.Exec("UPDATE reservations SET canceled_at = expires_at WHERE id = ?", id); err != nil {
+				return nil, err
+			}
+			r.CanceledAt = r.ExpiresAt
+			return r, nil
+		})
+		if err != nil {
+			return released, err
+		}
+		if r != nil {
+			released++
+		}
+		if next != nil {
+			notifyOffer(next)
+		}
+	}
+	return released, nil
+}
+
+// CancelReservation cancels in MySQL when it allocates: a cancellation
+// still queued for the writer would keep the sheet taken for everyone
+// else, and the hold offered off the waitlist needs an ID from MySQL.
+func (s *mysqlStore) CancelReservation(eventID, sheetID, userID int64, terms cancelTerms) (*Reservation, error) {
+	if !s.dbAllocation {
+		return s.memoryStore.CancelReservation(eventID, sheetID, userID, terms)
+	}
+
+	r, next, err := s.free(func(tx *sql.Tx) (*Reservation, error) {
+		r, err := lockReservation(tx, "event_id = ? AND sheet_id = ? AND canceled_at IS NULL", eventID, sheetID)
+		if err == sql.ErrNoRows {
+			return nil, ErrNotReserved
+		} else if err != nil {
+			return nil, err
+		}
+		if r.UserID != userID {
+			return nil, ErrNotPermitted
+		}
+		fee, err := terms.feeFor(r)
+		if err != nil {
+			return nil, err
+		}
+		canceledAt := time.Now().UTC().Truncate(time.Microsecond)
+		r.CanceledAt = &canceledAt
+		r.CancelFee = fee
+		if _, err := tx.Exec("UPDATE reservations SET canceled_at = ?, cancel_fee = ? WHERE id = ?", canceledAt.Format("2006-01-02 15:04:05.000000"), r.CancelFee, r.ID); err != nil {
+			return nil, err
+		}
+		return r, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		// Another process canceled it between our look at memory and ours.
+		return nil, ErrNotReserved
+	}
+	if next != nil {
+		notifyOffer(next)
+	}
+	return r, nil
+}
+
+// free runs cancel, which cancels a reservation in tx and returns it, or
+// nil if there was nothing to cancel. In the same transaction its pending
+// transfer is ended and the sheet is handed to the first customer on the
+// waitlist as a hold inserted with an ID from MySQL. Memory is updated once
+// MySQL has committed; only the waitlist entry's removal is written behind,
+// after its insert.
+func (s *mysqlStore) free(cancel func(tx *sql.Tx) (*Reservation, error)) (freed, next *Reservation, err error) {
+	err = s.mutate(func(seq *int64) error {
+		h := &handOff{m: s.memoryStore, seq: seq}
+		var transferID int64
+		err := s.inTx(func(tx *sql.Tx) error {
+			next = nil
+			var err error
+			if freed, err = cancel(tx); err != nil || freed == nil {
+				return err
+			}
+			if transferID, err = endPendingTransfer(tx, freed.ID, *freed.CanceledAt); err != nil {
+				return err
+			}
+			if h.entry == nil {
+				h.offer(freed)
+			}
+			if h.entry != nil {
+				next, err = s.insertHold(tx, freed, h.entry.UserID)
+			}
+			return err
+		})
+		if err != nil || freed == nil {
+			h.abort()
+			return err
+		}
+		s.addAllocated(freed)
+		if transferID != 0 {
+			s.transfers.MarkDone(transferID, *freed.CanceledAt, false)
+		}
+		if next == nil {
+			return nil
+		}
+		s.addAllocated(next)
+		return s.persist(seq, opWaitlistDrop, waitlistDropRecord{ID: h.entry.ID})
+	})
+	return freed, next, err
+}
+
+// insertHold gives the sheet of freed to userID as a hold.
+func (s *mysqlStore) insertHold(tx *sql.Tx, freed *Reservation, userID int64) (*Reservation, error) {
+	// Priced by what memory has reserved, which may trail other processes.
+	// The freed sheet still counts there, so the hold is priced as if it
+	// were back on sale.
+	reserved := s.ReservedCounts(freed.EventID)[sheetRank(freed.SheetID)] - 1
+	if reserved < 0 {
+		reserved = 0
+	}
+	b := s.sheetPrice(freed.EventID, freed.SheetID, reserved)
+
+	reservedAt := time.Now().UTC().Truncate(time.Microsecond)
+	expiresAt := reservedAt.Add(holdTTL)
+	res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at, expires_at, price, base_price, rank_price, adjustment) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		freed.EventID, freed.SheetID, userID, reservedAt.Format("2006-01-02 15:04:05.000000"), dbTime(&expiresAt), b.Total(), b.Base, b.Rank, b.Adjustment)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	hold := &Reservation{ID: id, EventID: freed.EventID, SheetID: freed.SheetID, UserID: userID, ReservedAt: &reservedAt, ExpiresAt: &expiresAt}
+	hold.charge(b)
+	return hold, nil
+}
+
+// AcceptTransfer moves the reservation in MySQL when it allocates. The
+// transfer itself is still written behind, without the reservation, which
+// must not be moved back by a late write.
+func (s *mysqlStore) AcceptTransfer(id, userID int64) (*TicketTransfer, error) {
+	if !s.dbAllocation {
+		return s.memoryStore.AcceptTransfer(id, userID)
+	}
+
+	t, ok := s.transfers.Get(id)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if t.ToUserID != userID {
+		return nil, ErrNotPermitted
+	}
+	limits := s.userLimits(t.EventID)
+	var done *TicketTransfer
+	err := s.mutate(func(seq *int64) error {
+		var err error
+		done, err = s.transfers.Finish(id, func(t *TicketTransfer) error {
+			var r *Reservation
+			err := s.inTx(func(tx *sql.Tx) error {
+				var err error
+				if r, err = lockReservation(tx, "id = ?", t.ReservationID); err == sql.ErrNoRows {
+					return ErrNotReserved
+				} else if err != nil {
+					return err
+				}
+				if r.CanceledAt != nil || r.ExpiresAt != nil {
+					return ErrNotReserved
+				}
+				if r.UserID != t.FromUserID {
+					return ErrNotPermitted
+				}
+				if err := checkLimitsTx(tx, t.EventID, t.ToUserID, sheetRank(r.SheetID), 1, limits); err != nil {
+					return err
+				}
+				r.UserID = t.ToUserID
+				_, err = tx.Exec("UPDATE reservations SET user_id = ? WHERE id = ?", r.UserID, r.ID)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			s.addAllocated(r)
+			now := time.Now().UTC()
+			t.DoneAt = &now
+			t.Accepted = true
+			return s.persist(seq, opTransferEnd, transferEndRecord{ID: t.ID, DoneAt: now, Accepted: true})
+		})
+		return err
+	})
+	return done, err
+}
+
+// runInitScript recreates the database from the initial dataset.
+func runInitScript() error {
+	cmd := exec.Command("../../db/init.sh")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
+
+func (s *mysqlStore) Initialize() error {
+	s.writer.Flush()
+
+	if err := runInitScript(); err != nil {
+		return err
+	}
+	if err := s.journal.Reset(); err != nil {
+		return err
+	}
+	return s.Load()
+}
+
+// Close drains the DB writer until ctx is done and reports anything left
+// behind. Unflushed writes are still in the journal and get replayed on the
+// next start.
+func (s *mysqlStore) Close(ctx context.Context) error {
+	var err error
+	pending := s.writer.Pending()
+	if unflushed, cerr := s.writer.Close(ctx); cerr != nil {
+		log.Printf("shutdown: %d writes could not be flushed: %v", unflushed, cerr)
+		for op, n := range pending {
+			log.Printf("shutdown:   %s: %d queued at shutdown", op, n)
+		}
+		err = cerr
+	}
+	if stats := s.writer.Stats(); stats.Failed > 0 {
+		log.Printf("shutdown: %d writes failed, last error: %s; refused ones are in %s.dead", stats.Failed, stats.LastError, s.journal.path)
+		err = errors.New("db writes failed")
+	}
+	if err != nil {
+		log.Printf("shutdown: journal %s kept for replay on next start", s.journal.path)
+	}
+	if cerr := s.journal.Close(); cerr != nil {
+		log.Println("shutdown: journal:", cerr)
+	}
+	return err
+}
+
+// mysqlAccounts implements the user and administrator half of Store directly
+// on MySQL.
+type mysqlAccounts struct {
+	db *sql.DB
+}
+
+func (s mysqlAccounts) CreateUser(nickname, loginName, password string) (*User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM users WHERE login_name = ?", loginName).Scan(&id); err != sql.ErrNoRows {
+		tx.Rollback()
+		if err == nil {
+			return nil, ErrDuplicated
+		}
+		return nil, err
+	}
+
+	res, err := tx.Exec("INSERT INTO users (login_name, pass_hash, nickname) VALUES (?, ?, ?)", loginName, passwordHash(password), nickname)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &User{ID: userID, Nickname: nickname, LoginName: loginName}, nil
+}
+
+func (s mysqlAccounts) GetUser(id int64) (*User, error) {
+	var user User
+	if err := s.db.QueryRow("SELECT id, nickname FROM users WHERE id = ?", id).Scan(&user.ID, &user.Nickname); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s mysqlAccounts) GetUserByLoginName(loginName string) (*User, error) {
+	var user User
+	if err := s.db.QueryRow("SELECT id, nickname, login_name, pass_hash FROM users WHERE login_name = ?", loginName).Scan(&user.ID, &user.Nickname, &user.LoginName, &user.PassHash); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s mysqlAccounts) GetAdministrator(id int64) (*Administrator, error) {
+	var administrator Administrator
+	if err := s.db.QueryRow("SELECT id, nickname FROM administrators WHERE id = ?", id).Scan(&administrator.ID, &administrator.Nickname); err != nil {
+		return nil, err
+	}
+	return &administrator, nil
+}
+
+func (s mysqlAccounts) GetAdministratorByLoginName(loginName string) (*Administrator, error) {
+	var administrator Administrator
+	if err := s.db.QueryRow("SELECT id, nickname, login_name, pass_hash FROM administrators WHERE login_name = ?", loginName).Scan(&administrator.ID, &administrator.Nickname, &administrator.LoginName, &administrator.PassHash); err != nil {
+		return nil, err
+	}
+	return &administrator, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Notification tells a customer that a sheet they waited for is being held
+// for them until ExpiresAt.
+type Notification struct {
+	UserID        int64  `json:"user_id"`
+	EventID       int64  `json:"event_id"`
+	ReservationID int64  `json:"reservation_id"`
+	SheetRank     string `json:"sheet_rank"`
+	SheetNum      int64  `json:"sheet_num"`
+	ExpiresAt     int64  `json:"expires_at"`
+}
+
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// logNotifier only logs; it is used when no webhook is configured.
+type logNotifier struct{}
+
+func (logNotifier) Notify(n *Notification) error {
+	log.Printf("notify: user %d offered %s-%d of event %d until %s", n.UserID, n.SheetRank, n.SheetNum, n.EventID, time.Unix(n.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	return nil
+}
+
+// webhookNotifier posts every notification as JSON to NOTIFY_WEBHOOK_URL,
+// which delivers it to the customer.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookNotifier(url string) *webhookNotifier {
+	return &webhookNotifier{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (w *webhookNotifier) Notify(n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+var notifier Notifier = logNotifier{}
+
+// notifyOffer tells a customer about the hold they got off the waitlist. It
+// does not hold up the request that freed the sheet; a failed delivery is
+// only logged, the hold shows up on the customer's page either way.
+func notifyOffer(r *Reservation) {
+	n := &Notification{
+		UserID:        r.UserID,
+		EventID:       r.EventID,
+		ReservationID: r.ID,
+		ExpiresAt:     r.ExpiresAt.Unix(),
+	}
+	if sheet := getSheetFromId(r.SheetID); sheet != nil {
+		n.SheetRank = sheet.Rank
+		n.SheetNum = sheet.Num
+	}
+	go func() {
+		if err := notifier.Notify(n); err != nil {
+			log.Printf("notify: user %d: %v", n.UserID, err)
+		}
+	}()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errInvalidPricing = errors.New("invalid pricing")
+
+// PricingPolicy adjusts the price of a rank when a sheet is reserved: steps
+// raise it as the rank sells out, early-bird discounts lower it until a
+// date. It is stored as JSON in events.pricing.
+type PricingPolicy struct {
+	Steps     []PriceStep `json:"steps,omitempty"`
+	EarlyBird []EarlyBird `json:"early_bird,omitempty"`
+}
+
+// PriceStep adds Add once no more than Remains sheets of Rank are left, or
+// of any rank if Rank is empty. Of the steps that apply only the largest
+// counts.
+type PriceStep struct {
+	Rank    string `json:"rank,omitempty"`
+	Remains int    `json:"remains"`
+	Add     int64  `json:"add"`
+}
+
+// EarlyBird takes Discount off reservations made before Until, in Unix
+// seconds. Of the discounts that apply only the largest counts.
+type EarlyBird struct {
+	Until    int64 `json:"until"`
+	Discount int64 `json:"discount"`
+}
+
+func (p *PricingPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, s := range p.Steps {
+		if s.Remains < 0 || s.Add < 0 {
+			return errInvalidPricing
+		}
+	}
+	for _, e := range p.EarlyBird {
+		if e.Until <= 0 || e.Discount < 0 {
+			return errInvalidPricing
+		}
+	}
+	return nil
+}
+
+func (p *PricingPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+func (p PricingPolicy) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
+func (p *PricingPolicy) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, p)
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	}
+	return fmt.Errorf("cannot scan %T into PricingPolicy", src)
+}
+
+// Adjustment is what the policy adds to the price of a sheet of rank when
+// remains sheets of it are left at now. It is negative for a discount.
+func (p *PricingPolicy) Adjustment(rank string, remains int, now time.Time) int64 {
+	if p == nil {
+		return 0
+	}
+	var add, discount int64
+	for _, s := range p.Steps {
+		if (s.Rank == "" || s.Rank == rank) && remains <= s.Remains && s.Add > add {
+			add = s.Add
+		}
+	}
+	for _, e := range p.EarlyBird {
+		if now.Unix() < e.Until && e.Discount > discount {
+			discount = e.Discount
+		}
+	}
+	return add - discount
+}
+
+// Quote prices a sheet of rank, which costs rankPrice on top of the event's
+// base price, when remains sheets of the rank are left at now. The
+// adjustment never takes the price below zero.
+func (p *PricingPolicy) Quote(base, rankPrice int64, rank string, remains int, now time.Time) PriceBreakdown {
+	b := PriceBreakdown{Base: base, Rank: rankPrice, Adjustment: p.Adjustment(rank, remains, now)}
+	if b.Total() < 0 {
+		b.Adjustment = -(base + rankPrice)
+	}
+	return b
+}
+
+// PriceBreakdown is how the price of a reservation was made up when it was
+// made, so later price changes leave it alone. Discount is what a promo
+// code took off.
+type PriceBreakdown struct {
+	Base       int64 `json:"base"`
+	Rank       int64 `json:"rank"`
+	Adjustment int64 `json:"adjustment"`
+	Discount   int64 `json:"discount,omitempty"`
+}
+
+func (b PriceBreakdown) Total() int64 {
+	return b.Base + b.Rank + b.Adjustment - b.Discount
+}
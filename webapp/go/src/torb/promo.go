@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrPromoExpired       = errors.New("promo code expired")
+	ErrPromoNotApplicable = errors.New("promo code not applicable")
+	ErrPromoExhausted     = errors.New("promo code used up")
+	errInvalidPromoCode   = errors.New("invalid promo code")
+)
+
+const (
+	promoPercent = "percent"
+	promoAmount  = "amount"
+)
+
+// PromoCode takes a discount off every sheet reserved with it: Value
+// percent of the sheet's price, or Value off it, never more than the price.
+// MaxUses caps its redemptions over all users and MaxUsesPerUser those of
+// one user, zero meaning no cap. A redemption is an active reservation made
+// with the code, so canceled ones and lapsed holds give the use back.
+type PromoCode struct {
+	ID             int64
+	Code           string
+	Kind           string
+	Value          int64
+	Scope          PromoScope
+	MaxUses        int
+	MaxUsesPerUser int
+	ExpiresAt      *time.Time
+	Disabled       bool
+	CreatedAt      time.Time
+}
+
+// PromoScope limits the events and ranks a promo code is good for; an empty
+// list means all of them. It is stored as JSON in promo_codes.scope.
+type PromoScope struct {
+	EventIDs []int64  `json:"event_ids,omitempty"`
+	Ranks    []string `json:"ranks,omitempty"`
+}
+
+func (s PromoScope) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *PromoScope) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	}
+	return fmt.Errorf("cannot scan %T into PromoScope", src)
+}
+
+func (s PromoScope) covers(eventID int64, rank string) bool {
+	if len(s.EventIDs) > 0 && !containsID(s.EventIDs, eventID) {
+		return false
+	}
+	if len(s.Ranks) > 0 && !containsString(s.Ranks, rank) {
+		return false
+	}
+	return true
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePromoCode is how codes are stored and looked up, so customers
+// need not match the case an administrator used.
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (p *PromoCode) Validate() error {
+	if p.Code == "" || len(p.Code) > 64 {
+		return errInvalidPromoCode
+	}
+	switch p.Kind {
+	case promoPercent:
+		if p.Value <= 0 || p.Value > 100 {
+			return errInvalidPromoCode
+		}
+	case promoAmount:
+		if p.Value <= 0 {
+			return errInvalidPromoCode
+		}
+	default:
+		return errInvalidPromoCode
+	}
+	if p.MaxUses < 0 || p.MaxUsesPerUser < 0 {
+		return errInvalidPromoCode
+	}
+	return nil
+}
+
+// Check returns why the code cannot be used for a sheet of rank at the
+// event at now, if it cannot. Usage caps are checked when reserving.
+func (p *PromoCode) Check(eventID int64, rank string, now time.Time) error {
+	if err := p.live(now); err != nil {
+		return err
+	}
+	if !p.Scope.covers(eventID, rank) {
+		return ErrPromoNotApplicable
+	}
+	return nil
+}
+
+// live returns ErrPromoExpired if the code is disabled or ran out by now.
+func (p *PromoCode) live(now time.Time) error {
+	if p.Disabled || (p.ExpiresAt != nil && !now.Before(*p.ExpiresAt)) {
+		return ErrPromoExpired
+	}
+	return nil
+}
+
+// allows reports whether n more redemptions fit in the caps when the code
+// has uses active redemptions, userUses of them the user's.
+func (p *PromoCode) allows(uses, userUses, n int) bool {
+	if p.MaxUses > 0 && uses+n > p.MaxUses {
+		return false
+	}
+	if p.MaxUsesPerUser > 0 && userUses+n > p.MaxUsesPerUser {
+		return false
+	}
+	return true
+}
+
+// apply takes the code's discount off b.
+func (p *PromoCode) apply(b PriceBreakdown) PriceBreakdown {
+	price := b.Total()
+	discount := p.Value
+	if p.Kind == promoPercent {
+		discount = price * p.Value / 100
+	}
+	if discount > price {
+		discount = price
+	}
+	b.Discount += discount
+	return b
+}
+
+// checkPromoTx enforces promo's caps inside a transaction that is about to
+// reserve n sheets with it, and that it is still live: the caller checked a
+// copy. Locking the code's row serializes its redemptions across app
+// instances until the transaction ends.
+func checkPromoTx(tx *sql.Tx, promo *PromoCode, userID int64, n int) error {
+	if promo == nil {
+		return nil
+	}
+	var current PromoCode
+	if err := tx.QueryRow("SELECT disabled_fg, expires_at FROM promo_codes WHERE id = ? FOR UPDATE", promo.ID).Scan(&current.Disabled, &current.ExpiresAt); err != nil {
+		return err
+	}
+	if err := current.live(time.Now()); err != nil {
+		return err
+	}
+	var uses, userUses int
+	if err := tx.QueryRow("SELECT COUNT(*), COALESCE(SUM(user_id = ?), 0) FROM reservations WHERE promo_id = ? AND canceled_at IS NULL", userID, promo.ID).Scan(&uses, &userUses); err != nil {
+		return err
+	}
+	if !promo.allows(uses, userUses, n) {
+		return ErrPromoExhausted
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+)
+
+// PromoStore keeps the promo codes by id and by code. Like the other stores
+// it hands out pointers that are never modified.
+type PromoStore struct {
+	mu     sync.RWMutex
+	byID   map[int64]*PromoCode
+	byCode map[string]*PromoCode
+	maxID  int64
+}
+
+func newPromoStore() *PromoStore {
+	return &PromoStore{
+		byID:   make(map[int64]*PromoCode),
+		byCode: make(map[string]*PromoCode),
+	}
+}
+
+// Replace takes over the contents of a freshly loaded store.
+func (s *PromoStore) Replace(other *PromoStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID = other.byID
+	s.byCode = other.byCode
+	s.maxID = other.maxID
+}
+
+// Put stores p, replacing any code with the same id. Used for loading and
+// replaying; new codes go through Create.
+func (s *PromoStore) Put(p *PromoCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(p)
+}
+
+func (s *PromoStore) put(p *PromoCode) {
+	s.byID[p.ID] = p
+	s.byCode[p.Code] = p
+	if p.ID > s.maxID {
+		s.maxID = p.ID
+	}
+}
+
+// Create fails with ErrDuplicated if the code is taken.
+func (s *PromoStore) Create(p PromoCode, persist func(p *PromoCode) error) (*PromoCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.byCode[p.Code]; ok {
+		return nil, ErrDuplicated
+	}
+	p.ID = s.maxID + 1
+	if err := persist(&p); err != nil {
+		return nil, err
+	}
+	s.put(&p)
+	return &p, nil
+}
+
+// Disable stops the code from being used. persist is skipped if it already
+// was.
+func (s *PromoStore) Disable(id int64, persist func(p *PromoCode) error) (*PromoCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.byID[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if p.Disabled {
+		return p, nil
+	}
+	disabled := *p
+	disabled.Disabled = true
+	if err := persist(&disabled); err != nil {
+		return nil, err
+	}
+	s.put(&disabled)
+	return &disabled, nil
+}
+
+func (s *PromoStore) Get(id int64) (*PromoCode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.byID[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return p, nil
+}
+
+// ByCode expects code normalized.
+func (s *PromoStore) ByCode(code string) (*PromoCode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.byCode[code]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return p, nil
+}
+
+// List returns every code in id order.
+func (s *PromoStore) List() []*PromoCode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ps := make([]*PromoCode, 0, len(s.byID))
+	for _, p := range s.byID {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+	return ps
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	repairNone   = ""
+	repairDB     = "db"
+	repairMemory = "memory"
+)
+
+type ReconcileReport struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Repair    string    `json:"repair,omitempty"`
+	Clean     bool      `json:"clean"`
+	// RepairSkipped says why drift was found but not repaired.
+	RepairSkipped string `json:"repair_skipped,omitempty"`
+	// RepairConflicts are reservations the repair could not write because
+	// MySQL holds another active one for the same sheet.
+	RepairConflicts []int64 `json:"repair_conflicts,omitempty"`
+
+	MemoryReservations int     `json:"memory_reservations"`
+	DBReservations     int     `json:"db_reservations"`
+	MissingInDB        []int64 `json:"missing_in_db"`
+	MissingInMemory    []int64 `json:"missing_in_memory"`
+	Mismatched         []int64 `json:"mismatched"`
+	CanceledAtMismatch []int64 `json:"canceled_at_mismatch"`
+	// The ID gaps are drift only when memory hands out the IDs. When MySQL
+	// does, a rolled back insert leaves a gap on both sides.
+	MemoryIDGaps []int64 `json:"memory_id_gaps"`
+	DBIDGaps     []int64 `json:"db_id_gaps"`
+
+	MemoryEvents          int     `json:"memory_events"`
+	DBEvents              int     `json:"db_events"`
+	EventsMissingInDB     []int64 `json:"events_missing_in_db"`
+	EventsMissingInMemory []int64 `json:"events_missing_in_memory"`
+	EventsMismatched      []int64 `json:"events_mismatched"`
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Truncate(time.Microsecond).Equal(b.Truncate(time.Microsecond))
+}
+
+func (s *mysqlStore) loadReservationsFromDB() (map[int64]*Reservation, error) {
+	rows, err := s.db.Query("SELECT id, event_id, sheet_id, user_id, reserved_at, canceled_at, expires_at, price, base_price, rank_price, adjustment, discount, promo_id, cancel_fee FROM reservations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := make(map[int64]*Reservation)
+	for rows.Next() {
+		var r Reservation
+		var b PriceBreakdown
+		if err := rows.Scan(&r.ID, &r.EventID, &r.SheetID, &r.UserID, &r.ReservedAt, &r.CanceledAt, &r.ExpiresAt, &r.Price, &b.Base, &b.Rank, &b.Adjustment, &b.Discount, &r.PromoCodeID, &r.CancelFee); err != nil {
+			return nil, err
+		}
+		r.Breakdown = &b
+		reservations[r.ID] = &r
+	}
+	return reservations, rows.Err()
+}
+
+func (s *mysqlStore) loadEventsFromDB() (map[int64]*Event, error) {
+	rows, err := s.db.Query("SELECT id, title, public_fg, closed_fg, price, venue_id, allocation, limits, schedule, pricing, cancellation FROM events")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make(map[int64]*Event)
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.Title, &e.PublicFg, &e.ClosedFg, &e.Price, &e.VenueID, &e.Allocation, &e.Limits, &e.Schedule, &e.Pricing, &e.Cancellation); err != nil {
+			return nil, err
+		}
+		events[e.ID] = &e
+	}
+	return events, rows.Err()
+}
+
+func idGaps(ids map[int64]bool, max int64) []int64 {
+	gaps := make([]int64, 0)
+	for id := int64(1); id <= max; id++ {
+		if !ids[id] {
+			gaps = append(gaps, id)
+		}
+	}
+	return gaps
+}
+
+// Reconcile diffs the in-memory stores against MySQL and, if asked, repairs
+// one side from the other: repairDB makes the tables mirror memory,
+// repairMemory reloads memory from the tables.
+//
+// Memory is copied under a short lock and compared with MySQL outside it, so
+// requests go on meanwhile. A change made after the copy can look like drift,
+// so drift is looked for twice and only what turns up both times counts. The
+// repair runs under the store locks, and only when the writer is idle.
+func (s *mysqlStore) Reconcile(repair string) (*ReconcileReport, error) {
+	if repair != repairNone && repair != repairDB && repair != repairMemory {
+		return nil, errors.New("unknown repair direction: " + repair)
+	}
+
+	report, err := s.diffSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if !report.Clean {
+		again, err := s.diffSnapshot()
+		if err != nil {
+			return nil, err
+		}
+		report = again.confirm(report, s.dbAllocation)
+	}
+	report.Repair = repair
+	if report.Clean || repair == repairNone {
+		return report, nil
+	}
+	return s.repair(report, repair)
+}
+
+// diffSnapshot copies memory, waits for the writer to get everything in the
+// copy to MySQL and compares the two.
+func (s *mysqlStore) diffSnapshot() (*ReconcileReport, error) {
+	s.reservations.mu.RLock()
+	s.events.mu.RLock()
+	reservations := append([]*Reservation(nil), s.reservations.all...)
+	events := append([]*Event(nil), s.events.events...)
+	s.events.mu.RUnlock()
+	s.reservations.mu.RUnlock()
+
+	// Mutations reach the writer queue while their store lock is held, so
+	// everything in the copy has been queued by now.
+	s.writer.Flush()
+
+	dbReservations, err := s.loadReservationsFromDB()
+	if err != nil {
+		return nil, err
+	}
+	dbEvents, err := s.loadEventsFromDB()
+	if err != nil {
+		return nil, err
+	}
+	return diffStores(reservations, events, dbReservations, dbEvents, s.dbAllocation), nil
+}
+
+// diffStores compares memory with MySQL. events is indexed by ID - 1 and may
+// have holes.
+func diffStores(reservations []*Reservation, events []*Event, dbReservations map[int64]*Reservation, dbEvents map[int64]*Event, dbAllocation bool) *ReconcileReport {
+	report := &ReconcileReport{
+		CheckedAt:             time.Now().UTC(),
+		MemoryReservations:    len(reservations),
+		DBReservations:        len(dbReservations),
+		MissingInDB:           make([]int64, 0),
+		MissingInMemory:       make([]int64, 0),
+		Mismatched:            make([]int64, 0),
+		CanceledAtMismatch:    make([]int64, 0),
+		DBEvents:              len(dbEvents),
+		EventsMissingInDB:     make([]int64, 0),
+		EventsMissingInMemory: make([]int64, 0),
+		EventsMismatched:      make([]int64, 0),
+	}
+
+	memIDs := make(map[int64]bool, len(reservations))
+	var memMax int64
+	for _, r := range reservations {
+		memIDs[r.ID] = true
+		if r.ID > memMax {
+			memMax = r.ID
+		}
+		d, ok := dbReservations[r.ID]
+		if !ok {
+			report.MissingInDB = append(report.MissingInDB, r.ID)
+			continue
+		}
+		if d.EventID != r.EventID || d.SheetID != r.SheetID || d.UserID != r.UserID || !sameTime(d.ReservedAt, r.ReservedAt) || !sameTime(d.ExpiresAt, r.ExpiresAt) || d.Price != r.Price || d.charged() != r.charged() || d.PromoCodeID != r.PromoCodeID {
+			report.Mismatched = append(report.Mismatched, r.ID)
+		} else if !sameTime(d.CanceledAt, r.CanceledAt) || d.CancelFee != r.CancelFee {
+			report.CanceledAtMismatch = append(report.CanceledAtMismatch, r.ID)
+		}
+	}
+	dbIDs := make(map[int64]bool, len(dbReservations))
+	var dbMax int64
+	for id := range dbReservations {
+		dbIDs[id] = true
+		if id > dbMax {
+			dbMax = id
+		}
+		if !memIDs[id] {
+			report.MissingInMemory = append(report.MissingInMemory, id)
+		}
+	}
+	sort.Slice(report.MissingInMemory, func(i, j int) bool { return report.MissingInMemory[i] < report.MissingInMemory[j] })
+	report.MemoryIDGaps = idGaps(memIDs, memMax)
+	report.DBIDGaps = idGaps(dbIDs, dbMax)
+
+	memEvents := make(map[int64]bool, len(events))
+	for _, e := range events {
+		if e == nil {
+			continue
+		}
+		memEvents[e.ID] = true
+		report.MemoryEvents++
+		d, ok := dbEvents[e.ID]
+		if !ok {
+			report.EventsMissingInDB = append(report.EventsMissingInDB, e.ID)
+			continue
+		}
+		if d.Title != e.Title || d.PublicFg != e.PublicFg || d.ClosedFg != e.ClosedFg || d.Price != e.Price || d.VenueID != e.VenueID || d.Allocation.String() != e.Allocation.String() || d.Limits.String() != e.Limits.String() || d.Schedule.String() != e.Schedule.String() || d.Pricing.String() != e.Pricing.String() || d.Cancellation.String() != e.Cancellation.String() {
+			report.EventsMismatched = append(report.EventsMismatched, e.ID)
+		}
+	}
+	for id := range dbEvents {
+		if !memEvents[id] {
+			report.EventsMissingInMemory = append(report.EventsMissingInMemory, id)
+		}
+	}
+	sort.Slice(report.EventsMissingInMemory, func(i, j int) bool { return report.EventsMissingInMemory[i] < report.EventsMissingInMemory[j] })
+
+	report.setClean(dbAllocation)
+	return report
+}
+
+func (r *ReconcileReport) setClean(dbAllocation bool) {
+	r.Clean = len(r.MissingInDB) == 0 && len(r.MissingInMemory) == 0 &&
+		len(r.Mismatched) == 0 && len(r.CanceledAtMismatch) == 0 &&
+		(dbAllocation || len(r.MemoryIDGaps) == 0 && len(r.DBIDGaps) == 0) &&
+		len(r.EventsMissingInDB) == 0 && len(r.EventsMissingInMemory) == 0 &&
+		len(r.EventsMismatched) == 0
+}
+
+// confirm keeps only the drift that earlier found as well.
+func (r *ReconcileReport) confirm(earlier *ReconcileReport, dbAllocation bool) *ReconcileReport {
+	both := func(ids, before []int64) []int64 {
+		seen := make(map[int64]bool, len(before))
+		for _, id := range before {
+			seen[id] = true
+		}
+		kept := make([]int64, 0)
+		for _, id := range ids {
+			if seen[id] {
+				kept = append(kept, id)
+			}
+		}
+		return kept
+	}
+	r.MissingInDB = both(r.MissingInDB, earlier.MissingInDB)
+	r.MissingInMemory = both(r.MissingInMemory, earlier.MissingInMemory)
+	r.Mismatched = both(r.Mismatched, earlier.Mismatched)
+	r.CanceledAtMismatch = both(r.CanceledAtMismatch, earlier.CanceledAtMismatch)
+	r.MemoryIDGaps = both(r.MemoryIDGaps, earlier.MemoryIDGaps)
+	r.DBIDGaps = both(r.DBIDGaps, earlier.DBIDGaps)
+	r.EventsMissingInDB = both(r.EventsMissingInDB, earlier.EventsMissingInDB)
+	r.EventsMissingInMemory = both(r.EventsMissingInMemory, earlier.EventsMissingInMemory)
+	r.EventsMismatched = both(r.EventsMismatched, earlier.EventsMismatched)
+	r.setClean(dbAllocation)
+	return r
+}
+
+// repair diffs once more under the store locks, so no request can slip in
+// between the diff and the repair, and repairs what it finds. It gives up
+// if the writer has anything in flight, as MySQL is behind memory then.
+func (s *mysqlStore) repair(report *ReconcileReport, repair string) (*ReconcileReport, error) {
+	s.reservations.mu.Lock()
+	defer s.reservations.mu.Unlock()
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+
+	if stats := s.writer.Stats(); stats.Queued > 0 || stats.Inflight > 0 {
+		report.RepairSkipped = "writes in flight"
+		return report, nil
+	}
+
+	dbReservations, err := s.loadReservationsFromDB()
+	if err != nil {
+		return nil, err
+	}
+	dbEvents, err := s.loadEventsFromDB()
+	if err != nil {
+		return nil, err
+	}
+	report = diffStores(s.reservations.all, s.events.events, dbReservations, dbEvents, s.dbAllocation)
+	report.Repair = repair
+	if report.Clean {
+		return report, nil
+	}
+
+	switch repair {
+	case repairDB:
+		err = s.repairDBFromMemory(report)
+	case repairMemory:
+		var store *ReservationStore
+		var events []*Event
+		if store, err = loadReservations(s.db); err != nil {
+			break
+		}
+		if events, err = loadEvents(s.db); err != nil {
+			break
+		}
+		s.reservations.replace(store)
+		s.events.replace(events)
+	}
+	return report, err
+}
+
+// repairDBFromMemory writes memory over the tables. A reservation is
+// inserted or updated by ID; one that would collide with another active
+// reservation of its sheet is left alone and reported.
+func (s *mysqlStore) repairDBFromMemory(report *ReconcileReport) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range s.events.events {
+		if e == nil {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO events (id, title, public_fg, closed_fg, price, venue_id, allocation, limits, schedule, pricing, cancellation) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE title = VALUES(title), public_fg = VALUES(public_fg), closed_fg = VALUES(closed_fg), price = VALUES(price), venue_id = VALUES(venue_id), allocation = VALUES(allocation), limits = VALUES(limits), schedule = VALUES(schedule), pricing = VALUES(pricing), cancellation = VALUES(cancellation)",
+			e.ID, e.Title, e.PublicFg, e.ClosedFg, e.Price, e.VenueID, e.Allocation, e.Limits, e.Schedule, e.Pricing, e.Cancellation); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, id := range report.EventsMissingInMemory {
+		if _, err := tx.Exec("DELETE FROM events WHERE id = ?", id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// Rows missing from memory go first, so their sheets are free for the
+	// rows memory has.
+	for _, id := range report.MissingInMemory {
+		if _, err := tx.Exec("DELETE FROM reservations WHERE id = ?", id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	missing := make(map[int64]bool, len(report.MissingInDB))
+	for _, id := range report.MissingInDB {
+		missing[id] = true
+	}
+	var broken []int64
+	broken = append(broken, report.MissingInDB...)
+	broken = append(broken, report.Mismatched...)
+	broken = append(broken, report.CanceledAtMismatch...)
+	byID := make(map[int64]*Reservation, len(broken))
+	for _, r := range s.reservations.all {
+		byID[r.ID] = r
+	}
+	for _, id := range broken {
+		r := byID[id]
+		var canceledAt interface{}
+		if r.CanceledAt != nil {
+			canceledAt = r.CanceledAt.Format("2006-01-02 15:04:05.000000")
+		}
+		b := r.charged()
+		reservedAt := r.ReservedAt.Format("2006-01-02 15:04:05.000000")
+		var err error
+		if missing[id] {
+			_, err = tx.Exec("INSERT INTO reservations (id, event_id, sheet_id, user_id, reserved_at, canceled_at, expires_at, price, base_price, rank_price, adjustment, discount, promo_id, cancel_fee) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+				r.ID, r.EventID, r.SheetID, r.UserID, reservedAt, canceledAt, dbTime(r.ExpiresAt), r.Price, b.Base, b.Rank, b.Adjustment, b.Discount, r.PromoCodeID, r.CancelFee)
+		} else {
+			_, err = tx.Exec("UPDATE reservations SET event_id = ?, sheet_id = ?, user_id = ?, reserved_at = ?, canceled_at = ?, expires_at = ?, price = ?, base_price = ?, rank_price = ?, adjustment = ?, discount = ?, promo_id = ?, cancel_fee = ? WHERE id = ?",
+				r.EventID, r.SheetID, r.UserID, reservedAt, canceledAt, dbTime(r.ExpiresAt), r.Price, b.Base, b.Rank, b.Adjustment, b.Discount, r.PromoCodeID, r.CancelFee, r.ID)
+		}
+		if isDuplicateEntry(err) {
+			log.Printf("reconcile: reservation %d collides with another active one on event %d sheet %d", r.ID, r.EventID, r.SheetID)
+			report.RepairConflicts = append(report.RepairConflicts, r.ID)
+			continue
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *mysqlStore) LastReconcile() *ReconcileReport {
+	s.lastReconcileMutex.Lock()
+	defer s.lastReconcileMutex.Unlock()
+	return s.lastReconcile
+}
+
+func (s *mysqlStore) reconcileLoop(interval time.Duration, repair string) {
+	for {
+		report, err := s.Reconcile(repair)
+		if err != nil {
+			log.Println("reconcile:", err)
+		} else {
+			s.lastReconcileMutex.Lock()
+			s.lastReconcile = report
+			s.lastReconcileMutex.Unlock()
+			if !report.Clean {
+				log.Printf("reconcile: drift found (missing in db: %d, missing in memory: %d, mismatched: %d, canceled_at: %d, events: %d/%d/%d), repair=%q",
+					len(report.MissingInDB), len(report.MissingInMemory), len(report.Mismatched), len(report.CanceledAtMismatch),
+					len(report.EventsMissingInDB), len(report.EventsMissingInMemory), len(report.EventsMismatched), report.Repair)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
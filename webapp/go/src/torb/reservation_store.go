@@ -0,0 +1,708 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSoldOut      = errors.New("sold out")
+	ErrNotReserved  = errors.New("not reserved")
+	ErrNotPermitted = errors.New("not permitted")
+	ErrHoldExpired  = errors.New("hold expired")
+)
+
+// ReservationStore keeps every reservation in memory together with the
+// indexes the handlers need, so that nothing has to scan the whole history:
+// per-event active reservations keyed by sheet, per-event and per-rank
+// reserved counters, per-user lists and the holds still waiting for
+// confirmation.
+//
+// A *Reservation is never modified once it is in the store; cancelling
+// swaps in a new copy under the write lock. Readers take the read lock only
+// to copy out the slices and maps they need and may keep the pointers
+// afterwards. Callers that decorate a reservation for a response must work
+// on their own copy.
+type ReservationStore struct {
+	mu     sync.RWMutex
+	all    []*Reservation
+	byID   map[int64]*reservationSlot
+	byUser map[int64][]*Reservation
+	events map[int64]*eventReservations
+	holds  map[int64]*Reservation
+	// byPromo lists the reservations made with each promo code.
+	byPromo map[int64][]*Reservation
+	maxID   int64
+
+	// price, if set, prices a new reservation of a sheet when reserved
+	// sheets of its rank are taken already.
+	price func(eventID, sheetID int64, reserved int) PriceBreakdown
+}
+
+type reservationSlot struct {
+	all, user, event, promo int
+}
+
+type eventReservations struct {
+	all      []*Reservation
+	active   map[int64]*Reservation
+	reserved map[string]int
+}
+
+func newReservationStore() *ReservationStore {
+	return &ReservationStore{
+		all:     make([]*Reservation, 0),
+		byID:    make(map[int64]*reservationSlot),
+		byUser:  make(map[int64][]*Reservation),
+		events:  make(map[int64]*eventReservations),
+		holds:   make(map[int64]*Reservation),
+		byPromo: make(map[int64][]*Reservation),
+	}
+}
+
+func (s *ReservationStore) event(eventID int64) *eventReservations {
+	er, ok := s.events[eventID]
+	if !ok {
+		er = &eventReservations{
+			active:   make(map[int64]*Reservation),
+			reserved: make(map[string]int),
+		}
+		s.events[eventID] = er
+	}
+	return er
+}
+
+func (s *ReservationStore) add(r *Reservation) {
+	er := s.event(r.EventID)
+	s.byID[r.ID] = &reservationSlot{
+		all:   len(s.all),
+		user:  len(s.byUser[r.UserID]),
+		event: len(er.all),
+	}
+	s.all = append(s.all, r)
+	s.byUser[r.UserID] = append(s.byUser[r.UserID], r)
+	if r.PromoCodeID != 0 {
+		s.byID[r.ID].promo = len(s.byPromo[r.PromoCodeID])
+		s.byPromo[r.PromoCodeID] = append(s.byPromo[r.PromoCodeID], r)
+	}
+	if r.ID > s.maxID {
+		s.maxID = r.ID
+	}
+
+	er.all = append(er.all, r)
+	if r.CanceledAt == nil {
+		er.active[r.SheetID] = r
+		er.reserved[sheetRank(r.SheetID)]++
+		if r.ExpiresAt != nil {
+			s.holds[r.ID] = r
+		}
+	}
+}
+
+func (s *ReservationStore) priceOf(eventID, sheetID int64, reserved int) PriceBreakdown {
+	if s.price == nil {
+		return PriceBreakdown{}
+	}
+	return s.price(eventID, sheetID, reserved)
+}
+
+// charge records that r was charged b.
+func (r *Reservation) charge(b PriceBreakdown) {
+	r.Price = b.Total()
+	r.Breakdown = &b
+}
+
+// charged is r's price breakdown, zero if it has none.
+func (r *Reservation) charged() PriceBreakdown {
+	if r.Breakdown == nil {
+		return PriceBreakdown{}
+	}
+	return *r.Breakdown
+}
+
+// sheetRank returns "" for a sheet missing from the catalog, so a stray
+// reservation cannot take the store down.
+func sheetRank(sheetID int64) string {
+	if sheet := getSheetFromId(sheetID); sheet != nil {
+		return sheet.Rank
+	}
+	return ""
+}
+
+// swap replaces old with its updated copy nr in every index.
+func (s *ReservationStore) swap(old, nr *Reservation) {
+	slot := s.byID[old.ID]
+	er := s.event(old.EventID)
+	s.all[slot.all] = nr
+	if nr.UserID == old.UserID {
+		s.byUser[old.UserID][slot.user] = nr
+	} else {
+		s.reassign(slot, old.UserID, nr)
+	}
+	er.all[slot.event] = nr
+	if old.PromoCodeID != 0 {
+		s.byPromo[old.PromoCodeID][slot.promo] = nr
+	}
+
+	if er.active[old.SheetID] == old {
+		delete(er.active, old.SheetID)
+		er.reserved[sheetRank(old.SheetID)]--
+	}
+	delete(s.holds, old.ID)
+	if nr.CanceledAt == nil {
+		er.active[nr.SheetID] = nr
+		er.reserved[sheetRank(nr.SheetID)]++
+		if nr.ExpiresAt != nil {
+			s.holds[nr.ID] = nr
+		}
+	}
+}
+
+// reassign moves nr, which changed hands, from the list of the user who
+// held it to its new holder's.
+func (s *ReservationStore) reassign(slot *reservationSlot, fromUserID int64, nr *Reservation) {
+	rs := s.byUser[fromUserID]
+	rs = append(rs[:slot.user], rs[slot.user+1:]...)
+	for _, r := range rs[slot.user:] {
+		s.byID[r.ID].user--
+	}
+	s.byUser[fromUserID] = rs
+	slot.user = len(s.byUser[nr.UserID])
+	s.byUser[nr.UserID] = append(s.byUser[nr.UserID], nr)
+}
+
+// Replace takes over the contents of a freshly loaded store.
+func (s *ReservationStore) Replace(other *ReservationStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replace(other)
+}
+
+func (s *ReservationStore) replace(other *ReservationStore) {
+	s.all = other.all
+	s.byID = other.byID
+	s.byUser = other.byUser
+	s.events = other.events
+	s.holds = other.holds
+	s.byPromo = other.byPromo
+	s.maxID = other.maxID
+}
+
+// Add is for loading existing reservations; new ones go through Reserve.
+// A reservation already in the store is left alone.
+func (s *ReservationStore) Add(r *Reservation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[r.ID]; ok {
+		return
+	}
+	s.add(r)
+}
+
+// Put stores r as the database has it, replacing the copy in memory if
+// there is one. Used when another process may have changed it.
+func (s *ReservationStore) Put(r *Reservation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slot, ok := s.byID[r.ID]; ok {
+		s.swap(s.all[slot.all], r)
+		return
+	}
+	s.add(r)
+}
+
+// MarkCanceled records a cancellation that already happened. Used when
+// replaying.
+func (s *ReservationStore) MarkCanceled(id int64, canceledAt time.Time, fee int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slot, ok := s.byID[id]
+	if !ok {
+		return
+	}
+	old := s.all[slot.all]
+	nr := *old
+	nr.CanceledAt = &canceledAt
+	nr.CancelFee = fee
+	s.swap(old, &nr)
+}
+
+// Transfer hands the active reservation id from one user to another, within
+// the new holder's limits. Holds cannot change hands until they are
+// confirmed.
+func (s *ReservationStore) Transfer(id, fromUserID, toUserID int64, limits userLimits, persist func(r *Reservation) error) (*Reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slot, ok := s.byID[id]
+	if !ok {
+		return nil, ErrNotReserved
+	}
+	old := s.all[slot.all]
+	if old.CanceledAt != nil || old.ExpiresAt != nil {
+		return nil, ErrNotReserved
+	}
+	if old.UserID != fromUserID {
+		return nil, ErrNotPermitted
+	}
+	rank := sheetRank(old.SheetID)
+	if !limits.allows(s.holdings(toUserID, old.EventID, rank), rank, 1) {
+		return nil, ErrLimitExceeded
+	}
+
+	nr := *old
+	nr.UserID = toUserID
+	if err := persist(&nr); err != nil {
+		return nil, err
+	}
+	s.swap(old, &nr)
+	return &nr, nil
+}
+
+// MarkTransferred records a transfer that already happened. Used when
+// replaying.
+func (s *ReservationStore) MarkTransferred(id, userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slot, ok := s.byID[id]
+	if !ok {
+		return
+	}
+	old := s.all[slot.all]
+	if old.UserID == userID {
+		return
+	}
+	nr := *old
+	nr.UserID = userID
+	s.swap(old, &nr)
+}
+
+// holdings counts the user's active reservations, holds included.
+func (s *ReservationStore) holdings(userID, eventID int64, rank string) userHoldings {
+	var h userHoldings
+	for _, r := range s.byUser[userID] {
+		if r.CanceledAt != nil {
+			continue
+		}
+		h.Total++
+		if r.EventID == eventID {
+			h.Event++
+			if sheetRank(r.SheetID) == rank {
+				h.Rank++
+			}
+		}
+	}
+	return h
+}
+
+// WithHoldings runs fn with the user's holdings under the read lock, so
+// none of their reservations come or go until it returns. fn may take the
+// waitlist lock, which always comes after this one.
+func (s *ReservationStore) WithHoldings(userID, eventID int64, rank string, fn func(h userHoldings) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(s.holdings(userID, eventID, rank))
+}
+
+// promoUses counts the active reservations made with the promo code, in
+// total and the user's.
+func (s *ReservationStore) promoUses(promoID, userID int64) (uses, userUses int) {
+	for _, r := range s.byPromo[promoID] {
+		if r.CanceledAt != nil {
+			continue
+		}
+		uses++
+		if r.UserID == userID {
+			userUses++
+		}
+	}
+	return uses, userUses
+}
+
+// ByPromo returns the reservations made with the promo code, canceled ones
+// included, oldest first.
+func (s *ReservationStore) ByPromo(promoID int64) []*Reservation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Reservation(nil), s.byPromo[promoID]...)
+}
+
+// Reserve books the first free sheet among candidates for the user, within
+// limits. A non-nil promo discounts it within the code's caps. persist runs
+// under the write lock before the reservation becomes visible, so the journal
+// sees mutations in the same order as memory; if it fails nothing is stored.
+func (s *ReservationStore) Reserve(eventID, userID int64, candidates []int64, limits userLimits, promo *PromoCode, persist func(r *Reservation) error) (*Reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	er := s.event(eventID)
+	sheetID := int64(-1)
+	for _, id := range candidates {
+		if _, used := er.active[id]; !used {
+			sheetID = id
+			break
+		}
+	}
+	if sheetID == -1 {
+		return nil, ErrSoldOut
+	}
+	rank := sheetRank(sheetID)
+	if !limits.allows(s.holdings(userID, eventID, rank), rank, 1) {
+		return nil, ErrLimitExceeded
+	}
+	if promo != nil {
+		if uses, userUses := s.promoUses(promo.ID, userID); !promo.allows(uses, userUses, 1) {
+			return nil, ErrPromoExhausted
+		}
+	}
+
+	reservedAt := time.Now().UTC()
+	r := &Reservation{
+		ID:         s.maxID + 1,
+		EventID:    eventID,
+		SheetID:    sheetID,
+		UserID:     userID,
+		ReservedAt: &reservedAt,
+	}
+	b := s.priceOf(eventID, sheetID, er.reserved[rank])
+	if promo != nil {
+		b = promo.apply(b)
+		r.PromoCodeID = promo.ID
+	}
+	r.charge(b)
+	if err := persist(r); err != nil {
+		return nil, err
+	}
+	s.add(r)
+	return r, nil
+}
+
+// ReserveSeats books several sheets of one rank for the user at once,
+// within limits. pick chooses them given which sheets are taken and returns
+// nil if it cannot. A positive hold makes them holds that lapse unless
+// confirmed in time. A non-nil promo discounts every sheet within its caps.
+// persist gets every new reservation in one call; if it fails nothing is
+// stored.
+func (s *ReservationStore) ReserveSeats(eventID, userID int64, hold time.Duration, limits userLimits, promo *PromoCode, pick func(taken func(sheetID int64) bool) []int64, persist func(rs []*Reservation) error) ([]*Reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	er := s.event(eventID)
+	sheetIDs := pick(func(sheetID int64) bool {
+		_, used := er.active[sheetID]
+		return used
+	})
+	if len(sheetIDs) == 0 {
+		return nil, ErrSoldOut
+	}
+	rank := sheetRank(sheetIDs[0])
+	if !limits.allows(s.holdings(userID, eventID, rank), rank, len(sheetIDs)) {
+		return nil, ErrLimitExceeded
+	}
+	if promo != nil {
+		if uses, userUses := s.promoUses(promo.ID, userID); !promo.allows(uses, userUses, len(sheetIDs)) {
+			return nil, ErrPromoExhausted
+		}
+	}
+
+	reservedAt := time.Now().UTC()
+	var expiresAt *time.Time
+	if hold > 0 {
+		t := reservedAt.Add(hold)
+		expiresAt = &t
+	}
+	rs := make([]*Reservation, len(sheetIDs))
+	for i, sheetID := range sheetIDs {
+		rs[i] = &Reservation{
+			ID:         s.maxID + int64(i) + 1,
+			EventID:    eventID,
+			SheetID:    sheetID,
+			UserID:     userID,
+			ReservedAt: &reservedAt,
+			ExpiresAt:  expiresAt,
+		}
+		b := s.priceOf(eventID, sheetID, er.reserved[rank]+i)
+		if promo != nil {
+			b = promo.apply(b)
+			rs[i].PromoCodeID = promo.ID
+		}
+		rs[i].charge(b)
+	}
+	if err := persist(rs); err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		s.add(r)
+	}
+	return rs, nil
+}
+
+// Confirm turns the user's holds into reservations, all or none. Ones that
+// are already confirmed are returned as they are. persist gets only the
+// reservations that change.
+func (s *ReservationStore) Confirm(eventID, userID int64, ids []int64, now time.Time, persist func(rs []*Reservation) error) ([]*Reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rs := make([]*Reservation, len(ids))
+	var olds, changed []*Reservation
+	for i, id := range ids {
+		slot, ok := s.byID[id]
+		if !ok || s.all[slot.all].EventID != eventID {
+			return nil, ErrNotReserved
+		}
+		r := s.all[slot.all]
+		if r.UserID != userID {
+			return nil, ErrNotPermitted
+		}
+		if r.CanceledAt != nil {
+			if r.ExpiresAt != nil {
+				return nil, ErrHoldExpired
+			}
+			return nil, ErrNotReserved
+		}
+		rs[i] = r
+		if r.ExpiresAt == nil {
+			continue
+		}
+		if !now.Before(*r.ExpiresAt) {
+			return nil, ErrHoldExpired
+		}
+		nr := *r
+		nr.ExpiresAt = nil
+		rs[i] = &nr
+		olds = append(olds, r)
+		changed = append(changed, &nr)
+	}
+
+	if len(changed) > 0 {
+		if err := persist(changed); err != nil {
+			return nil, err
+		}
+	}
+	for i, old := range olds {
+		s.swap(old, changed[i])
+	}
+	return rs, nil
+}
+
+// MarkConfirmed records a confirmation that already happened. Used when
+// replaying.
+func (s *ReservationStore) MarkConfirmed(ids []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		slot, ok := s.byID[id]
+		if !ok {
+			continue
+		}
+		old := s.all[slot.all]
+		if old.ExpiresAt == nil {
+			continue
+		}
+		nr := *old
+		nr.ExpiresAt = nil
+		s.swap(old, &nr)
+	}
+}
+
+// ExpiredHolds returns the IDs of unconfirmed holds that ran out by now.
+func (s *ReservationStore) ExpiredHolds(now time.Time) []int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []int64
+	for id, r := range s.holds {
+		if !now.Before(*r.ExpiresAt) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// seatOffer is asked, under the write lock, who gets a sheet that was just
+// freed. It returns a zero userID to put the sheet back on sale.
+type seatOffer func(freed *Reservation) (userID int64, hold time.Duration)
+
+// free swaps in nr, the canceled copy of old, and hands the sheet to
+// whoever offer names as a hold on it. persist gets both before either is
+// visible, so nobody else can take the sheet in between. It returns the
+// hold, or nil.
+func (s *ReservationStore) free(old, nr *Reservation, now time.Time, offer seatOffer, persist func(r, next *Reservation) error) (*Reservation, error) {
+	var next *Reservation
+	if offer != nil {
+		if userID, hold := offer(nr); userID != 0 {
+			reservedAt := now
+			expiresAt := now.Add(hold)
+			// The freed sheet still counts as reserved, so the hold is
+			// priced as if it were back on sale.
+			reserved := s.event(nr.EventID).reserved[sheetRank(nr.SheetID)] - 1
+			next = &Reservation{
+				ID:         s.maxID + 1,
+				EventID:    nr.EventID,
+				SheetID:    nr.SheetID,
+				UserID:     userID,
+				ReservedAt: &reservedAt,
+				ExpiresAt:  &expiresAt,
+			}
+			next.charge(s.priceOf(nr.EventID, nr.SheetID, reserved))
+		}
+	}
+	if err := persist(nr, next); err != nil {
+		return nil, err
+	}
+	s.swap(old, nr)
+	if next != nil {
+		s.add(next)
+	}
+	return next, nil
+}
+
+// Release cancels a hold that ran out by now, as of its expiry time, and
+// passes the sheet on as Cancel does. It returns nil if the hold was
+// confirmed or canceled in the meantime.
+func (s *ReservationStore) Release(id int64, now time.Time, offer seatOffer, persist func(r, next *Reservation) error) (released, next *Reservation, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.holds[id]
+	if !ok || now.Before(*old.ExpiresAt) {
+		return nil, nil, nil
+	}
+	nr := *old
+	nr.CanceledAt = old.ExpiresAt
+	if next, err = s.free(old, &nr, now, offer, persist); err != nil {
+		return nil, nil, err
+	}
+	return &nr, next, nil
+}
+
+// Cancel cancels the user's active reservation of a sheet, keeping what
+// terms say of its price. If offer names someone the sheet becomes their
+// hold straight away.
+func (s *ReservationStore) Cancel(eventID, sheetID, userID int64, terms cancelTerms, offer seatOffer, persist func(r, next *Reservation) error) (canceled, next *Reservation, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.event(eventID).active[sheetID]
+	if old == nil {
+		return nil, nil, ErrNotReserved
+	}
+	if old.UserID != userID {
+		return nil, nil, ErrNotPermitted
+	}
+
+	fee, err := terms.feeFor(old)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	canceledAt := time.Now().UTC()
+	nr := *old
+	nr.CanceledAt = &canceledAt
+	nr.CancelFee = fee
+	if next, err = s.free(old, &nr, canceledAt, offer, persist); err != nil {
+		return nil, nil, err
+	}
+	return &nr, next, nil
+}
+
+func (s *ReservationStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.all)
+}
+
+// ActiveByEvent returns the live reservations of an event keyed by sheet ID.
+func (s *ReservationStore) ActiveByEvent(eventID int64) map[int64]*Reservation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	er, ok := s.events[eventID]
+	if !ok {
+		return nil
+	}
+	active := make(map[int64]*Reservation, len(er.active))
+	for k, v := range er.active {
+		active[k] = v
+	}
+	return active
+}
+
+// ActiveOn returns the live reservation of a sheet for an event, or nil.
+func (s *ReservationStore) ActiveOn(eventID, sheetID int64) *Reservation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if er, ok := s.events[eventID]; ok {
+		return er.active[sheetID]
+	}
+	return nil
+}
+
+// SheetReserved reports whether any event has an active reservation of the
+// sheet.
+func (s *ReservationStore) SheetReserved(sheetID int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, er := range s.events {
+		if _, ok := er.active[sheetID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Reserved returns how many sheets of each rank are taken for an event.
+func (s *ReservationStore) Reserved(eventID int64) map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reserved := make(map[string]int)
+	if er, ok := s.events[eventID]; ok {
+		for k, v := range er.reserved {
+			reserved[k] = v
+		}
+	}
+	return reserved
+}
+
+// ByEvent returns every reservation of an event, canceled ones included, in
+// the order they were made.
+func (s *ReservationStore) ByEvent(eventID int64) []*Reservation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	er, ok := s.events[eventID]
+	if !ok {
+		return nil
+	}
+	return append([]*Reservation(nil), er.all...)
+}
+
+func (s *ReservationStore) Get(id int64) (*Reservation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	slot, ok := s.byID[id]
+	if !ok {
+		return nil, false
+	}
+	return s.all[slot.all], true
+}
+
+func (s *ReservationStore) ByUser(userID int64) []*Reservation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Reservation(nil), s.byUser[userID]...)
+}
+
+func (s *ReservationStore) All() []*Reservation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Reservation(nil), s.all...)
+}
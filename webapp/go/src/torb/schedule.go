@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	ErrSalesNotStarted = errors.New("sales not started")
+	ErrSalesEnded      = errors.New("sales ended")
+	errInvalidSchedule = errors.New("invalid schedule")
+)
+
+// EventSchedule says when an event takes place and when its tickets are
+// sold, all in Unix seconds. A zero time leaves that end open: without
+// SalesStartAt tickets sell as soon as the event is public. It is stored as
+// JSON in events.schedule.
+type EventSchedule struct {
+	StartsAt     int64 `json:"starts_at,omitempty"`
+	EndsAt       int64 `json:"ends_at,omitempty"`
+	SalesStartAt int64 `json:"sales_start_at,omitempty"`
+	SalesEndAt   int64 `json:"sales_end_at,omitempty"`
+}
+
+func (s *EventSchedule) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.StartsAt < 0 || s.EndsAt < 0 || s.SalesStartAt < 0 || s.SalesEndAt < 0 {
+		return errInvalidSchedule
+	}
+	if s.StartsAt != 0 && s.EndsAt != 0 && s.EndsAt < s.StartsAt {
+		return errInvalidSchedule
+	}
+	if s.SalesStartAt != 0 && s.SalesEndAt != 0 && s.SalesEndAt < s.SalesStartAt {
+		return errInvalidSchedule
+	}
+	return nil
+}
+
+func (s *EventSchedule) String() string {
+	if s == nil {
+		return ""
+	}
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func (s EventSchedule) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *EventSchedule) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	}
+	return fmt.Errorf("cannot scan %T into EventSchedule", src)
+}
+
+// CheckSale returns why tickets cannot be bought at now, if they cannot.
+// Sales stop when the event is over even if no sales end was set.
+func (s *EventSchedule) CheckSale(now time.Time) error {
+	if s == nil {
+		return nil
+	}
+	t := now.Unix()
+	if s.SalesStartAt != 0 && t < s.SalesStartAt {
+		return ErrSalesNotStarted
+	}
+	if (s.SalesEndAt != 0 && t >= s.SalesEndAt) || (s.EndsAt != 0 && t >= s.EndsAt) {
+		return ErrSalesEnded
+	}
+	return nil
+}
+
+// CheckCancel returns ErrSalesEnded once the event is over and its
+// reservations can no longer be canceled. Any earlier deadline is the
+// event's CancellationPolicy's to set.
+func (s *EventSchedule) CheckCancel(now time.Time) error {
+	if s.Over(now) {
+		return ErrSalesEnded
+	}
+	return nil
+}
+
+// Over reports whether the event has ended at now. An event without an end
+// is over once it has started.
+func (s *EventSchedule) Over(now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	end := s.EndsAt
+	if end == 0 {
+		end = s.StartsAt
+	}
+	return end != 0 && now.Unix() >= end
+}
+
+// upcomingEvents drops the events that are over and orders the rest by when
+// they start. Events without a start date come last, in id order.
+func upcomingEvents(events []*Event, now time.Time) []*Event {
+	upcoming := make([]*Event, 0, len(events))
+	for _, e := range events {
+		if !e.Schedule.Over(now) {
+			upcoming = append(upcoming, e)
+		}
+	}
+	sort.SliceStable(upcoming, func(i, j int) bool {
+		a, b := startsAt(upcoming[i]), startsAt(upcoming[j])
+		if a == 0 || b == 0 {
+			return a != 0 && b == 0
+		}
+		return a < b
+	})
+	return upcoming
+}
+
+func startsAt(e *Event) int64 {
+	if e.Schedule == nil {
+		return 0
+	}
+	return e.Schedule.StartsAt
+}
@@ -0,0 +1,1221 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store is everything the handlers need from persistence. Lookups that find
+// nothing return sql.ErrNoRows whatever the backend.
+type Store interface {
+	// Load fills the in-memory state from the backend.
+	Load() error
+	// Initialize resets the backend to its initial dataset.
+	Initialize() error
+	Close(ctx context.Context) error
+
+	CreateUser(nickname, loginName, password string) (*User, error)
+	// GetUser and GetAdministrator only fill in ID and Nickname.
+	GetUser(id int64) (*User, error)
+	GetUserByLoginName(loginName string) (*User, error)
+
+	GetAdministrator(id int64) (*Administrator, error)
+	GetAdministratorByLoginName(loginName string) (*Administrator, error)
+
+	GetEvent(id int64) (*Event, error)
+	ListEvents() []*Event
+	CreateEvent(e Event) (*Event, error)
+	UpdateEvent(id int64, public, closed bool) (*Event, error)
+	SetEventAllocation(id int64, policy *SeatPolicy) (*Event, error)
+	SetEventLimits(id int64, limits *PurchaseLimits) (*Event, error)
+	SetEventSchedule(id int64, schedule *EventSchedule) (*Event, error)
+	// SetEventPricing changes the prices of reservations from now on; the
+	// ones already made keep the price they were charged.
+	SetEventPricing(id int64, pricing *PricingPolicy) (*Event, error)
+	SetEventCancellation(id int64, policy *CancellationPolicy) (*Event, error)
+
+	// ScheduleTransition has ApplyDueTransitions set the event's flags at
+	// runAt, with the same rules as UpdateEvent then.
+	ScheduleTransition(eventID int64, public, closed bool, runAt time.Time, adminID int64) (*EventTransition, error)
+	// CancelTransition fails with ErrTransitionDone once the transition ran.
+	CancelTransition(eventID, id int64) error
+	ListTransitions(eventID int64) []*EventTransition
+	// ApplyDueTransitions runs every pending transition whose time has come,
+	// each exactly once even across restarts and instances, and reports how
+	// many it ran. One the rules no longer allow is done with its Error set.
+	ApplyDueTransitions() (int, error)
+
+	// ActiveLimit is how many active reservations one user may have over
+	// all events, 0 for no limit.
+	ActiveLimit() int
+	SetActiveLimit(max int) error
+
+	GetVenue(id int64) (*Venue, error)
+	ListVenues() []*Venue
+	GetSheet(id int64) (*Sheet, error)
+	CreateVenue(name string) (*Venue, error)
+	AddSheets(venueID int64, rank string, count, price int64) (*Venue, error)
+	// RetireSheet stops selling a sheet. It fails with ErrSheetReserved
+	// while the sheet has an active reservation.
+	RetireSheet(venueID int64, rank string, num int64) error
+	SetRankPrice(venueID int64, rank string, price int64) (*Venue, error)
+
+	// Reserve and ReserveSeats fail with ErrLimitExceeded if the seats would
+	// take the user past ActiveLimit or the event's limits. A non-nil promo
+	// discounts every sheet; they fail with ErrPromoExhausted if that would
+	// go past the code's caps, and with ErrPromoExpired if the code was
+	// disabled or ran out since the caller looked it up.
+	Reserve(eventID, userID int64, candidates []int64, promo *PromoCode) (*Reservation, error)
+	// ReserveSeats books count of the sheets, all or none, seating them
+	// together where alloc says if it can. sheets must be in num order. A
+	// positive hold makes them holds that lapse unless confirmed in time.
+	ReserveSeats(eventID, userID int64, sheets []*Sheet, count int, alloc SeatAllocator, hold time.Duration, promo *PromoCode) ([]*Reservation, error)
+	// ConfirmReservations turns the user's holds into reservations, all or
+	// none. It fails with ErrHoldExpired if one of them ran out.
+	ConfirmReservations(eventID, userID int64, ids []int64) ([]*Reservation, error)
+	// ReleaseExpiredHolds cancels holds that ran out and reports how many.
+	// Their sheets go to the waitlist as CancelReservation's do.
+	ReleaseExpiredHolds() (int, error)
+	// CancelReservation frees the sheet, keeping what terms say of its
+	// price or failing with their error; a hold is let go for free. If
+	// someone is waiting for its rank the sheet becomes their hold at once
+	// and they are notified.
+	CancelReservation(eventID, sheetID, userID int64, terms cancelTerms) (*Reservation, error)
+	ActiveReservations(eventID int64) map[int64]*Reservation
+	ReservedCounts(eventID int64) map[string]int
+	ReservationsByEvent(eventID int64) []*Reservation
+	ReservationsByUser(userID int64) []*Reservation
+	AllReservations() []*Reservation
+	GetReservation(id int64) (*Reservation, error)
+
+	// JoinWaitlist queues the user for the next freed sheet of the rank.
+	// Joining again returns the existing entry.
+	JoinWaitlist(eventID int64, rank string, userID int64) (*WaitlistEntry, error)
+	// LeaveWaitlist fails with ErrNotWaiting if the user is not queued.
+	LeaveWaitlist(eventID int64, rank string, userID int64) error
+	// WaitlistStatus returns how many wait for the rank and the user's
+	// 1-based place among them, 0 if not queued.
+	WaitlistStatus(eventID int64, rank string, userID int64) (length, position int)
+
+	// CreatePromoCode fails with ErrDuplicated if the code is taken.
+	CreatePromoCode(p PromoCode) (*PromoCode, error)
+	DisablePromoCode(id int64) (*PromoCode, error)
+	GetPromoCode(id int64) (*PromoCode, error)
+	// FindPromoCode looks a code up the way a customer typed it.
+	FindPromoCode(code string) (*PromoCode, error)
+	ListPromoCodes() []*PromoCode
+	// PromoRedemptions returns the reservations made with the promo code,
+	// canceled ones included.
+	PromoRedemptions(id int64) []*Reservation
+
+	// OfferTransfer offers the holder's confirmed reservation to another
+	// user. It fails with ErrTransferPending while another offer of it is.
+	OfferTransfer(reservationID, fromUserID, toUserID int64) (*TicketTransfer, error)
+	// AcceptTransfer makes the recipient the reservation's holder, within
+	// their purchase limits for the event.
+	AcceptTransfer(id, userID int64) (*TicketTransfer, error)
+	// CancelTransfer withdraws or declines a pending transfer; either user
+	// may.
+	CancelTransfer(id, userID int64) (*TicketTransfer, error)
+	GetTransfer(id int64) (*TicketTransfer, error)
+	// TransfersByUser returns the transfers the user offered or was
+	// offered, newest first.
+	TransfersByUser(userID int64) []*TicketTransfer
+	// TransfersByReservation returns the reservation's transfers in the
+	// order they were offered.
+	TransfersByReservation(reservationID int64) []*TicketTransfer
+}
+
+var ErrDuplicated = errors.New("duplicated")
+
+func passwordHash(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// mutationSink receives every journaled mutation after it has been applied
+// in memory. DBWriter is the MySQL one.
+type mutationSink interface {
+	Acquire() error
+	Release()
+	Enqueue(seq int64, op string, data interface{})
+}
+
+type nopSink struct{}
+
+func (nopSink) Acquire() error                                 { return nil }
+func (nopSink) Release()                                       {}
+func (nopSink) Enqueue(seq int64, op string, data interface{}) {}
+
+// memoryStore implements the event, sheet and reservation half of Store on
+// the in-memory indexes. Backends embed it and supply their own journal and
+// sink.
+type memoryStore struct {
+	activeLimit int64
+	limitMu     sync.Mutex
+
+	reservations *ReservationStore
+	events       *EventStore
+	waitlist     *WaitlistStore
+	transitions  *TransitionStore
+	promos       *PromoStore
+	transfers    *TransferStore
+	journal      *Journal
+	sink         mutationSink
+	// newID, if set, inserts the row of a new waitlist entry, transition,
+	// promo code or transfer right away and returns the ID it got, for
+	// when several processes hand out IDs from the same tables.
+	newID func(record interface{}) (int64, error)
+
+	catalog atomic.Value
+	venueMu sync.Mutex
+}
+
+func newMemoryStore(journal *Journal, sink mutationSink) *memoryStore {
+	m := &memoryStore{
+		reservations: newReservationStore(),
+		events:       newEventStore(),
+		waitlist:     newWaitlistStore(),
+		transitions:  newTransitionStore(),
+		promos:       newPromoStore(),
+		transfers:    newTransferStore(),
+		journal:      journal,
+		sink:         sink,
+	}
+	m.catalog.Store(newVenueCatalog(map[int64]string{}, nil))
+	m.reservations.price = m.sheetPrice
+	return m
+}
+
+// persist journals a record and hands it to the sink. It is called under the
+// write lock of whichever in-memory store is being mutated.
+func (m *memoryStore) persist(seq *int64, op string, record interface{}) error {
+	var err error
+	if *seq, err = m.journal.Append(op, record); err != nil {
+		return err
+	}
+	m.sink.Enqueue(*seq, op, record)
+	return nil
+}
+
+// assignID sets *id to the one MySQL gives record if MySQL hands out IDs,
+// and leaves the store's own otherwise. The row written behind later finds
+// itself there already and is left alone.
+func (m *memoryStore) assignID(id *int64, record interface{}) error {
+	if m.newID == nil {
+		return nil
+	}
+	got, err := m.newID(record)
+	if err != nil {
+		return err
+	}
+	*id = got
+	return nil
+}
+
+// mutate takes room in the sink, runs fn and waits for the journal to be
+// durable before returning, so a nil error means the change survives a crash.
+func (m *memoryStore) mutate(fn func(seq *int64) error) error {
+	if err := m.sink.Acquire(); err != nil {
+		return err
+	}
+	var seq int64
+	if err := fn(&seq); err != nil {
+		m.sink.Release()
+		return err
+	}
+	if seq == 0 {
+		// fn found nothing to change.
+		m.sink.Release()
+		return nil
+	}
+	return m.journal.Sync(seq)
+}
+
+// apply replays a journaled mutation into memory. It reports false for ops
+// it does not know. Applying a record twice is harmless.
+func (m *memoryStore) apply(rec *journalRecord) (bool, error) {
+	v, err := decodeRecord(rec)
+	if err != nil || v == nil {
+		return v != nil, err
+	}
+
+	switch r := v.(type) {
+	case reserveRecord:
+		m.reservations.Add(m.backfillPrice(r.reservation()))
+	case reserveBatchRecord:
+		for _, rr := range r.Reservations {
+			m.reservations.Add(m.backfillPrice(rr.reservation()))
+		}
+	case cancelRecord:
+		m.applyCancel(r)
+	case confirmRecord:
+		m.reservations.MarkConfirmed(r.IDs)
+	case offerRecord:
+		m.applyCancel(r.Canceled)
+		m.waitlist.Remove(r.WaitlistID)
+		m.reservations.Add(m.backfillPrice(r.Hold.reservation()))
+	case eventRecord:
+		if rec.Op == opEventCreate {
+			m.events.Put(&Event{ID: r.ID, Title: r.Title, PublicFg: r.PublicFg, ClosedFg: r.ClosedFg, Price: r.Price, VenueID: r.VenueID, Allocation: r.Allocation, Limits: r.Limits, Schedule: r.Schedule, Pricing: r.Pricing, Cancellation: r.Cancellation})
+			break
+		}
+		e, err := m.events.Get(r.ID)
+		if err != nil {
+			return true, err
+		}
+		updated := *e
+		switch rec.Op {
+		case opEventSeats:
+			updated.Allocation = r.Allocation
+		case opEventLimits:
+			updated.Limits = r.Limits
+		case opEventSchedule:
+			updated.Schedule = r.Schedule
+		case opEventPricing:
+			updated.Pricing = r.Pricing
+		case opEventCancellation:
+			updated.Cancellation = r.Cancellation
+		default:
+			updated.PublicFg = r.PublicFg
+			updated.ClosedFg = r.ClosedFg
+		}
+		m.events.Put(&updated)
+	case venueRecord:
+		m.updateVenues(func(c *VenueCatalog) *VenueCatalog { return c.withVenue(r.ID, r.Name) })
+	case sheetsRecord:
+		if len(r.IDs) == 0 {
+			break
+		}
+		m.updateVenues(func(c *VenueCatalog) *VenueCatalog {
+			if _, err := c.Sheet(r.IDs[0]); err == nil {
+				return c
+			}
+			return c.withSheets(r.sheets())
+		})
+	case sheetRetireRecord:
+		m.updateVenues(func(c *VenueCatalog) *VenueCatalog { return c.withRetired(r.ID) })
+	case rankPriceRecord:
+		m.updateVenues(func(c *VenueCatalog) *VenueCatalog { return c.withRankPrice(r.VenueID, r.Rank, r.Price) })
+	case activeLimitRecord:
+		atomic.StoreInt64(&m.activeLimit, int64(r.Max))
+	case waitlistRecord:
+		m.waitlist.Add(r.entry())
+	case waitlistDropRecord:
+		m.waitlist.Remove(r.ID)
+	case transitionRecord:
+		m.transitions.Put(r.transition())
+	case transitionEndRecord:
+		if r.Event != nil {
+			e, err := m.events.Get(r.Event.ID)
+			if err != nil {
+				return true, err
+			}
+			updated := *e
+			updated.PublicFg = r.Event.PublicFg
+			updated.ClosedFg = r.Event.ClosedFg
+			m.events.Put(&updated)
+		}
+		m.transitions.MarkDone(r.ID, r.DoneAt, r.Canceled, r.Error)
+	case promoRecord:
+		m.promos.Put(r.promo())
+	case promoDisableRecord:
+		m.promos.Disable(r.ID, func(*PromoCode) error { return nil })
+	case transferRecord:
+		m.transfers.Put(r.transfer())
+	case transferEndRecord:
+		if r.Accepted {
+			m.reservations.MarkTransferred(r.ReservationID, r.UserID)
+		}
+		m.transfers.MarkDone(r.ID, r.DoneAt, r.Accepted)
+	}
+	return true, nil
+}
+
+func (m *memoryStore) applyCancel(r cancelRecord) {
+	m.reservations.MarkCanceled(r.ID, r.CanceledAt, r.Fee)
+	if r.TransferID != 0 {
+		m.transfers.MarkDone(r.TransferID, r.CanceledAt, false)
+	}
+}
+
+func (m *memoryStore) GetEvent(id int64) (*Event, error) {
+	return m.events.Get(id)
+}
+
+func (m *memoryStore) ListEvents() []*Event {
+	return m.events.List()
+}
+
+func (m *memoryStore) CreateEvent(e Event) (*Event, error) {
+	var event *Event
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		event, err = m.events.Create(e, func(e *Event) error {
+			return m.persist(seq, opEventCreate, eventRecord{
+				ID:       e.ID,
+				Title:    e.Title,
+				PublicFg: e.PublicFg,
+				ClosedFg: e.ClosedFg,
+				Price:    e.Price,
+				VenueID:  e.VenueID,
+
+				Allocation:   e.Allocation,
+				Limits:       e.Limits,
+				Schedule:     e.Schedule,
+				Pricing:      e.Pricing,
+				Cancellation: e.Cancellation,
+			})
+		})
+		return err
+	})
+	return event, err
+}
+
+var (
+	errCannotEditClosedEvent  = errors.New("cannot edit closed event")
+	errCannotClosePublicEvent = errors.New("cannot close public event")
+)
+
+// setEventFlags edits the event's flags if the rules allow it.
+func setEventFlags(e *Event, public, closed bool) error {
+	if e.ClosedFg {
+		return errCannotEditClosedEvent
+	} else if e.PublicFg && closed {
+		return errCannotClosePublicEvent
+	}
+	e.PublicFg = public
+	e.ClosedFg = closed
+	return nil
+}
+
+func (m *memoryStore) UpdateEvent(id int64, public, closed bool) (*Event, error) {
+	var event *Event
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		event, err = m.events.Update(id, func(e *Event) error {
+			return setEventFlags(e, public, closed)
+		}, func(e *Event) error {
+			return m.persist(seq, opEventUpdate, eventRecord{ID: e.ID, PublicFg: e.PublicFg, ClosedFg: e.ClosedFg})
+		})
+		return err
+	})
+	return event, err
+}
+
+func (m *memoryStore) SetEventAllocation(id int64, policy *SeatPolicy) (*Event, error) {
+	var event *Event
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		event, err = m.events.Update(id, func(e *Event) error {
+			if e.ClosedFg {
+				return errCannotEditClosedEvent
+			}
+			e.Allocation = policy
+			return nil
+		}, func(e *Event) error {
+			return m.persist(seq, opEventSeats, eventRecord{ID: e.ID, Allocation: e.Allocation})
+		})
+		return err
+	})
+	return event, err
+}
+
+func (m *memoryStore) SetEventLimits(id int64, limits *PurchaseLimits) (*Event, error) {
+	var event *Event
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		event, err = m.events.Update(id, func(e *Event) error {
+			if e.ClosedFg {
+				return errCannotEditClosedEvent
+			}
+			e.Limits = limits
+			return nil
+		}, func(e *Event) error {
+			return m.persist(seq, opEventLimits, eventRecord{ID: e.ID, Limits: e.Limits})
+		})
+		return err
+	})
+	return event, err
+}
+
+func (m *memoryStore) SetEventSchedule(id int64, schedule *EventSchedule) (*Event, error) {
+	var event *Event
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		event, err = m.events.Update(id, func(e *Event) error {
+			if e.ClosedFg {
+				return errCannotEditClosedEvent
+			}
+			e.Schedule = schedule
+			return nil
+		}, func(e *Event) error {
+			return m.persist(seq, opEventSchedule, eventRecord{ID: e.ID, Schedule: e.Schedule})
+		})
+		return err
+	})
+	return event, err
+}
+
+func (m *memoryStore) SetEventPricing(id int64, pricing *PricingPolicy) (*Event, error) {
+	var event *Event
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		event, err = m.events.Update(id, func(e *Event) error {
+			if e.ClosedFg {
+				return errCannotEditClosedEvent
+			}
+			e.Pricing = pricing
+			return nil
+		}, func(e *Event) error {
+			return m.persist(seq, opEventPricing, eventRecord{ID: e.ID, Pricing: e.Pricing})
+		})
+		return err
+	})
+	return event, err
+}
+
+func (m *memoryStore) SetEventCancellation(id int64, policy *CancellationPolicy) (*Event, error) {
+	var event *Event
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		event, err = m.events.Update(id, func(e *Event) error {
+			if e.ClosedFg {
+				return errCannotEditClosedEvent
+			}
+			e.Cancellation = policy
+			return nil
+		}, func(e *Event) error {
+			return m.persist(seq, opEventCancellation, eventRecord{ID: e.ID, Cancellation: e.Cancellation})
+		})
+		return err
+	})
+	return event, err
+}
+
+// sheetPrice is what a sheet of the event costs right now, with reserved
+// sheets of its rank already gone.
+func (m *memoryStore) sheetPrice(eventID, sheetID int64, reserved int) PriceBreakdown {
+	e, err := m.events.Get(eventID)
+	if err != nil {
+		return PriceBreakdown{}
+	}
+	sheet, err := m.venues().Sheet(sheetID)
+	if err != nil {
+		return PriceBreakdown{Base: e.Price}
+	}
+	remains := 0
+	if venue, err := m.venues().Get(sheet.VenueID); err == nil {
+		if vr, ok := venue.Rank(sheet.Rank); ok {
+			remains = int(vr.Count) - reserved
+		}
+	}
+	return e.Pricing.Quote(e.Price, sheet.Price, sheet.Rank, remains, time.Now())
+}
+
+// seatPrices prices sheets of one rank booked together, in order, when
+// reserved sheets of the rank were taken before them.
+func (m *memoryStore) seatPrices(eventID int64, sheetIDs []int64, reserved int) []PriceBreakdown {
+	prices := make([]PriceBreakdown, len(sheetIDs))
+	for i, sheetID := range sheetIDs {
+		prices[i] = m.sheetPrice(eventID, sheetID, reserved+i)
+	}
+	return prices
+}
+
+func (m *memoryStore) ScheduleTransition(eventID int64, public, closed bool, runAt time.Time, adminID int64) (*EventTransition, error) {
+	e, err := m.events.Get(eventID)
+	if err != nil {
+		return nil, err
+	} else if e.ClosedFg {
+		return nil, errCannotEditClosedEvent
+	}
+	var t *EventTransition
+	err = m.mutate(func(seq *int64) error {
+		var err error
+		t, err = m.transitions.Create(EventTransition{
+			EventID:     eventID,
+			PublicFg:    public,
+			ClosedFg:    closed,
+			RunAt:       runAt.UTC(),
+			ScheduledBy: adminID,
+			CreatedAt:   time.Now().UTC(),
+		}, func(t *EventTransition) error {
+			rec := transitionRecord{
+				ID:          t.ID,
+				EventID:     t.EventID,
+				PublicFg:    t.PublicFg,
+				ClosedFg:    t.ClosedFg,
+				RunAt:       t.RunAt,
+				ScheduledBy: t.ScheduledBy,
+				CreatedAt:   t.CreatedAt,
+			}
+			if err := m.assignID(&rec.ID, rec); err != nil {
+				return err
+			}
+			t.ID = rec.ID
+			return m.persist(seq, opTransitionAdd, rec)
+		})
+		return err
+	})
+	return t, err
+}
+
+func (m *memoryStore) CancelTransition(eventID, id int64) error {
+	if t, ok := m.transitions.Get(id); !ok || t.EventID != eventID {
+		return sql.ErrNoRows
+	}
+	return m.mutate(func(seq *int64) error {
+		_, err := m.transitions.Finish(id, func(t *EventTransition) error {
+			now := time.Now().UTC()
+			t.DoneAt = &now
+			t.Canceled = true
+			return m.persist(seq, opTransitionEnd, transitionEndRecord{ID: t.ID, DoneAt: now, Canceled: true})
+		})
+		return err
+	})
+}
+
+func (m *memoryStore) CreatePromoCode(p PromoCode) (*PromoCode, error) {
+	p.CreatedAt = time.Now().UTC()
+	var created *PromoCode
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		created, err = m.promos.Create(p, func(p *PromoCode) error {
+			if err := m.assignID(&p.ID, newPromoRecord(p)); err != nil {
+				return err
+			}
+			return m.persist(seq, opPromoCreate, newPromoRecord(p))
+		})
+		return err
+	})
+	return created, err
+}
+
+func (m *memoryStore) DisablePromoCode(id int64) (*PromoCode, error) {
+	var disabled *PromoCode
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		disabled, err = m.promos.Disable(id, func(p *PromoCode) error {
+			return m.persist(seq, opPromoDisable, promoDisableRecord{ID: p.ID})
+		})
+		return err
+	})
+	return disabled, err
+}
+
+func (m *memoryStore) GetPromoCode(id int64) (*PromoCode, error) {
+	return m.promos.Get(id)
+}
+
+func (m *memoryStore) FindPromoCode(code string) (*PromoCode, error) {
+	return m.promos.ByCode(normalizePromoCode(code))
+}
+
+func (m *memoryStore) ListPromoCodes() []*PromoCode {
+	return m.promos.List()
+}
+
+func (m *memoryStore) PromoRedemptions(id int64) []*Reservation {
+	return m.reservations.ByPromo(id)
+}
+
+func (m *memoryStore) ListTransitions(eventID int64) []*EventTransition {
+	return m.transitions.ByEvent(eventID)
+}
+
+func (m *memoryStore) ApplyDueTransitions() (int, error) {
+	now := time.Now().UTC()
+	ran := 0
+	for _, due := range m.transitions.Due(now) {
+		finished := false
+		err := m.mutate(func(seq *int64) error {
+			_, err := m.transitions.Finish(due.ID, func(t *EventTransition) error {
+				t.DoneAt = &now
+				rec := transitionEndRecord{ID: t.ID, DoneAt: now}
+				_, err := m.events.Update(t.EventID, func(e *Event) error {
+					return setEventFlags(e, t.PublicFg, t.ClosedFg)
+				}, func(e *Event) error {
+					rec.Event = &eventRecord{ID: e.ID, PublicFg: e.PublicFg, ClosedFg: e.ClosedFg}
+					return m.persist(seq, opTransitionEnd, rec)
+				})
+				if isEventEditError(err) {
+					t.Error = err.Error()
+					rec.Error = t.Error
+					return m.persist(seq, opTransitionEnd, rec)
+				}
+				return err
+			})
+			if err == ErrTransitionDone {
+				// Canceled or run by someone else since Due looked.
+				return nil
+			}
+			finished = err == nil
+			return err
+		})
+		if err != nil {
+			return ran, err
+		}
+		if finished {
+			ran++
+		}
+	}
+	return ran, nil
+}
+
+// isEventEditError reports whether err means the rules refused an event
+// edit, so retrying will not help.
+func isEventEditError(err error) bool {
+	return err == errCannotEditClosedEvent || err == errCannotClosePublicEvent || err == sql.ErrNoRows
+}
+
+func (m *memoryStore) ActiveLimit() int {
+	return int(atomic.LoadInt64(&m.activeLimit))
+}
+
+func (m *memoryStore) SetActiveLimit(max int) error {
+	return m.mutate(func(seq *int64) error {
+		m.limitMu.Lock()
+		defer m.limitMu.Unlock()
+		if err := m.persist(seq, opActiveLimit, activeLimitRecord{Max: max}); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&m.activeLimit, int64(max))
+		return nil
+	})
+}
+
+// userLimits is what caps a reservation request for the event.
+func (m *memoryStore) userLimits(eventID int64) userLimits {
+	limits := userLimits{Active: m.ActiveLimit()}
+	if e, err := m.events.Get(eventID); err == nil {
+		limits.Event = e.Limits
+	}
+	return limits
+}
+
+// venues returns the current catalog. It takes no lock, so it is safe to
+// call while holding the lock of any other store.
+func (m *memoryStore) venues() *VenueCatalog {
+	return m.catalog.Load().(*VenueCatalog)
+}
+
+func (m *memoryStore) setVenues(c *VenueCatalog) {
+	m.venueMu.Lock()
+	defer m.venueMu.Unlock()
+	m.catalog.Store(c)
+}
+
+func (m *memoryStore) updateVenues(fn func(c *VenueCatalog) *VenueCatalog) {
+	m.venueMu.Lock()
+	defer m.venueMu.Unlock()
+	m.catalog.Store(fn(m.venues()))
+}
+
+func (m *memoryStore) GetVenue(id int64) (*Venue, error) {
+	return m.venues().Get(id)
+}
+
+func (m *memoryStore) ListVenues() []*Venue {
+	return m.venues().List()
+}
+
+func (m *memoryStore) GetSheet(id int64) (*Sheet, error) {
+	return m.venues().Sheet(id)
+}
+
+func (m *memoryStore) CreateVenue(name string) (*Venue, error) {
+	var venue *Venue
+	err := m.mutate(func(seq *int64) error {
+		m.venueMu.Lock()
+		defer m.venueMu.Unlock()
+
+		c := m.venues()
+		id := c.maxVenueID + 1
+		if err := m.persist(seq, opVenueCreate, venueRecord{ID: id, Name: name}); err != nil {
+			return err
+		}
+		c = c.withVenue(id, name)
+		m.catalog.Store(c)
+		venue, _ = c.Get(id)
+		return nil
+	})
+	return venue, err
+}
+
+func (m *memoryStore) AddSheets(venueID int64, rank string, count, price int64) (*Venue, error) {
+	var venue *Venue
+	err := m.mutate(func(seq *int64) error {
+		m.venueMu.Lock()
+		defer m.venueMu.Unlock()
+
+		c := m.venues()
+		if _, err := c.Get(venueID); err != nil {
+			return err
+		}
+		sheets := c.newSheets(venueID, rank, count, price)
+		record := sheetsRecord{VenueID: venueID, Rank: rank, Price: price, FirstNum: sheets[0].Num}
+		for _, s := range sheets {
+			record.IDs = append(record.IDs, s.ID)
+		}
+		if err := m.persist(seq, opSheetsAdd, record); err != nil {
+			return err
+		}
+		c = c.withSheets(sheets)
+		m.catalog.Store(c)
+		venue, _ = c.Get(venueID)
+		return nil
+	})
+	return venue, err
+}
+
+func (m *memoryStore) RetireSheet(venueID int64, rank string, num int64) error {
+	return m.mutate(func(seq *int64) error {
+		m.venueMu.Lock()
+		defer m.venueMu.Unlock()
+
+		c := m.venues()
+		sheet, err := lookupSheet(c, venueID, rank, num)
+		if err != nil {
+			return err
+		}
+		if sheet.Retired {
+			return nil
+		}
+		if m.reservations.SheetReserved(sheet.ID) {
+			return ErrSheetReserved
+		}
+		if err := m.persist(seq, opSheetRetire, sheetRetireRecord{ID: sheet.ID}); err != nil {
+			return err
+		}
+		m.catalog.Store(c.withRetired(sheet.ID))
+		return nil
+	})
+}
+
+func (m *memoryStore) SetRankPrice(venueID int64, rank string, price int64) (*Venue, error) {
+	var venue *Venue
+	err := m.mutate(func(seq *int64) error {
+		m.venueMu.Lock()
+		defer m.venueMu.Unlock()
+
+		c := m.venues()
+		v, err := c.Get(venueID)
+		if err != nil {
+			return err
+		}
+		if _, ok := v.Rank(rank); !ok {
+			return sql.ErrNoRows
+		}
+		if err := m.persist(seq, opRankPrice, rankPriceRecord{VenueID: venueID, Rank: rank, Price: price}); err != nil {
+			return err
+		}
+		c = c.withRankPrice(venueID, rank, price)
+		m.catalog.Store(c)
+		venue, _ = c.Get(venueID)
+		return nil
+	})
+	return venue, err
+}
+
+func lookupSheet(c *VenueCatalog, venueID int64, rank string, num int64) (*Sheet, error) {
+	v, err := c.Get(venueID)
+	if err != nil {
+		return nil, err
+	}
+	vr, ok := v.Rank(rank)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	sheet, ok := vr.Sheet(num)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return sheet, nil
+}
+
+func (m *memoryStore) Reserve(eventID, userID int64, candidates []int64, promo *PromoCode) (*Reservation, error) {
+	var reservation *Reservation
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		reservation, err = m.reservations.Reserve(eventID, userID, candidates, m.userLimits(eventID), promo, func(r *Reservation) error {
+			if err := m.checkPromo(promo); err != nil {
+				return err
+			}
+			return m.persist(seq, opReserve, newReserveRecord(r))
+		})
+		return err
+	})
+	return reservation, err
+}
+
+func (m *memoryStore) ReserveSeats(eventID, userID int64, sheets []*Sheet, count int, alloc SeatAllocator, hold time.Duration, promo *PromoCode) ([]*Reservation, error) {
+	var reservations []*Reservation
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		reservations, err = m.reservations.ReserveSeats(eventID, userID, hold, m.userLimits(eventID), promo, func(taken func(int64) bool) []int64 {
+			return pickSeats(sheets, count, taken, alloc)
+		}, func(rs []*Reservation) error {
+			if err := m.checkPromo(promo); err != nil {
+				return err
+			}
+			op, record := reservationsRecord(rs)
+			return m.persist(seq, op, record)
+		})
+		return err
+	})
+	return reservations, err
+}
+
+// checkPromo looks at promo again as it is now. The caller checked a copy,
+// and the code may have been disabled or run out since.
+func (m *memoryStore) checkPromo(promo *PromoCode) error {
+	if promo == nil {
+		return nil
+	}
+	current, err := m.promos.Get(promo.ID)
+	if err != nil {
+		return err
+	}
+	return current.live(time.Now())
+}
+
+// reservationsRecord journals a single reservation the way Reserve does and
+// a group as one batch.
+func reservationsRecord(rs []*Reservation) (string, interface{}) {
+	batch := newReserveBatchRecord(rs)
+	if len(rs) == 1 {
+		return opReserve, batch.Reservations[0]
+	}
+	return opReserveBatch, batch
+}
+
+func newReserveBatchRecord(rs []*Reservation) reserveBatchRecord {
+	record := reserveBatchRecord{Reservations: make([]reserveRecord, len(rs))}
+	for i, r := range rs {
+		record.Reservations[i] = newReserveRecord(r)
+	}
+	return record
+}
+
+func newReserveRecord(r *Reservation) reserveRecord {
+	return reserveRecord{
+		ID:         r.ID,
+		EventID:    r.EventID,
+		SheetID:    r.SheetID,
+		UserID:     r.UserID,
+		ReservedAt: *r.ReservedAt,
+		Price:      r.Price,
+		Breakdown:  r.Breakdown,
+		ExpiresAt:  r.ExpiresAt,
+
+		PromoCodeID: r.PromoCodeID,
+	}
+}
+
+// backfillPrice gives a reservation journaled before prices were recorded
+// the event's and the sheet's price as of that point in the journal, the
+// best there is to go on. backfillPrices does the same in MySQL.
+func (m *memoryStore) backfillPrice(r *Reservation) *Reservation {
+	if r.Breakdown != nil {
+		return r
+	}
+	var b PriceBreakdown
+	if e, err := m.events.Get(r.EventID); err == nil {
+		b.Base = e.Price
+	}
+	if sheet, err := m.venues().Sheet(r.SheetID); err == nil {
+		b.Rank = sheet.Price
+	}
+	r.charge(b)
+	return r
+}
+
+func (m *memoryStore) ConfirmReservations(eventID, userID int64, ids []int64) ([]*Reservation, error) {
+	var reservations []*Reservation
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		reservations, err = m.reservations.Confirm(eventID, userID, ids, time.Now().UTC(), func(rs []*Reservation) error {
+			record := confirmRecord{}
+			for _, r := range rs {
+				record.IDs = append(record.IDs, r.ID)
+			}
+			return m.persist(seq, opConfirm, record)
+		})
+		return err
+	})
+	return reservations, err
+}
+
+func (m *memoryStore) ReleaseExpiredHolds() (int, error) {
+	now := time.Now().UTC()
+	released := 0
+	for _, id := range m.reservations.ExpiredHolds(now) {
+		var next *Reservation
+		err := m.mutate(func(seq *int64) error {
+			h := &handOff{m: m, seq: seq}
+			r, hold, err := m.reservations.Release(id, now, h.offer, h.persist)
+			if err != nil {
+				h.abort()
+				return err
+			}
+			if r != nil {
+				released++
+			}
+			next = hold
+			return nil
+		})
+		if err != nil {
+			return released, err
+		}
+		if next != nil {
+			notifyOffer(next)
+		}
+	}
+	return released, nil
+}
+
+// errReservationMoved means the sheet changed hands between looking up its
+// reservation and canceling it.
+var errReservationMoved = errors.New("reservation moved")
+
+// CancelReservation ends the reservation's pending transfer along with it.
+// The transfer is locked first, as AcceptTransfer does, so the reservation
+// is looked up beforehand and the cancel retried if another took its place.
+func (m *memoryStore) CancelReservation(eventID, sheetID, userID int64, terms cancelTerms) (*Reservation, error) {
+	var reservation, next *Reservation
+	for {
+		var activeID int64
+		if r := m.reservations.ActiveOn(eventID, sheetID); r != nil {
+			activeID = r.ID
+		}
+		err := m.mutate(func(seq *int64) error {
+			return m.transfers.FinishPending(activeID, func(t *TicketTransfer) error {
+				h := &handOff{m: m, seq: seq, transfer: t}
+				var err error
+				reservation, next, err = m.reservations.Cancel(eventID, sheetID, userID, terms, h.offer, func(r, next *Reservation) error {
+					if r.ID != activeID {
+						return errReservationMoved
+					}
+					return h.persist(r, next)
+				})
+				if err != nil {
+					h.abort()
+				}
+				return err
+			})
+		})
+		if err == errReservationMoved {
+			continue
+		}
+		if err == nil && next != nil {
+			notifyOffer(next)
+		}
+		return reservation, err
+	}
+}
+
+// holdTTL is how long a hold, and a sheet offered off the waitlist, stays
+// reserved without being confirmed.
+var holdTTL = time.Duration(GetenvInt("HOLD_TTL_SEC", 600)) * time.Second
+
+// handOff passes a freed sheet to the first customer waiting for its rank,
+// as long as the event is still on sale. It carries the waitlist entry from
+// the offer, which runs under the reservation lock, to the journal record.
+type handOff struct {
+	m        *memoryStore
+	seq      *int64
+	entry    *WaitlistEntry
+	transfer *TicketTransfer
+}
+
+func (h *handOff) offer(freed *Reservation) (int64, time.Duration) {
+	if e, err := h.m.events.Get(freed.EventID); err != nil || !e.PublicFg {
+		return 0, 0
+	}
+	h.entry = h.m.waitlist.Take(freed.EventID, sheetRank(freed.SheetID))
+	if h.entry == nil {
+		return 0, 0
+	}
+	return h.entry.UserID, holdTTL
+}
+
+func (h *handOff) persist(r, next *Reservation) error {
+	canceled := cancelRecord{ID: r.ID, CanceledAt: *r.CanceledAt, Fee: r.CancelFee}
+	if h.transfer != nil {
+		h.transfer.DoneAt = r.CanceledAt
+		canceled.TransferID = h.transfer.ID
+	}
+	if next == nil {
+		return h.m.persist(h.seq, opCancel, canceled)
+	}
+	return h.m.persist(h.seq, opOffer, offerRecord{Canceled: canceled, WaitlistID: h.entry.ID, Hold: newReserveRecord(next)})
+}
+
+// abort puts the customer back at the front of the queue when the sheet
+// could not be handed over after all.
+func (h *handOff) abort() {
+	if h.entry != nil {
+		h.m.waitlist.Restore(h.entry)
+		h.entry = nil
+	}
+}
+
+func (m *memoryStore) ActiveReservations(eventID int64) map[int64]*Reservation {
+	return m.reservations.ActiveByEvent(eventID)
+}
+
+func (m *memoryStore) ReservedCounts(eventID int64) map[string]int {
+	return m.reservations.Reserved(eventID)
+}
+
+func (m *memoryStore) ReservationsByEvent(eventID int64) []*Reservation {
+	return m.reservations.ByEvent(eventID)
+}
+
+func (m *memoryStore) ReservationsByUser(userID int64) []*Reservation {
+	return m.reservations.ByUser(userID)
+}
+
+func (m *memoryStore) AllReservations() []*Reservation {
+	return m.reservations.All()
+}
+
+func (m *memoryStore) GetReservation(id int64) (*Reservation, error) {
+	r, ok := m.reservations.Get(id)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return r, nil
+}
+
+func (m *memoryStore) JoinWaitlist(eventID int64, rank string, userID int64) (*WaitlistEntry, error) {
+	var entry *WaitlistEntry
+	err := m.mutate(func(seq *int64) error {
+		// Sheets offered off the waitlist are not checked against the
+		// limits, so whoever could not buy one may not queue for it either.
+		// No reservation may slip in between the check and the join.
+		return m.reservations.WithHoldings(userID, eventID, rank, func(h userHoldings) error {
+			if !m.userLimits(eventID).allows(h, rank, 1) {
+				return ErrLimitExceeded
+			}
+			var err error
+			entry, err = m.waitlist.Join(eventID, rank, userID, func(e *WaitlistEntry) error {
+				rec := waitlistRecord{ID: e.ID, EventID: e.EventID, Rank: e.Rank, UserID: e.UserID, CreatedAt: e.CreatedAt}
+				if err := m.assignID(&rec.ID, rec); err != nil {
+					return err
+				}
+				e.ID = rec.ID
+				return m.persist(seq, opWaitlistJoin, rec)
+			})
+			return err
+		})
+	})
+	return entry, err
+}
+
+func (m *memoryStore) LeaveWaitlist(eventID int64, rank string, userID int64) error {
+	return m.mutate(func(seq *int64) error {
+		_, err := m.waitlist.Leave(eventID, rank, userID, func(e *WaitlistEntry) error {
+			return m.persist(seq, opWaitlistDrop, waitlistDropRecord{ID: e.ID})
+		})
+		return err
+	})
+}
+
+func (m *memoryStore) WaitlistStatus(eventID int64, rank string, userID int64) (int, int) {
+	return m.waitlist.Len(eventID, rank), m.waitlist.Position(eventID, rank, userID)
+}
+
+func (m *memoryStore) OfferTransfer(reservationID, fromUserID, toUserID int64) (*TicketTransfer, error) {
+	r, ok := m.reservations.Get(reservationID)
+	if !ok || r.CanceledAt != nil || r.ExpiresAt != nil {
+		return nil, ErrNotReserved
+	}
+	if r.UserID != fromUserID {
+		return nil, ErrNotPermitted
+	}
+	var t *TicketTransfer
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		t, err = m.transfers.Create(TicketTransfer{
+			ReservationID: r.ID,
+			EventID:       r.EventID,
+			FromUserID:    fromUserID,
+			ToUserID:      toUserID,
+			CreatedAt:     time.Now().UTC(),
+		}, func(t *TicketTransfer) error {
+			if err := m.assignID(&t.ID, newTransferRecord(t)); err != nil {
+				return err
+			}
+			return m.persist(seq, opTransferOffer, newTransferRecord(t))
+		})
+		return err
+	})
+	return t, err
+}
+
+func (m *memoryStore) AcceptTransfer(id, userID int64) (*TicketTransfer, error) {
+	t, ok := m.transfers.Get(id)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if t.ToUserID != userID {
+		return nil, ErrNotPermitted
+	}
+	limits := m.userLimits(t.EventID)
+	var done *TicketTransfer
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		done, err = m.transfers.Finish(id, func(t *TicketTransfer) error {
+			now := time.Now().UTC()
+			t.DoneAt = &now
+			t.Accepted = true
+			_, err := m.reservations.Transfer(t.ReservationID, t.FromUserID, t.ToUserID, limits, func(r *Reservation) error {
+				return m.persist(seq, opTransferEnd, transferEndRecord{ID: t.ID, DoneAt: now, Accepted: true, ReservationID: r.ID, UserID: r.UserID})
+			})
+			return err
+		})
+		return err
+	})
+	return done, err
+}
+
+func (m *memoryStore) CancelTransfer(id, userID int64) (*TicketTransfer, error) {
+	var done *TicketTransfer
+	err := m.mutate(func(seq *int64) error {
+		var err error
+		done, err = m.transfers.Finish(id, func(t *TicketTransfer) error {
+			if t.FromUserID != userID && t.ToUserID != userID {
+				return ErrNotPermitted
+			}
+			now := time.Now().UTC()
+			t.DoneAt = &now
+			return m.persist(seq, opTransferEnd, transferEndRecord{ID: t.ID, DoneAt: now})
+		})
+		return err
+	})
+	return done, err
+}
+
+func (m *memoryStore) GetTransfer(id int64) (*TicketTransfer, error) {
+	t, ok := m.transfers.Get(id)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+func (m *memoryStore) TransfersByUser(userID int64) []*TicketTransfer {
+	return m.transfers.ByUser(userID)
+}
+
+func (m *memoryStore) TransfersByReservation(reservationID int64) []*TicketTransfer {
+	return m.transfers.ByReservation(reservationID)
+}
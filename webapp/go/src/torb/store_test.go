@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestStore opens a file store on path and makes it the global store,
+// which sheet lookups go through.
+func openTestStore(t testing.TB, path string) *fileStore {
+	t.Helper()
+	fs, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	store = fs
+	return fs
+}
+
+// TestConcurrentReserveCancelEdit hammers one event with reservations,
+// cancellations and event edits at once. Run it with -race.
+func TestConcurrentReserveCancelEdit(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "journal"))
+	defer s.Close(context.Background())
+
+	event, err := s.CreateEvent(Event{Title: "stress", PublicFg: true, Price: 1000, VenueID: defaultVenueID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	venue, err := s.GetVenue(defaultVenueID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranks := []string{"S", "A"}
+
+	const users = 8
+	const rounds = 100
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for u := int64(1); u <= users; u++ {
+		wg.Add(1)
+		go func(userID int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(userID))
+			for i := 0; i < rounds; i++ {
+				rank := ranks[rnd.Intn(len(ranks))]
+				vr, _ := venue.Rank(rank)
+				e, err := s.GetEvent(event.ID)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				switch rnd.Intn(3) {
+				case 0:
+					_, err = s.Reserve(event.ID, userID, vr.SheetIDs(), nil)
+				case 1:
+					_, err = s.ReserveSeats(event.ID, userID, vr.Sheets(), 1+rnd.Intn(3), e.Allocation.Allocator(rank), 0, nil)
+				default:
+					var mine []*Reservation
+					for _, r := range s.ReservationsByUser(userID) {
+						if r.CanceledAt == nil {
+							mine = append(mine, r)
+						}
+					}
+					if len(mine) == 0 {
+						continue
+					}
+					r := mine[rnd.Intn(len(mine))]
+					_, err = s.CancelReservation(event.ID, r.SheetID, userID, nil)
+				}
+				if err != nil && err != ErrSoldOut && err != ErrLimitExceeded && err != ErrNotReserved {
+					t.Error(err)
+				}
+			}
+		}(u)
+	}
+
+	var editors sync.WaitGroup
+	editors.Add(2)
+	go func() {
+		defer editors.Done()
+		strategies := []string{"random", "best_available", "fill_from_back", "balanced"}
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var err error
+			switch i % 4 {
+			case 0:
+				_, err = s.UpdateEvent(event.ID, true, false)
+			case 1:
+				_, err = s.SetEventAllocation(event.ID, &SeatPolicy{Default: strategies[i%len(strategies)]})
+			case 2:
+				_, err = s.SetEventLimits(event.ID, &PurchaseLimits{Event: 20 + i%5})
+			default:
+				_, err = s.SetEventPricing(event.ID, nil)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer editors.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for sheetID, r := range s.ActiveReservations(event.ID) {
+				if r.SheetID != sheetID || r.CanceledAt != nil {
+					t.Errorf("active reservation %d listed under sheet %d", r.ID, sheetID)
+				}
+			}
+			e, _ := s.GetEvent(event.ID)
+			fillEventSummary(e)
+			s.ReservationsByEvent(event.ID)
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	editors.Wait()
+
+	checkReservationInvariants(t, s, event.ID)
+}
+
+// checkReservationInvariants checks that no sheet is sold twice and that
+// every index agrees with the reservations themselves.
+func checkReservationInvariants(t *testing.T, s Store, eventID int64) {
+	t.Helper()
+	active := make(map[int64]*Reservation)
+	perRank := make(map[string]int)
+	for _, r := range s.ReservationsByEvent(eventID) {
+		if r.CanceledAt != nil {
+			continue
+		}
+		if other, ok := active[r.SheetID]; ok {
+			t.Errorf("sheet %d reserved by both %d and %d", r.SheetID, other.ID, r.ID)
+		}
+		active[r.SheetID] = r
+		perRank[sheetRank(r.SheetID)]++
+	}
+
+	indexed := s.ActiveReservations(eventID)
+	if len(indexed) != len(active) {
+		t.Errorf("%d active reservations indexed, want %d", len(indexed), len(active))
+	}
+	for sheetID, r := range active {
+		if indexed[sheetID] != r {
+			t.Errorf("sheet %d: indexed %v, want reservation %d", sheetID, indexed[sheetID], r.ID)
+		}
+	}
+	counts := s.ReservedCounts(eventID)
+	for _, rank := range []string{"S", "A", "B", "C"} {
+		if counts[rank] != perRank[rank] {
+			t.Errorf("rank %s: %d counted reserved, want %d", rank, counts[rank], perRank[rank])
+		}
+	}
+
+	e, err := s.GetEvent(eventID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := fillEventSummary(e)
+	if want := summary.Total - len(active); summary.Remains != want {
+		t.Errorf("remains = %d, want %d", summary.Remains, want)
+	}
+}
+
+func TestConcurrentReserveSameSheet(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "journal"))
+	defer s.Close(context.Background())
+
+	event, err := s.CreateEvent(Event{Title: "one seat", PublicFg: true, Price: 1000, VenueID: defaultVenueID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheet, err := lookupSheet(s.venues(), defaultVenueID, "S", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	start := make(chan struct{})
+	for u := int64(1); u <= 16; u++ {
+		wg.Add(1)
+		go func(userID int64) {
+			defer wg.Done()
+			<-start
+			_, err := s.Reserve(event.ID, userID, []int64{sheet.ID}, nil)
+			switch err {
+			case nil:
+				mu.Lock()
+				won++
+				mu.Unlock()
+			case ErrSoldOut:
+			default:
+				t.Error(err)
+			}
+		}(u)
+	}
+	close(start)
+	wg.Wait()
+
+	if won != 1 {
+		t.Errorf("%d users got the sheet, want 1", won)
+	}
+	checkReservationInvariants(t, s, event.ID)
+}
+
+func TestReservePromo(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "journal"))
+	defer s.Close(context.Background())
+
+	event, err := s.CreateEvent(Event{Title: "promo", PublicFg: true, Price: 1000, VenueID: defaultVenueID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	promo, err := s.CreatePromoCode(PromoCode{Code: "ONCE", Kind: promoAmount, Value: 300, MaxUsesPerUser: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheet := func(num int64) []int64 {
+		sheet, err := lookupSheet(s.venues(), defaultVenueID, "S", num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []int64{sheet.ID}
+	}
+
+	r, err := s.Reserve(event.ID, 1, sheet(1), promo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.PromoCodeID != promo.ID || r.charged().Discount != 300 {
+		t.Errorf("reserved with promo %d, discount %d", r.PromoCodeID, r.charged().Discount)
+	}
+	if _, err := s.Reserve(event.ID, 1, sheet(2), promo); err != ErrPromoExhausted {
+		t.Errorf("second use by the same user: %v, want %v", err, ErrPromoExhausted)
+	}
+
+	// The caller still has the copy it looked up before the code was
+	// disabled.
+	if _, err := s.DisablePromoCode(promo.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve(event.ID, 2, sheet(3), promo); err != ErrPromoExpired {
+		t.Errorf("reserve with a disabled code: %v, want %v", err, ErrPromoExpired)
+	}
+	venue, err := s.GetVenue(defaultVenueID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vr, _ := venue.Rank("A")
+	if _, err := s.ReserveSeats(event.ID, 2, vr.Sheets(), 1, seatAllocators["best_available"], 0, promo); err != ErrPromoExpired {
+		t.Errorf("reserve seats with a disabled code: %v, want %v", err, ErrPromoExpired)
+	}
+	checkReservationInvariants(t, s, event.ID)
+}
+
+func TestCancelHoldIgnoresTerms(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "journal"))
+	defer s.Close(context.Background())
+
+	event, err := s.CreateEvent(Event{Title: "terms", PublicFg: true, Price: 1000, VenueID: defaultVenueID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	venue, err := s.GetVenue(defaultVenueID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vr, _ := venue.Rank("S")
+	closed := cancelTerms(func() (*CancellationFee, error) { return nil, ErrCancelClosed })
+	charged := cancelTerms(func() (*CancellationFee, error) { return &CancellationFee{Percent: 50}, nil })
+
+	holds, err := s.ReserveSeats(event.ID, 1, vr.Sheets(), 2, seatAllocators["best_available"], time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.CancelReservation(event.ID, holds[0].SheetID, 1, closed)
+	if err != nil {
+		t.Fatalf("cancel a hold past the deadline: %v", err)
+	}
+	if r.CancelFee != 0 {
+		t.Errorf("hold canceled for a fee of %d", r.CancelFee)
+	}
+	if r, err = s.CancelReservation(event.ID, holds[1].SheetID, 1, charged); err != nil {
+		t.Fatalf("cancel a hold under a fee: %v", err)
+	} else if r.CancelFee != 0 {
+		t.Errorf("hold canceled under a fee for %d", r.CancelFee)
+	}
+
+	r, err = s.Reserve(event.ID, 1, vr.SheetIDs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CancelReservation(event.ID, r.SheetID, 1, closed); err != ErrCancelClosed {
+		t.Errorf("cancel a reservation past the deadline: %v, want %v", err, ErrCancelClosed)
+	}
+	if r, err = s.CancelReservation(event.ID, r.SheetID, 1, charged); err != nil {
+		t.Fatalf("cancel a reservation under a fee: %v", err)
+	} else if r.CancelFee != r.Price/2 {
+		t.Errorf("reservation canceled for a fee of %d of %d", r.CancelFee, r.Price)
+	}
+	checkReservationInvariants(t, s, event.ID)
+}
+
+func TestHoldExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	s := openTestStore(t, path)
+	defer func() { s.Close(context.Background()) }()
+
+	event, err := s.CreateEvent(Event{Title: "holds", PublicFg: true, Price: 1000, VenueID: defaultVenueID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	venue, err := s.GetVenue(defaultVenueID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vr, _ := venue.Rank("S")
+	best := seatAllocators["best_available"]
+
+	short, err := s.ReserveSeats(event.ID, 1, vr.Sheets(), 1, best, 50*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := s.ReserveSeats(event.ID, 2, vr.Sheets(), 1, best, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.ReleaseExpiredHolds(); err != nil || n != 0 {
+		t.Errorf("released %d holds before any expired: %v", n, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	// Expired but not swept yet: it cannot be confirmed any more.
+	if _, err := s.ConfirmReservations(event.ID, 1, []int64{short[0].ID}); err != ErrHoldExpired {
+		t.Errorf("confirm an expired hold: %v, want %v", err, ErrHoldExpired)
+	}
+	if n, err := s.ReleaseExpiredHolds(); err != nil || n != 1 {
+		t.Fatalf("released %d holds, want 1: %v", n, err)
+	}
+	if n, err := s.ReleaseExpiredHolds(); err != nil || n != 0 {
+		t.Errorf("released %d holds again: %v", n, err)
+	}
+	if _, err := s.ConfirmReservations(event.ID, 1, []int64{short[0].ID}); err != ErrHoldExpired {
+		t.Errorf("confirm a released hold: %v, want %v", err, ErrHoldExpired)
+	}
+
+	confirmed, err := s.ConfirmReservations(event.ID, 2, []int64{long[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed[0].ExpiresAt != nil {
+		t.Errorf("confirmed hold still expires at %v", confirmed[0].ExpiresAt)
+	}
+
+	// The released sheet is on sale again, also after a restart.
+	s.Close(context.Background())
+	s = openTestStore(t, path)
+	for _, r := range s.ReservationsByUser(1) {
+		if r.ID == short[0].ID && (r.CanceledAt == nil || !r.CanceledAt.Equal(*r.ExpiresAt)) {
+			t.Errorf("released hold canceled at %v, expired at %v", r.CanceledAt, r.ExpiresAt)
+		}
+	}
+	if _, err := s.Reserve(event.ID, 3, []int64{short[0].SheetID}, nil); err != nil {
+		t.Errorf("reserve the released sheet: %v", err)
+	}
+	checkReservationInvariants(t, s, event.ID)
+}
+
+// activeHold returns the user's active hold on the event, if any.
+func activeHold(s Store, eventID, userID int64) *Reservation {
+	for _, r := range s.ReservationsByUser(userID) {
+		if r.EventID == eventID && r.CanceledAt == nil && r.ExpiresAt != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestWaitlistHandOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	s := openTestStore(t, path)
+	defer func() { s.Close(context.Background()) }()
+	defer func(ttl time.Duration) { holdTTL = ttl }(holdTTL)
+	holdTTL = 50 * time.Millisecond
+
+	event, err := s.CreateEvent(Event{Title: "waitlist", PublicFg: true, Price: 1000, VenueID: defaultVenueID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	venue, err := s.GetVenue(defaultVenueID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vr, _ := venue.Rank("S")
+
+	r, err := s.Reserve(event.ID, 1, vr.SheetIDs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range []int64{2, 3} {
+		if _, err := s.JoinWaitlist(event.ID, "S", userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, pos := s.WaitlistStatus(event.ID, "S", 3); n != 2 || pos != 2 {
+		t.Errorf("waitlist: %d waiting, user 3 at %d", n, pos)
+	}
+
+	// The first in line gets the canceled sheet as a hold.
+	if _, err := s.CancelReservation(event.ID, r.SheetID, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	hold := activeHold(s, event.ID, 2)
+	if hold == nil || hold.SheetID != r.SheetID {
+		t.Fatalf("user 2 holds %+v, want sheet %d", hold, r.SheetID)
+	}
+	if n, pos := s.WaitlistStatus(event.ID, "S", 3); n != 1 || pos != 1 {
+		t.Errorf("waitlist after the offer: %d waiting, user 3 at %d", n, pos)
+	}
+
+	// Letting the hold lapse passes the sheet on to the next one.
+	time.Sleep(60 * time.Millisecond)
+	if n, err := s.ReleaseExpiredHolds(); err != nil || n != 1 {
+		t.Fatalf("released %d holds, want 1: %v", n, err)
+	}
+	if hold := activeHold(s, event.ID, 3); hold == nil || hold.SheetID != r.SheetID {
+		t.Fatalf("user 3 holds %+v, want sheet %d", hold, r.SheetID)
+	}
+
+	s.Close(context.Background())
+	s = openTestStore(t, path)
+	if hold := activeHold(s, event.ID, 3); hold == nil || hold.SheetID != r.SheetID {
+		t.Errorf("after restart user 3 holds %+v, want sheet %d", hold, r.SheetID)
+	}
+	if n, _ := s.WaitlistStatus(event.ID, "S", 3); n != 0 {
+		t.Errorf("after restart %d still waiting", n)
+	}
+	checkReservationInvariants(t, s, event.ID)
+}
+
+func TestCancelEndsTransfer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	s := openTestStore(t, path)
+	defer func() { s.Close(context.Background()) }()
+
+	event, err := s.CreateEvent(Event{Title: "transfers", PublicFg: true, Price: 1000, VenueID: defaultVenueID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	venue, err := s.GetVenue(defaultVenueID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vr, _ := venue.Rank("S")
+
+	// One sheet is canceled outright, the other handed to the waitlist.
+	var offered []*TicketTransfer
+	for i := 0; i < 2; i++ {
+		r, err := s.Reserve(event.ID, 1, vr.SheetIDs(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err := s.OfferTransfer(r.ID, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			if _, err := s.JoinWaitlist(event.ID, "S", 3); err != nil {
+				t.Fatal(err)
+			}
+		}
+		canceled, err := s.CancelReservation(event.ID, r.SheetID, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done, _ := s.GetTransfer(tr.ID); done.Pending() || done.Accepted || !done.DoneAt.Equal(*canceled.CanceledAt) {
+			t.Errorf("transfer of a canceled reservation: %+v", done)
+		}
+		if _, err := s.AcceptTransfer(tr.ID, 2); err != ErrTransferDone {
+			t.Errorf("accept the transfer of a canceled reservation: %v, want %v", err, ErrTransferDone)
+		}
+		offered = append(offered, tr)
+	}
+	if hold := activeHold(s, event.ID, 3); hold == nil {
+		t.Error("waitlisted user 3 got no hold")
+	}
+
+	s.Close(context.Background())
+	s = openTestStore(t, path)
+	for _, tr := range offered {
+		if done, _ := s.GetTransfer(tr.ID); done.Pending() || done.Accepted {
+			t.Errorf("after restart transfer %d is %+v", tr.ID, done)
+		}
+	}
+	checkReservationInvariants(t, s, event.ID)
+}
+
+func TestTransitionsRunOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	s := openTestStore(t, path)
+	defer func() { s.Close(context.Background()) }()
+
+	event, err := s.CreateEvent(Event{Title: "scheduled", Price: 1000, VenueID: defaultVenueID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ScheduleTransition(event.ID, true, false, time.Now().Add(20*time.Millisecond), 1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.ApplyDueTransitions(); err != nil || n != 0 {
+		t.Errorf("ran %d transitions before any was due: %v", n, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// Sweepers racing each other run it once between them.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ran := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := s.ApplyDueTransitions()
+			if err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			ran += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if ran != 1 {
+		t.Errorf("ran %d transitions, want 1", ran)
+	}
+	if e, err := s.GetEvent(event.ID); err != nil || !e.PublicFg {
+		t.Errorf("event after the transition: %+v %v", e, err)
+	}
+
+	s.Close(context.Background())
+	s = openTestStore(t, path)
+	if n, err := s.ApplyDueTransitions(); err != nil || n != 0 {
+		t.Errorf("ran %d transitions again after restart: %v", n, err)
+	}
+}
+
+func TestPricingQuote(t *testing.T) {
+	now := time.Unix(1000, 0)
+	steps := &PricingPolicy{Steps: []PriceStep{{Remains: 10, Add: 500}, {Remains: 2, Add: 2000}, {Rank: "S", Remains: 5, Add: 1000}}}
+	early := &PricingPolicy{EarlyBird: []EarlyBird{{Until: 2000, Discount: 300}, {Until: 3000, Discount: 100}, {Until: 500, Discount: 900}}}
+	tests := []struct {
+		name       string
+		policy     *PricingPolicy
+		rank       string
+		remains    int
+		adjustment int64
+		total      int64
+	}{
+		{"no policy", nil, "S", 0, 0, 1500},
+		{"no step yet", steps, "A", 11, 0, 1500},
+		{"step reached", steps, "A", 10, 500, 2000},
+		{"step of another rank", steps, "A", 5, 500, 2000},
+		{"largest step counts", steps, "S", 5, 1000, 2500},
+		{"last sheets", steps, "S", 1, 2000, 3500},
+		{"largest running discount counts", early, "S", 50, -300, 1200},
+		{"discount clamped at zero", &PricingPolicy{EarlyBird: []EarlyBird{{Until: 2000, Discount: 5000}}}, "S", 50, -1500, 0},
+		{"step and discount", &PricingPolicy{Steps: steps.Steps, EarlyBird: early.EarlyBird}, "S", 1, 1700, 3200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.policy.Quote(1000, 500, tt.rank, tt.remains, now)
+			if b.Base != 1000 || b.Rank != 500 || b.Adjustment != tt.adjustment || b.Total() != tt.total {
+				t.Errorf("Quote = %+v (total %d), want adjustment %d, total %d", b, b.Total(), tt.adjustment, tt.total)
+			}
+		})
+	}
+}
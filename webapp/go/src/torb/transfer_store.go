@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTransferDone    = errors.New("transfer already done")
+	ErrTransferPending = errors.New("transfer already pending")
+)
+
+// TicketTransfer offers a reservation from its holder to another user, who
+// becomes its holder on accepting. It is done once DoneAt is set: accepted,
+// or canceled by either of them. Done transfers are kept as the history of
+// who held a reservation.
+type TicketTransfer struct {
+	ID            int64
+	ReservationID int64
+	EventID       int64
+	FromUserID    int64
+	ToUserID      int64
+	CreatedAt     time.Time
+	DoneAt        *time.Time
+	Accepted      bool
+}
+
+func (t *TicketTransfer) Pending() bool {
+	return t.DoneAt == nil
+}
+
+// TransferStore keeps every transfer, done ones included. Like the other
+// stores it hands out pointers that are never modified.
+type TransferStore struct {
+	mu    sync.RWMutex
+	byID  map[int64]*TicketTransfer
+	maxID int64
+}
+
+func newTransferStore() *TransferStore {
+	return &TransferStore{byID: make(map[int64]*TicketTransfer)}
+}
+
+// Replace takes over the contents of a freshly loaded store.
+func (s *TransferStore) Replace(other *TransferStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID = other.byID
+	s.maxID = other.maxID
+}
+
+// Put stores t, replacing any transfer with the same id. Used for loading
+// and replaying; new transfers go through Create.
+func (s *TransferStore) Put(t *TicketTransfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[t.ID] = t
+	if t.ID > s.maxID {
+		s.maxID = t.ID
+	}
+}
+
+// MarkDone records the outcome of a transfer. Used when replaying.
+func (s *TransferStore) MarkDone(id int64, doneAt time.Time, accepted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.byID[id]
+	if !ok || !t.Pending() {
+		return
+	}
+	done := *t
+	done.DoneAt = &doneAt
+	done.Accepted = accepted
+	s.byID[id] = &done
+}
+
+// Create fails with ErrTransferPending while the reservation has another
+// transfer pending.
+func (s *TransferStore) Create(t TicketTransfer, persist func(t *TicketTransfer) error) (*TicketTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.byID {
+		if other.ReservationID == t.ReservationID && other.Pending() {
+			return nil, ErrTransferPending
+		}
+	}
+	t.ID = s.maxID + 1
+	if err := persist(&t); err != nil {
+		return nil, err
+	}
+	s.byID[t.ID] = &t
+	s.maxID = t.ID
+	return &t, nil
+}
+
+// Finish ends a pending transfer. fn gets a copy to fill in the outcome and
+// persist it; it runs under the write lock, so a transfer is finished at
+// most once. Finishing one that is done already fails with ErrTransferDone.
+func (s *TransferStore) Finish(id int64, fn func(t *TicketTransfer) error) (*TicketTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.byID[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if !t.Pending() {
+		return nil, ErrTransferDone
+	}
+	done := *t
+	if err := fn(&done); err != nil {
+		return nil, err
+	}
+	s.byID[id] = &done
+	return &done, nil
+}
+
+// FinishPending ends the reservation's pending transfer, if it has one, the
+// way Finish does. fn gets nil when there is none, and runs under the write
+// lock either way, so no transfer can be offered for the reservation while
+// it is being canceled.
+func (s *TransferStore) FinishPending(reservationID int64, fn func(t *TicketTransfer) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var done *TicketTransfer
+	for _, t := range s.byID {
+		if t.ReservationID == reservationID && t.Pending() {
+			cp := *t
+			done = &cp
+			break
+		}
+	}
+	if err := fn(done); err != nil {
+		return err
+	}
+	if done != nil {
+		s.byID[done.ID] = done
+	}
+	return nil
+}
+
+func (s *TransferStore) Get(id int64) (*TicketTransfer, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.byID[id]
+	return t, ok
+}
+
+// ByUser returns the transfers the user offered or was offered, newest
+// first.
+func (s *TransferStore) ByUser(userID int64) []*TicketTransfer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ts []*TicketTransfer
+	for _, t := range s.byID {
+		if t.FromUserID == userID || t.ToUserID == userID {
+			ts = append(ts, t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].ID > ts[j].ID })
+	return ts
+}
+
+// ByReservation returns the reservation's transfers oldest first, which
+// for the accepted ones is the order it changed hands.
+func (s *TransferStore) ByReservation(reservationID int64) []*TicketTransfer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ts []*TicketTransfer
+	for _, t := range s.byID {
+		if t.ReservationID == reservationID {
+			ts = append(ts, t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].ID < ts[j].ID })
+	return ts
+}
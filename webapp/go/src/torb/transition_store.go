@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTransitionDone    = errors.New("transition already done")
+	errInvalidTransition = errors.New("invalid transition")
+)
+
+// EventTransition sets an event's public and closed flags at RunAt, as if
+// the administrator who scheduled it had edited the event then. It is done
+// once DoneAt is set: applied, canceled, or failed with Error because the
+// edit was not allowed by then.
+type EventTransition struct {
+	ID          int64
+	EventID     int64
+	PublicFg    bool
+	ClosedFg    bool
+	RunAt       time.Time
+	ScheduledBy int64
+	CreatedAt   time.Time
+	DoneAt      *time.Time
+	Canceled    bool
+	Error       string
+}
+
+func (t *EventTransition) Pending() bool {
+	return t.DoneAt == nil
+}
+
+// TransitionStore keeps every transition, done ones included, so admins can
+// see what happened. Like the other stores it hands out pointers that are
+// never modified.
+type TransitionStore struct {
+	mu    sync.RWMutex
+	byID  map[int64]*EventTransition
+	maxID int64
+}
+
+func newTransitionStore() *TransitionStore {
+	return &TransitionStore{byID: make(map[int64]*EventTransition)}
+}
+
+// Replace takes over the contents of a freshly loaded store.
+func (s *TransitionStore) Replace(other *TransitionStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID = other.byID
+	s.maxID = other.maxID
+}
+
+// Put stores t, replacing any transition with the same id. Used for
+// loading and replaying; new transitions go through Create.
+func (s *TransitionStore) Put(t *EventTransition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[t.ID] = t
+	if t.ID > s.maxID {
+		s.maxID = t.ID
+	}
+}
+
+// MarkDone records the outcome of a transition. Used when replaying.
+func (s *TransitionStore) MarkDone(id int64, doneAt time.Time, canceled bool, errMsg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.byID[id]
+	if !ok || !t.Pending() {
+		return
+	}
+	done := *t
+	done.DoneAt = &doneAt
+	done.Canceled = canceled
+	done.Error = errMsg
+	s.byID[id] = &done
+}
+
+func (s *TransitionStore) Create(t EventTransition, persist func(t *EventTransition) error) (*EventTransition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t.ID = s.maxID + 1
+	if err := persist(&t); err != nil {
+		return nil, err
+	}
+	s.byID[t.ID] = &t
+	s.maxID = t.ID
+	return &t, nil
+}
+
+// Finish ends a pending transition. fn gets a copy to fill in the outcome
+// and persist it; it runs under the write lock, so a transition is finished
+// at most once. Finishing one that is done already fails with
+// ErrTransitionDone.
+func (s *TransitionStore) Finish(id int64, fn func(t *EventTransition) error) (*EventTransition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.byID[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if !t.Pending() {
+		return nil, ErrTransitionDone
+	}
+	done := *t
+	if err := fn(&done); err != nil {
+		return nil, err
+	}
+	s.byID[id] = &done
+	return &done, nil
+}
+
+func (s *TransitionStore) Get(id int64) (*EventTransition, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.byID[id]
+	return t, ok
+}
+
+// ByEvent returns the event's transitions in the order they run.
+func (s *TransitionStore) ByEvent(eventID int64) []*EventTransition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ts []*EventTransition
+	for _, t := range s.byID {
+		if t.EventID == eventID {
+			ts = append(ts, t)
+		}
+	}
+	sortTransitions(ts)
+	return ts
+}
+
+// Due returns the pending transitions whose time has come, earliest first.
+func (s *TransitionStore) Due(now time.Time) []*EventTransition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ts []*EventTransition
+	for _, t := range s.byID {
+		if t.Pending() && !t.RunAt.After(now) {
+			ts = append(ts, t)
+		}
+	}
+	sortTransitions(ts)
+	return ts
+}
+
+func sortTransitions(ts []*EventTransition) {
+	sort.Slice(ts, func(i, j int) bool {
+		if !ts[i].RunAt.Equal(ts[j].RunAt) {
+			return ts[i].RunAt.Before(ts[j].RunAt)
+		}
+		return ts[i].ID < ts[j].ID
+	})
+}
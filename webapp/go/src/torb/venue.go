@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+)
+
+var ErrSheetReserved = errors.New("sheet is reserved")
+
+// Venue is a seat layout an event is sold against. Ranks are listed in the
+// order their first sheet was added and only include ranks that still have
+// sheets on sale.
+type Venue struct {
+	ID    int64        `json:"id"`
+	Name  string       `json:"name"`
+	Ranks []*VenueRank `json:"ranks"`
+	Total int          `json:"total"`
+
+	byRank map[string]*VenueRank
+}
+
+// VenueRank holds the sheets of one rank. Retired sheets are no longer sold
+// but can still be looked up by number, so old reservations keep resolving.
+type VenueRank struct {
+	Rank    string `json:"rank"`
+	Count   int64  `json:"count"`
+	Price   int64  `json:"price"`
+	Retired int64  `json:"retired,omitempty"`
+
+	sheets []*Sheet
+	byNum  map[int64]*Sheet
+}
+
+const defaultVenueID = 1
+
+// defaultVenueSheets is the layout seeded into an empty store, the same one
+// db/init.sh loads into MySQL.
+func defaultVenueSheets() []*Sheet {
+	var sheets []*Sheet
+	for _, r := range []struct {
+		rank  string
+		count int64
+		price int64
+	}{{"S", 50, 5000}, {"A", 150, 3000}, {"B", 300, 1000}, {"C", 500, 0}} {
+		for num := int64(1); num <= r.count; num++ {
+			sheets = append(sheets, &Sheet{
+				ID:      int64(len(sheets) + 1),
+				VenueID: defaultVenueID,
+				Rank:    r.rank,
+				Num:     num,
+				Price:   r.price,
+			})
+		}
+	}
+	return sheets
+}
+
+func (v *Venue) Rank(rank string) (*VenueRank, bool) {
+	vr, ok := v.byRank[rank]
+	return vr, ok
+}
+
+func (v *Venue) RankNames() []string {
+	names := make([]string, len(v.Ranks))
+	for i, vr := range v.Ranks {
+		names[i] = vr.Rank
+	}
+	return names
+}
+
+// Sheets returns the sheets on sale in rank order. The sheets are shared and
+// must not be modified.
+func (v *Venue) Sheets() []*Sheet {
+	sheets := make([]*Sheet, 0, v.Total)
+	for _, vr := range v.Ranks {
+		sheets = append(sheets, vr.sheets...)
+	}
+	return sheets
+}
+
+func (vr *VenueRank) Sheet(num int64) (*Sheet, bool) {
+	s, ok := vr.byNum[num]
+	return s, ok
+}
+
+// Sheets returns the sheets on sale in num order. The sheets are shared and
+// must not be modified.
+func (vr *VenueRank) Sheets() []*Sheet {
+	return append([]*Sheet(nil), vr.sheets...)
+}
+
+// SheetIDs returns the IDs of the sheets on sale.
+func (vr *VenueRank) SheetIDs() []int64 {
+	return sheetIDs(vr.sheets)
+}
+
+// VenueCatalog is an immutable snapshot of every venue and sheet. Changes
+// build a new catalog from the rows of the old one.
+type VenueCatalog struct {
+	names      map[int64]string
+	rows       []*Sheet
+	venues     []*Venue
+	byID       map[int64]*Venue
+	sheets     map[int64]*Sheet
+	maxVenueID int64
+	maxSheetID int64
+}
+
+// newVenueCatalog builds the catalog from venue names and sheet rows; rows
+// are shared with the new catalog and must not be modified afterwards.
+func newVenueCatalog(names map[int64]string, rows []*Sheet) *VenueCatalog {
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+
+	c := &VenueCatalog{
+		names:  names,
+		rows:   rows,
+		byID:   make(map[int64]*Venue, len(names)),
+		sheets: make(map[int64]*Sheet, len(rows)),
+	}
+	for id, name := range names {
+		c.byID[id] = &Venue{ID: id, Name: name, Ranks: make([]*VenueRank, 0), byRank: make(map[string]*VenueRank)}
+		if id > c.maxVenueID {
+			c.maxVenueID = id
+		}
+	}
+	for _, s := range rows {
+		c.sheets[s.ID] = s
+		if s.ID > c.maxSheetID {
+			c.maxSheetID = s.ID
+		}
+		v, ok := c.byID[s.VenueID]
+		if !ok {
+			continue
+		}
+		vr, ok := v.byRank[s.Rank]
+		if !ok {
+			vr = &VenueRank{Rank: s.Rank, byNum: make(map[int64]*Sheet)}
+			v.byRank[s.Rank] = vr
+		}
+		vr.byNum[s.Num] = s
+		if s.Retired {
+			vr.Retired++
+			continue
+		}
+		if vr.Count == 0 {
+			v.Ranks = append(v.Ranks, vr)
+		}
+		vr.sheets = append(vr.sheets, s)
+		vr.Count++
+		vr.Price = s.Price
+		v.Total++
+	}
+	for _, v := range c.byID {
+		for _, vr := range v.Ranks {
+			sort.Slice(vr.sheets, func(i, j int) bool { return vr.sheets[i].Num < vr.sheets[j].Num })
+		}
+		c.venues = append(c.venues, v)
+	}
+	sort.Slice(c.venues, func(i, j int) bool { return c.venues[i].ID < c.venues[j].ID })
+	return c
+}
+
+func (c *VenueCatalog) Get(id int64) (*Venue, error) {
+	v, ok := c.byID[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return v, nil
+}
+
+func (c *VenueCatalog) List() []*Venue {
+	return append([]*Venue(nil), c.venues...)
+}
+
+func (c *VenueCatalog) Sheet(id int64) (*Sheet, error) {
+	s, ok := c.sheets[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return s, nil
+}
+
+func (c *VenueCatalog) withVenue(id int64, name string) *VenueCatalog {
+	names := make(map[int64]string, len(c.names)+1)
+	for k, v := range c.names {
+		names[k] = v
+	}
+	names[id] = name
+	return newVenueCatalog(names, c.rows)
+}
+
+func (c *VenueCatalog) withSheets(sheets []*Sheet) *VenueCatalog {
+	rows := make([]*Sheet, 0, len(c.rows)+len(sheets))
+	rows = append(rows, c.rows...)
+	rows = append(rows, sheets...)
+	return newVenueCatalog(c.names, rows)
+}
+
+// withSheet replaces the rows of fn's choosing with the copies fn returns.
+func (c *VenueCatalog) withSheet(fn func(s *Sheet) *Sheet) *VenueCatalog {
+	rows := make([]*Sheet, len(c.rows))
+	for i, s := range c.rows {
+		if ns := fn(s); ns != nil {
+			s = ns
+		}
+		rows[i] = s
+	}
+	return newVenueCatalog(c.names, rows)
+}
+
+func (c *VenueCatalog) withRetired(sheetID int64) *VenueCatalog {
+	return c.withSheet(func(s *Sheet) *Sheet {
+		if s.ID != sheetID {
+			return nil
+		}
+		ns := *s
+		ns.Retired = true
+		return &ns
+	})
+}
+
+func (c *VenueCatalog) withRankPrice(venueID int64, rank string, price int64) *VenueCatalog {
+	return c.withSheet(func(s *Sheet) *Sheet {
+		if s.VenueID != venueID || s.Rank != rank {
+			return nil
+		}
+		ns := *s
+		ns.Price = price
+		return &ns
+	})
+}
+
+// newSheets numbers count new sheets after the highest number the rank has
+// ever used.
+func (c *VenueCatalog) newSheets(venueID int64, rank string, count, price int64) []*Sheet {
+	var maxNum int64
+	if v, ok := c.byID[venueID]; ok {
+		if vr, ok := v.byRank[rank]; ok {
+			for num := range vr.byNum {
+				if num > maxNum {
+					maxNum = num
+				}
+			}
+		}
+	}
+	sheets := make([]*Sheet, count)
+	for i := range sheets {
+		sheets[i] = &Sheet{
+			ID:      c.maxSheetID + int64(i) + 1,
+			VenueID: venueID,
+			Rank:    rank,
+			Num:     maxNum + int64(i) + 1,
+			Price:   price,
+		}
+	}
+	return sheets
+}
+
+func loadVenueCatalog(db *sql.DB) (*VenueCatalog, error) {
+	rows, err := db.Query("SELECT id, name FROM venues")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT id, venue_id, `rank`, num, price, retired_fg FROM sheets ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sheets []*Sheet
+	for rows.Next() {
+		var s Sheet
+		if err := rows.Scan(&s.ID, &s.VenueID, &s.Rank, &s.Num, &s.Price, &s.Retired); err != nil {
+			return nil, err
+		}
+		sheets = append(sheets, &s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newVenueCatalog(names, sheets), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrNotWaiting = errors.New("not waiting")
+
+// WaitlistEntry is a customer waiting for a sheet of a sold-out rank.
+type WaitlistEntry struct {
+	ID        int64     `json:"id"`
+	EventID   int64     `json:"-"`
+	Rank      string    `json:"sheet_rank"`
+	UserID    int64     `json:"-"`
+	CreatedAt time.Time `json:"-"`
+}
+
+type waitlistKey struct {
+	eventID int64
+	rank    string
+}
+
+// WaitlistStore keeps one first-come-first-served queue per event and rank.
+// Entries leave the queue when the customer gives up or is offered a sheet.
+// Like the other stores it hands out pointers that are never modified.
+type WaitlistStore struct {
+	mu     sync.RWMutex
+	byID   map[int64]*WaitlistEntry
+	queues map[waitlistKey][]*WaitlistEntry
+	maxID  int64
+}
+
+func newWaitlistStore() *WaitlistStore {
+	return &WaitlistStore{
+		byID:   make(map[int64]*WaitlistEntry),
+		queues: make(map[waitlistKey][]*WaitlistEntry),
+	}
+}
+
+// Replace takes over the contents of a freshly loaded store.
+func (s *WaitlistStore) Replace(other *WaitlistStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID = other.byID
+	s.queues = other.queues
+	s.maxID = other.maxID
+}
+
+func (s *WaitlistStore) add(e *WaitlistEntry) {
+	key := waitlistKey{e.EventID, e.Rank}
+	// Entries are loaded in id order and new ones get the highest id, so
+	// appending keeps every queue in the order customers joined.
+	s.queues[key] = append(s.queues[key], e)
+	s.byID[e.ID] = e
+	if e.ID > s.maxID {
+		s.maxID = e.ID
+	}
+}
+
+func (s *WaitlistStore) remove(id int64) *WaitlistEntry {
+	e, ok := s.byID[id]
+	if !ok {
+		return nil
+	}
+	delete(s.byID, id)
+	key := waitlistKey{e.EventID, e.Rank}
+	queue := s.queues[key]
+	for i, q := range queue {
+		if q.ID == id {
+			s.queues[key] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(s.queues[key]) == 0 {
+		delete(s.queues, key)
+	}
+	return e
+}
+
+// Add is for loading existing entries; new ones go through Join. An entry
+// already in the store is left alone.
+func (s *WaitlistStore) Add(e *WaitlistEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byID[e.ID]; ok {
+		return
+	}
+	s.add(e)
+}
+
+// Remove drops an entry that already left the queue. Used when replaying.
+func (s *WaitlistStore) Remove(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+}
+
+// Join puts the user at the back of the queue for the rank. Joining twice
+// returns the existing entry without persisting anything.
+func (s *WaitlistStore) Join(eventID int64, rank string, userID int64, persist func(e *WaitlistEntry) error) (*WaitlistEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.queues[waitlistKey{eventID, rank}] {
+		if e.UserID == userID {
+			return e, nil
+		}
+	}
+	e := &WaitlistEntry{
+		ID:        s.maxID + 1,
+		EventID:   eventID,
+		Rank:      rank,
+		UserID:    userID,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := persist(e); err != nil {
+		return nil, err
+	}
+	s.add(e)
+	return e, nil
+}
+
+// Leave takes the user off the queue for the rank.
+func (s *WaitlistStore) Leave(eventID int64, rank string, userID int64, persist func(e *WaitlistEntry) error) (*WaitlistEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.queues[waitlistKey{eventID, rank}] {
+		if e.UserID == userID {
+			if err := persist(e); err != nil {
+				return nil, err
+			}
+			return s.remove(e.ID), nil
+		}
+	}
+	return nil, ErrNotWaiting
+}
+
+// Take removes and returns the first entry for the rank, or nil if nobody
+// is waiting. Put it back with Restore if the offer falls through.
+func (s *WaitlistStore) Take(eventID int64, rank string) *WaitlistEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := s.queues[waitlistKey{eventID, rank}]
+	if len(queue) == 0 {
+		return nil
+	}
+	return s.remove(queue[0].ID)
+}
+
+// Restore puts an entry returned by Take back at the front of its queue.
+func (s *WaitlistStore) Restore(e *WaitlistEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := waitlistKey{e.EventID, e.Rank}
+	s.queues[key] = append([]*WaitlistEntry{e}, s.queues[key]...)
+	s.byID[e.ID] = e
+}
+
+// Position returns the user's 1-based place in the queue for the rank, or 0
+// if they are not on it.
+func (s *WaitlistStore) Position(eventID int64, rank string, userID int64) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i, e := range s.queues[waitlistKey{eventID, rank}] {
+		if e.UserID == userID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Len returns how many customers wait for the rank.
+func (s *WaitlistStore) Len(eventID int64, rank string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.queues[waitlistKey{eventID, rank}])
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrWriterBusy = errors.New("db writer queue is full")
+
+// DBWriter owns every asynchronous write to MySQL. Handlers Acquire a slot
+// before mutating memory (so a full queue turns into a 503 instead of an
+// unbounded pile of goroutines) and Enqueue the mutation afterwards; a single
+// goroutine drains the queue in batches.
+type DBWriter struct {
+	db      *sql.DB
+	journal *Journal
+
+	batchSize      int
+	flushInterval  time.Duration
+	enqueueTimeout time.Duration
+	maxRetries     int
+
+	slots chan struct{}
+	wake  chan struct{}
+	done  chan struct{}
+
+	mu       sync.Mutex
+	idle     *sync.Cond
+	queue    []*writeOp
+	inflight []*writeOp
+	closing  bool
+	// stopped is why the writer gave up on MySQL while closing. What it
+	// did not write is still in the journal.
+	stopped error
+	stats   WriterStats
+}
+
+type WriterStats struct {
+	Queued    int   `json:"queued"`
+	Inflight  int   `json:"inflight"`
+	LagMillis int64 `json:"lag_ms"`
+	Written   int64 `json:"written"`
+	Batches   int64 `json:"batches"`
+	Retries   int64 `json:"retries"`
+	Failed    int64 `json:"failed"`
+	Rejected  int64 `json:"rejected"`
+	// Dropped counts rows MySQL let go on a duplicate key although their
+	// writes went through.
+	Dropped   int64  `json:"dropped"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type writeOp struct {
+	seq        int64
+	op         string
+	data       interface{}
+	enqueuedAt time.Time
+}
+
+func newDBWriter(db *sql.DB, journal *Journal) *DBWriter {
+	w := &DBWriter{
+		db:             db,
+		journal:        journal,
+		batchSize:      GetenvInt("WRITER_BATCH_SIZE", 500),
+		flushInterval:  time.Duration(GetenvInt("WRITER_FLUSH_INTERVAL_MS", 5)) * time.Millisecond,
+		enqueueTimeout: time.Duration(GetenvInt("WRITER_ENQUEUE_TIMEOUT_MS", 1000)) * time.Millisecond,
+		maxRetries:     GetenvInt("WRITER_MAX_RETRIES", 5),
+		slots:          make(chan struct{}, GetenvInt("WRITER_QUEUE_SIZE", 10000)),
+		wake:           make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	w.idle = sync.NewCond(&w.mu)
+	go w.run()
+	return w
+}
+
+// Acquire reserves room in the queue for one write, waiting up to the
+// configured timeout. Every successful Acquire must be followed by exactly
+// one Enqueue or Release.
+func (w *DBWriter) Acquire() error {
+	select {
+	case w.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	t := time.NewTimer(w.enqueueTimeout)
+	defer t.Stop()
+	select {
+	case w.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+		w.mu.Lock()
+		w.stats.Rejected++
+		w.mu.Unlock()
+		return ErrWriterBusy
+	}
+}
+
+func (w *DBWriter) Release() {
+	<-w.slots
+}
+
+// Enqueue queues the journal record seq for MySQL. It never blocks; the room
+// was taken by Acquire.
+func (w *DBWriter) Enqueue(seq int64, op string, data interface{}) {
+	w.mu.Lock()
+	w.queue = append(w.queue, &writeOp{seq: seq, op: op, data: data, enqueuedAt: time.Now()})
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *DBWriter) Stats() WriterStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := w.stats
+	stats.Queued = len(w.queue)
+	stats.Inflight = len(w.inflight)
+	var oldest time.Time
+	if len(w.inflight) > 0 {
+		oldest = w.inflight[0].enqueuedAt
+	} else if len(w.queue) > 0 {
+		oldest = w.queue[0].enqueuedAt
+	}
+	if !oldest.IsZero() {
+		stats.LagMillis = int64(time.Since(oldest) / time.Millisecond)
+	}
+	return stats
+}
+
+// Pending counts the writes not yet in MySQL, by operation.
+func (w *DBWriter) Pending() map[string]int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pending := make(map[string]int)
+	for _, op := range w.inflight {
+		pending[op.op]++
+	}
+	for _, op := range w.queue {
+		pending[op.op]++
+	}
+	return pending
+}
+
+// Flush blocks until everything enqueued so far has been written (or has
+// permanently failed), or the writer stopped.
+func (w *DBWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for (len(w.queue) > 0 || len(w.inflight) > 0) && w.stopped == nil {
+		w.idle.Wait()
+	}
+}
+
+// Close stops accepting work and drains the queue until ctx is done or MySQL
+// cannot be reached. It returns the number of writes that were still pending
+// when it gave up.
+func (w *DBWriter) Close(ctx context.Context) (int, error) {
+	w.mu.Lock()
+	w.closing = true
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-w.done:
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.stopped != nil {
+			return len(w.queue) + len(w.inflight), w.stopped
+		}
+		return 0, nil
+	case <-ctx.Done():
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.queue) + len(w.inflight), ctx.Err()
+	}
+}
+
+func (w *DBWriter) run() {
+	defer close(w.done)
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 {
+			if w.closing {
+				w.idle.Broadcast()
+				w.mu.Unlock()
+				return
+			}
+			w.idle.Broadcast()
+			w.mu.Unlock()
+			<-w.wake
+			w.mu.Lock()
+		}
+		if len(w.queue) < w.batchSize && !w.closing {
+			w.mu.Unlock()
+			time.Sleep(w.flushInterval)
+			w.mu.Lock()
+		}
+		n := len(w.queue)
+		if n > w.batchSize {
+			n = w.batchSize
+		}
+		w.inflight = w.queue[:n:n]
+		w.queue = w.queue[n:]
+		batch := w.inflight
+		w.mu.Unlock()
+
+		failed := w.writeWithRetry(batch)
+		// Writes that failed for a transient reason are retried for as
+		// long as it takes, oldest first, so nothing later overtakes
+		// them. Only closing gives up on them, leaving them and the rest
+		// of the queue in the journal for the next start.
+		for backoff := time.Second; ; {
+			retry := unwritten(batch, failed)
+			if len(retry) == 0 {
+				break
+			}
+			w.mu.Lock()
+			if w.closing {
+				w.stopped = failed[retry[0]]
+				w.idle.Broadcast()
+				w.mu.Unlock()
+				return
+			}
+			w.mu.Unlock()
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			for _, op := range retry {
+				delete(failed, op)
+			}
+			for op, err := range w.writeWithRetry(retry) {
+				failed[op] = err
+			}
+		}
+
+		w.mu.Lock()
+		w.inflight = nil
+		w.stats.Batches++
+		w.stats.Written += int64(len(batch) - len(failed))
+		w.stats.Failed += int64(len(failed))
+		w.mu.Unlock()
+
+		for _, op := range batch {
+			if w.journal != nil {
+				w.journal.Done(op.seq, op.op, op.data, failed[op])
+			}
+			w.Release()
+		}
+	}
+}
+
+// unwritten returns the ops of batch that failed for a transient reason.
+func unwritten(batch []*writeOp, failed map[*writeOp]error) []*writeOp {
+	var ops []*writeOp
+	for _, op := range batch {
+		if err := failed[op]; err != nil && isTransientDBError(err) {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// writeWithRetry writes the batch, retrying transient errors with backoff. A
+// batch rejected outright is split so one bad row cannot sink the rest; once
+// a row fails for a transient reason the rows after it are not tried, so they
+// never reach MySQL ahead of it.
+func (w *DBWriter) writeWithRetry(batch []*writeOp) map[*writeOp]error {
+	backoff := 50 * time.Millisecond
+	var err error
+	for attempt := 0; attempt <= w.maxRetries; attempt++ {
+		if attempt > 0 {
+			w.mu.Lock()
+			w.stats.Retries++
+			w.mu.Unlock()
+			time.Sleep(backoff)
+			if backoff < 2*time.Second {
+				backoff *= 2
+			}
+		}
+		if err = w.writeBatch(batch); err == nil {
+			return nil
+		}
+		log.Println("db writer:", err)
+		w.mu.Lock()
+		w.stats.LastError = err.Error()
+		w.mu.Unlock()
+		if !isTransientDBError(err) {
+			break
+		}
+	}
+
+	failed := make(map[*writeOp]error)
+	if len(batch) == 1 || isTransientDBError(err) {
+		for _, op := range batch {
+			failed[op] = err
+		}
+		log.Printf("db writer: %d writes failed: %v", len(batch), err)
+		return failed
+	}
+	for i, op := range batch {
+		ferr := w.writeWithRetry([]*writeOp{op})[op]
+		if ferr == nil {
+			continue
+		}
+		failed[op] = ferr
+		if isTransientDBError(ferr) {
+			for _, rest := range batch[i+1:] {
+				failed[rest] = ferr
+			}
+			break
+		}
+	}
+	return failed
+}
+
+func (w *DBWriter) writeBatch(batch []*writeOp) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Inserts are collected into multi-row statements, but flushed before
+	// any other statement so MySQL sees the ops in journal order; a sheet
+	// can be canceled and reserved again within one batch.
+	var lost []lostRow
+	insert := func(table, keyExpr string, ids []int64, keys []string, query string, args ...interface{}) error {
+		l, err := insertRows(tx, table, keyExpr, ids, keys, query, args)
+		lost = append(lost, l...)
+		return err
+	}
+
+	var events []eventRecord
+	var reservations []reserveRecord
+	flush := func() error {
+		if len(events) > 0 {
+			ids := make([]int64, len(events))
+			keys := make([]string, len(events))
+			args := make([]interface{}, 0, len(events)*11)
+			for i, e := range events {
+				ids[i], keys[i] = e.ID, e.Title
+				args = append(args, e.ID, e.Title, e.PublicFg, e.ClosedFg, e.Price, e.VenueID, e.Allocation, e.Limits, e.Schedule, e.Pricing, e.Cancellation)
+			}
+			query := "INSERT INTO events (id, title, public_fg, closed_fg, price, venue_id, allocation, limits, schedule, pricing, cancellation) VALUES " + placeholders(len(events), 11) + " ON DUPLICATE KEY UPDATE id = id"
+			if err := insert("events", "title", ids, keys, query, args...); err != nil {
+				return err
+			}
+			events = nil
+		}
+		if len(reservations) > 0 {
+			ids := make([]int64, len(reservations))
+			keys := make([]string, len(reservations))
+			args := make([]interface{}, 0, len(reservations)*12)
+			for i, r := range reservations {
+				b := r.reservation().charged()
+				ids[i], keys[i] = r.ID, fmt.Sprintf("%d:%d", r.EventID, r.SheetID)
+				args = append(args, r.ID, r.EventID, r.SheetID, r.UserID, r.ReservedAt.Format("2006-01-02 15:04:05.000000"), dbTime(r.ExpiresAt), r.Price, b.Base, b.Rank, b.Adjustment, b.Discount, r.PromoCodeID)
+			}
+			query := "INSERT INTO reservations (id, event_id, sheet_id, user_id, reserved_at, expires_at, price, base_price, rank_price, adjustment, discount, promo_id) VALUES " + placeholders(len(reservations), 12) + " ON DUPLICATE KEY UPDATE id = id"
+			if err := insert("reservations", "CONCAT(event_id, ':', sheet_id)", ids, keys, query, args...); err != nil {
+				return err
+			}
+			reservations = nil
+		}
+		return nil
+	}
+
+	for _, op := range batch {
+		switch op.op {
+		case opEventCreate:
+			events = append(events, op.data.(eventRecord))
+			continue
+		case opReserve:
+			reservations = append(reservations, op.data.(reserveRecord))
+			continue
+		case opReserveBatch:
+			reservations = append(reservations, op.data.(reserveBatchRecord).Reservations...)
+			continue
+		}
+		if err := flush(); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		var err error
+		switch op.op {
+		case opCancel:
+			err = writeCancel(tx, op.data.(cancelRecord))
+		case opConfirm:
+			r := op.data.(confirmRecord)
+			args := make([]interface{}, len(r.IDs))
+			for i, id := range r.IDs {
+				args[i] = id
+			}
+			_, err = tx.Exec("UPDATE reservations SET expires_at = NULL WHERE id IN "+placeholders(1, len(r.IDs)), args...)
+		case opOffer:
+			r := op.data.(offerRecord)
+			if err = writeCancel(tx, r.Canceled); err == nil {
+				_, err = tx.Exec("DELETE FROM waitlist WHERE id = ?", r.WaitlistID)
+			}
+			reservations = append(reservations, r.Hold)
+		case opEventUpdate:
+			r := op.data.(eventRecord)
+			_, err = tx.Exec("UPDATE events SET public_fg = ?, closed_fg = ? WHERE id = ?", r.PublicFg, r.ClosedFg, r.ID)
+		case opEventSeats:
+			r := op.data.(eventRecord)
+			_, err = tx.Exec("UPDATE events SET allocation = ? WHERE id = ?", r.Allocation, r.ID)
+		case opEventLimits:
+			r := op.data.(eventRecord)
+			_, err = tx.Exec("UPDATE events SET limits = ? WHERE id = ?", r.Limits, r.ID)
+		case opEventSchedule:
+			r := op.data.(eventRecord)
+			_, err = tx.Exec("UPDATE events SET schedule = ? WHERE id = ?", r.Schedule, r.ID)
+		case opEventPricing:
+			r := op.data.(eventRecord)
+			_, err = tx.Exec("UPDATE events SET pricing = ? WHERE id = ?", r.Pricing, r.ID)
+		case opEventCancellation:
+			r := op.data.(eventRecord)
+			_, err = tx.Exec("UPDATE events SET cancellation = ? WHERE id = ?", r.Cancellation, r.ID)
+		case opActiveLimit:
+			r := op.data.(activeLimitRecord)
+			_, err = tx.Exec("INSERT INTO settings (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)", settingActiveLimit, strconv.Itoa(r.Max))
+		case opVenueCreate:
+			r := op.data.(venueRecord)
+			err = insert("venues", "name", []int64{r.ID}, []string{r.Name}, "INSERT INTO venues (id, name) VALUES (?, ?) ON DUPLICATE KEY UPDATE id = id", r.ID, r.Name)
+		case opSheetsAdd:
+			r := op.data.(sheetsRecord)
+			keys := make([]string, len(r.IDs))
+			args := make([]interface{}, 0, len(r.IDs)*5)
+			for i, s := range r.sheets() {
+				keys[i] = fmt.Sprintf("%d:%s:%d", s.VenueID, s.Rank, s.Num)
+				args = append(args, s.ID, s.VenueID, s.Rank, s.Num, s.Price)
+			}
+			err = insert("sheets", "CONCAT(venue_id, ':', `rank`, ':', num)", r.IDs, keys, "INSERT INTO sheets (id, venue_id, `rank`, num, price) VALUES "+placeholders(len(r.IDs), 5)+" ON DUPLICATE KEY UPDATE id = id", args...)
+		case opSheetRetire:
+			r := op.data.(sheetRetireRecord)
+			_, err = tx.Exec("UPDATE sheets SET retired_fg = 1 WHERE id = ?", r.ID)
+		case opRankPrice:
+			r := op.data.(rankPriceRecord)
+			_, err = tx.Exec("UPDATE sheets SET price = ? WHERE venue_id = ? AND `rank` = ?", r.Price, r.VenueID, r.Rank)
+		case opWaitlistJoin:
+			r := op.data.(waitlistRecord)
+			err = insert("waitlist", "CONCAT(event_id, ':', user_id)", []int64{r.ID}, []string{fmt.Sprintf("%d:%d", r.EventID, r.UserID)},
+				"INSERT INTO waitlist (id, event_id, `rank`, user_id, created_at) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id",
+				r.ID, r.EventID, r.Rank, r.UserID, r.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+		case opWaitlistDrop:
+			r := op.data.(waitlistDropRecord)
+			_, err = tx.Exec("DELETE FROM waitlist WHERE id = ?", r.ID)
+		case opTransitionAdd:
+			r := op.data.(transitionRecord)
+			err = insert("event_transitions", "event_id", []int64{r.ID}, []string{strconv.FormatInt(r.EventID, 10)},
+				"INSERT INTO event_transitions (id, event_id, public_fg, closed_fg, run_at, scheduled_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id",
+				r.ID, r.EventID, r.PublicFg, r.ClosedFg, r.RunAt.Format("2006-01-02 15:04:05.000000"), r.ScheduledBy, r.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+		case opTransitionEnd:
+			r := op.data.(transitionEndRecord)
+			if r.Event != nil {
+				if _, err = tx.Exec("UPDATE events SET public_fg = ?, closed_fg = ? WHERE id = ?", r.Event.PublicFg, r.Event.ClosedFg, r.Event.ID); err != nil {
+					break
+				}
+			}
+			_, err = tx.Exec("UPDATE event_transitions SET done_at = ?, canceled_fg = ?, error_message = ? WHERE id = ?",
+				r.DoneAt.Format("2006-01-02 15:04:05.000000"), r.Canceled, r.Error, r.ID)
+		case opPromoCreate:
+			r := op.data.(promoRecord)
+			err = insert("promo_codes", "code", []int64{r.ID}, []string{r.Code},
+				"INSERT INTO promo_codes (id, code, kind, value, scope, max_uses, max_uses_per_user, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id",
+				r.ID, r.Code, r.Kind, r.Value, r.Scope, r.MaxUses, r.MaxUsesPerUser, dbTime(r.ExpiresAt), r.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+		case opPromoDisable:
+			r := op.data.(promoDisableRecord)
+			_, err = tx.Exec("UPDATE promo_codes SET disabled_fg = 1 WHERE id = ?", r.ID)
+		case opTransferOffer:
+			r := op.data.(transferRecord)
+			err = insert("transfers", "reservation_id", []int64{r.ID}, []string{strconv.FormatInt(r.ReservationID, 10)},
+				"INSERT INTO transfers (id, reservation_id, event_id, from_user_id, to_user_id, created_at) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id",
+				r.ID, r.ReservationID, r.EventID, r.FromUserID, r.ToUserID, r.CreatedAt.Format("2006-01-02 15:04:05.000000"))
+		case opTransferEnd:
+			r := op.data.(transferEndRecord)
+			if r.Accepted && r.ReservationID != 0 {
+				if _, err = tx.Exec("UPDATE reservations SET user_id = ? WHERE id = ?", r.UserID, r.ReservationID); err != nil {
+					break
+				}
+			}
+			_, err = tx.Exec("UPDATE transfers SET done_at = ?, accepted_fg = ? WHERE id = ?", r.DoneAt.Format("2006-01-02 15:04:05.000000"), r.Accepted, r.ID)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := flush(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	w.reportLost(lost)
+	return nil
+}
+
+// lostRow is a row an INSERT ... ON DUPLICATE KEY UPDATE id = id let go
+// because another row held its id or one of its unique keys.
+type lostRow struct {
+	table string
+	id    int64
+	key   string
+}
+
+// writeCancel cancels a reservation and ends the transfer that was pending
+// on it.
+func writeCancel(tx *sql.Tx, r cancelRecord) error {
+	canceledAt := r.CanceledAt.Format("2006-01-02 15:04:05.000000")
+	if _, err := tx.Exec("UPDATE reservations SET canceled_at = ?, cancel_fee = ? WHERE id = ?", canceledAt, r.Fee, r.ID); err != nil || r.TransferID == 0 {
+		return err
+	}
+	_, err := tx.Exec("UPDATE transfers SET done_at = ? WHERE id = ?", canceledAt, r.TransferID)
+	return err
+}
+
+// insertRows runs such an insert of the rows with ids and, if MySQL
+// inserted fewer rows than that, looks for the ones it let go. keyExpr tells
+// a row apart besides its id and keys holds it for each of ids: a row
+// already there with the same key was written before, as replaying does,
+// and is not lost.
+func insertRows(tx *sql.Tx, table, keyExpr string, ids []int64, keys []string, query string, args []interface{}) ([]lostRow, error) {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n >= int64(len(ids)) {
+		return nil, err
+	}
+
+	idArgs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		idArgs[i] = id
+	}
+	rows, err := tx.Query("SELECT id, "+keyExpr+" FROM "+table+" WHERE id IN "+placeholders(1, len(ids)), idArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := make(map[int64]string, len(ids))
+	for rows.Next() {
+		var id int64
+		var key string
+		if err := rows.Scan(&id, &key); err != nil {
+			return nil, err
+		}
+		found[id] = key
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var lost []lostRow
+	for i, id := range ids {
+		if key, ok := found[id]; !ok || key != keys[i] {
+			lost = append(lost, lostRow{table: table, id: id, key: keys[i]})
+		}
+	}
+	return lost, nil
+}
+
+func (w *DBWriter) reportLost(lost []lostRow) {
+	if len(lost) == 0 {
+		return
+	}
+	w.mu.Lock()
+	w.stats.Dropped += int64(len(lost))
+	w.mu.Unlock()
+	for _, r := range lost {
+		log.Printf("db writer: %s row %d (%s) dropped on a duplicate key", r.table, r.id, r.key)
+	}
+}
+
+func placeholders(rows, cols int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", cols), ", ") + ")"
+	return strings.TrimSuffix(strings.Repeat(row+", ", rows), ", ")
+}
+
+func isDuplicateEntry(err error) bool {
+	me, ok := err.(*mysql.MySQLError)
+	return ok && me.Number == 1062
+}
+
+func isTransientDBError(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn || err == sql.ErrConnDone {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if me, ok := err.(*mysql.MySQLError); ok {
+		switch me.Number {
+		case 1040, // too many connections
+			1205, // lock wait timeout
+			1213, // deadlock
+			2006, // server has gone away
+			2013: // lost connection
+			return true
+		}
+	}
+	return false
+}
@@ -17,10 +17,21 @@ const Errors = {
   authentication_failed: '認証に失敗しました',
   not_found:             '存在しません',
   invalid_rank:          'そのランクを指定することはできません',
+  invalid_venue:         'その会場を指定することはできません',
+  invalid_allocation:    'その割り当て方法を指定することはできません',
+  invalid_limits:        'その購入上限を指定することはできません',
+  invalid_schedule:      'その日程を指定することはできません',
+  invalid_pricing:       'その価格設定を指定することはできません',
+  invalid_cancellation:  'そのキャンセル規定を指定することはできません',
+  invalid_promo_code:    'そのクーポンコードを指定することはできません',
+  invalid_transition:    'その予約変更を指定することはできません',
+  transition_done:       'その予約変更はすでに実行済みです',
   invalid_event:         'そのイベントを指定することはできません',
   invalid_sheet:         'そのシートを指定することはできません',
+  sheet_reserved:        'そのシートは予約されています',
   not_reserved:          'その席は予約されていません',
   not_permitted:         'その操作はできません',
+  busy:                  '混雑しています。しばらくしてから再度お試しください',
   unwknown:              '不明なエラーです',
 };
 
@@ -76,11 +87,11 @@ const API = (() => {
       },
     },
     Event: {
-      register (title, price, isPublic) {
+      register (title, price, isPublic, venueId) {
         return fetch('/admin/api/events', {
           method: 'POST',
           headers: new Headers({ 'Content-Type': 'application/json' }),
-          body: JSON.stringify({ title, price, public: isPublic }),
+          body: JSON.stringify({ title, price, public: isPublic, venue_id: venueId }),
           credentials: 'same-origin',
         }).then(handleJSON).then(handleJSONError);
       },
@@ -105,6 +116,14 @@ const API = (() => {
         }).then(handleJSON).then(handleJSONError);
       },
     },
+    Venue: {
+      getAll () {
+        return fetch('/admin/api/venues', {
+          method: 'GET',
+          credentials: 'same-origin',
+        }).then(handleJSON).then(handleJSONError);
+      },
+    },
     Report: {
       getEventSales (eventId) {
         window.open(`/admin/api/reports/events/${eventId}/sales`);
@@ -172,7 +191,7 @@ const EventModal = new Vue({
   },
   methods: {
     divRange (n ,d) {
-      const max = Math.floor(n / d);
+      const max = Math.ceil(n / d);
       const range = [];
       for (let i = 1; i <= max; i++) {
         range.push(i);
@@ -296,11 +315,23 @@ new Vue({
       title: '',
       price: 1000,
       public: 0,
+      venueId: 1,
+      venues: [],
     };
   },
+  mounted () {
+    if (DOM.appWrapper.data('administrator') === null) {
+      return;
+    }
+    API.Venue.getAll().then(venues => {
+      this.venues = venues;
+    }).catch(err => {
+      showError(err);
+    });
+  },
   methods: {
     submit () {
-      API.Event.register(this.title, this.price, this.public != 0).then(event => {
+      API.Event.register(this.title, this.price, this.public != 0, Number(this.venueId)).then(event => {
         EventList.$data.events.push(event);
         DOM.eventRegistrationModal.modal('hide');
       }).catch(err => {
@@ -21,7 +21,26 @@ const Errors = {
   invalid_event:         'そのイベントを指定することはできません',
   invalid_sheet:         'そのシートを指定することはできません',
   not_reserved:          'その席は予約されていません',
+  invalid_count:         'その枚数を指定することはできません',
+  already_reserved:      'その席はすでに予約されています',
+  hold_expired:          '仮押さえの期限が切れました',
+  not_sold_out:          'まだ空席があります',
+  not_waiting:           'キャンセル待ちに登録されていません',
+  limit_exceeded:        '購入できる枚数の上限を超えています',
+  invalid_promo_code:    'そのクーポンコードは存在しません',
+  promo_code_expired:    'そのクーポンコードは有効期限切れです',
+  promo_code_not_applicable: 'そのクーポンコードはこの席には使えません',
+  promo_code_exhausted:  'そのクーポンコードは利用上限に達しています',
+  sales_not_started:     'まだ販売開始前です',
+  sales_ended:           '販売は終了しました',
+  cancellation_closed:   'キャンセル受付は終了しました',
+  invalid_recipient:     'その譲渡先を指定することはできません',
+  transfer_pending:      'その席はすでに譲渡手続き中です',
+  transfer_done:         'その譲渡はすでに完了しています',
+  event_closed:          'イベントは終了しています',
+  invalid_reservation:   '予約の指定が正しくありません',
   not_permitted:         'その操作はできません',
+  busy:                  '混雑しています。しばらくしてから再度お試しください',
   unwknown:              '不明なエラーです',
 };
 
@@ -106,11 +125,41 @@ const API = (() => {
           credentials: 'same-origin',
         }).then(handleJSON).then(handleJSONError);
       },
-      reserveSheet (eventId, sheetRank) {
+      reserveSheet (eventId, sheetRank, count, promoCode) {
         return fetch(`/api/events/${eventId}/actions/reserve`, {
           method: 'POST',
           headers: new Headers({ 'Content-Type': 'application/json' }),
-          body: JSON.stringify({ sheet_rank: sheetRank }),
+          body: JSON.stringify({ sheet_rank: sheetRank, count: count || 1, promo_code: promoCode || '' }),
+          credentials: 'same-origin',
+        }).then(handleJSON).then(handleJSONError);
+      },
+      reserveSheetAt (eventId, sheetRank, sheetNum) {
+        return fetch(`/api/events/${eventId}/sheets/${sheetRank}/${sheetNum}/reservation`, {
+          method: 'POST',
+          headers: new Headers({ 'Content-Type': 'application/json' }),
+          body: '{}',
+          credentials: 'same-origin',
+        }).then(handleJSON).then(handleJSONError);
+      },
+      confirm (eventId, reservationIds) {
+        return fetch(`/api/events/${eventId}/actions/confirm`, {
+          method: 'POST',
+          headers: new Headers({ 'Content-Type': 'application/json' }),
+          body: JSON.stringify({ reservation_ids: reservationIds }),
+          credentials: 'same-origin',
+        }).then(handleJSON).then(handleJSONError);
+      },
+      joinWaitlist (eventId, sheetRank) {
+        return fetch(`/api/events/${eventId}/sheets/${sheetRank}/waitlist`, {
+          method: 'POST',
+          headers: new Headers({ 'Content-Type': 'application/json' }),
+          body: '{}',
+          credentials: 'same-origin',
+        }).then(handleJSON).then(handleJSONError);
+      },
+      leaveWaitlist (eventId, sheetRank) {
+        return fetch(`/api/events/${eventId}/sheets/${sheetRank}/waitlist`, {
+          method: 'DELETE',
           credentials: 'same-origin',
         }).then(handleJSON).then(handleJSONError);
       },
@@ -121,6 +170,38 @@ const API = (() => {
         }).then(handleJSON).then(handleJSONError);
       },
     },
+    Transfer: {
+      getAll () {
+        return fetch('/api/transfers', {
+          method: 'GET',
+          credentials: 'same-origin',
+        }).then(handleJSON).then(handleJSONError);
+      },
+      offer (reservationId, loginName) {
+        return fetch(`/api/reservations/${reservationId}/actions/transfer`, {
+          method: 'POST',
+          headers: new Headers({ 'Content-Type': 'application/json' }),
+          body: JSON.stringify({ login_name: loginName }),
+          credentials: 'same-origin',
+        }).then(handleJSON).then(handleJSONError);
+      },
+      accept (transferId) {
+        return fetch(`/api/transfers/${transferId}/actions/accept`, {
+          method: 'POST',
+          headers: new Headers({ 'Content-Type': 'application/json' }),
+          body: '{}',
+          credentials: 'same-origin',
+        }).then(handleJSON).then(handleJSONError);
+      },
+      cancel (transferId) {
+        return fetch(`/api/transfers/${transferId}/actions/cancel`, {
+          method: 'POST',
+          headers: new Headers({ 'Content-Type': 'application/json' }),
+          body: '{}',
+          credentials: 'same-origin',
+        }).then(handleJSON).then(handleJSONError);
+      },
+    },
   };
 })();
 
@@ -162,6 +243,16 @@ const EventList = new Vue({
   },
   methods: {
     open (eventId) { openEventModal(eventId) },
+    formatDateTime (epoch) {
+      return new Date(epoch * 1000).toLocaleString();
+    },
+    salesLabel (event) {
+      const schedule = event.schedule || {};
+      if (schedule.sales_start_at && Date.now() < schedule.sales_start_at * 1000) {
+        return this.formatDateTime(schedule.sales_start_at) + ' 販売開始';
+      }
+      return '販売終了';
+    },
   },
 });
 
@@ -171,37 +262,95 @@ const EventModal = new Vue({
     return {
       event: { sheets: { S:{}, A:{}, B:{}, C:{} } },
       ranks: ['S', 'A', 'B', 'C'],
+      count: 1,
+      promoCode: '',
     };
   },
   methods: {
     divRange (n ,d) {
-      const max = Math.floor(n / d);
+      const max = Math.ceil(n / d);
       const range = [];
       for (let i = 1; i <= max; i++) {
         range.push(i);
       }
       return range;
     },
+    formatDateTime (epoch) {
+      return new Date(epoch * 1000).toLocaleString();
+    },
     isSoldOut (sheetRank) {
-      return this.event.sheets[sheetRank].remains === 0;
+      return this.event.sheets[sheetRank].remains < this.count;
     },
     reserveSheet (sheetRank) {
-      const message = sheetRank+'席: '+this.event.sheets[sheetRank].price+'円を予約購入します。よろしいですか？';
+      const count = this.count;
+      const promoCode = this.promoCode.trim();
+      const message = sheetRank+'席: '+this.event.sheets[sheetRank].price+'円 x '+count+'枚を予約購入します。よろしいですか？';
       confirm('席の予約', message).then(() => {
         return showWaitingDialog('Processing...');
       }).then(() => {
-        return API.Event.reserveSheet(this.event.id, sheetRank);
+        return API.Event.reserveSheet(this.event.id, sheetRank, count, promoCode);
       }).then(result => {
-        const sheet = this.event.sheets[sheetRank].detail[result.sheet_num-1];
+        result.reservations.forEach(reservation => {
+          const sheet = this.event.sheets[sheetRank].detail.find(s => s.num === reservation.sheet_num);
+          sheet.reserved = true;
+          sheet.mine = true;
+          this.event.sheets[sheetRank].remains--;
+          this.event.remains--;
+        });
+        this.$forceUpdate();
+      }).catch(showError).finally(hideWaitingDialog);
+    },
+    clickSheet (sheetRank, sheetNum) {
+      const sheet = this.event.sheets[sheetRank].detail.find(s => s.num === sheetNum);
+      if (sheet.mine && sheet.held) return this.confirmSheet(sheetRank, sheetNum);
+      if (sheet.mine) return this.freeSheet(sheetRank, sheetNum);
+      if (sheet.reserved) return;
+
+      const message = sheetRank+'-'+sheet.num+'席: '+this.event.sheets[sheetRank].price+'円を予約購入します。よろしいですか？';
+      confirm('席の予約', message).then(() => {
+        return showWaitingDialog('Processing...');
+      }).then(() => {
+        return API.Event.reserveSheetAt(this.event.id, sheetRank, sheetNum);
+      }).then(() => {
         sheet.reserved = true;
         sheet.mine = true;
         this.event.sheets[sheetRank].remains--;
         this.event.remains--;
         this.$forceUpdate();
+      }).catch(err => {
+        if (err === 'already_reserved') updateEventModal(this.event.id);
+        showError(err);
+      }).finally(hideWaitingDialog);
+    },
+    confirmSheet (sheetRank, sheetNum) {
+      const sheet = this.event.sheets[sheetRank].detail.find(s => s.num === sheetNum);
+      const message = sheetRank+'-'+sheet.num+'席: '+this.event.sheets[sheetRank].price+'円の仮押さえを確定します。よろしいですか？';
+      confirm('仮押さえの確定', message).then(() => {
+        return showWaitingDialog('Processing...');
+      }).then(() => {
+        return API.Event.confirm(this.event.id, [sheet.reservation_id]);
+      }).then(() => {
+        sheet.held = false;
+        this.$forceUpdate();
+      }).catch(err => {
+        if (err === 'hold_expired') updateEventModal(this.event.id);
+        showError(err);
+      }).finally(hideWaitingDialog);
+    },
+    toggleWaitlist (sheetRank) {
+      const sheets = this.event.sheets[sheetRank];
+      const leave = sheets.waiting > 0;
+      const message = leave ? sheetRank+'席のキャンセル待ちを取り消しますか？' : sheetRank+'席のキャンセル待ちに登録します。空席が出ると仮押さえされます。';
+      confirm('キャンセル待ち', message).then(() => {
+        return showWaitingDialog('Processing...');
+      }).then(() => {
+        return leave ? API.Event.leaveWaitlist(this.event.id, sheetRank) : API.Event.joinWaitlist(this.event.id, sheetRank);
+      }).then(() => {
+        return updateEventModal(this.event.id);
       }).catch(showError).finally(hideWaitingDialog);
     },
     freeSheet (sheetRank, sheetNum) {
-      const sheet = this.event.sheets[sheetRank].detail[sheetNum-1];
+      const sheet = this.event.sheets[sheetRank].detail.find(s => s.num === sheetNum);
       if (!sheet.mine) return;
 
       const message = '予約をキャンセルしますか？: '+sheetRank+'-'+sheet.num;
@@ -259,9 +408,15 @@ const MyPageModal = new Vue({
         recent_events: [],
         recent_reservations: [],
       },
+      transfers: [],
       ranks: ['S', 'A', 'B', 'C'],
     };
   },
+  computed: {
+    pendingTransfers () {
+      return this.transfers.filter(t => t.status === 'pending');
+    },
+  },
   methods: {
     openEvent (event) {
       if (!event.public || event.closed) {
@@ -274,13 +429,47 @@ const MyPageModal = new Vue({
       const dt = new Date(epoch * 1000);
       return dt.toLocaleString();
     },
+    canTransfer (reservation) {
+      return !reservation.canceled_at && !reservation.expires_at && !reservation.event.closed;
+    },
+    offerTransfer (reservation) {
+      const loginName = window.prompt('譲渡先のログイン名を入力してください: '+reservation.sheet_rank+'-'+reservation.sheet_num);
+      if (!loginName) return;
+
+      showWaitingDialog('Processing...').then(() => {
+        return API.Transfer.offer(reservation.id, loginName);
+      }).then(() => {
+        return updateMyPageModal(this.user.id);
+      }).catch(showError).finally(hideWaitingDialog);
+    },
+    acceptTransfer (transfer) {
+      const message = transfer.from_nickname+'さんから譲渡された席を受け取りますか？: '+transfer.event_title+' '+transfer.sheet_rank+'-'+transfer.sheet_num;
+      confirm('席の受け取り', message).then(() => {
+        return showWaitingDialog('Processing...');
+      }).then(() => {
+        return API.Transfer.accept(transfer.id);
+      }).then(() => {
+        return updateMyPageModal(this.user.id);
+      }).catch(showError).finally(hideWaitingDialog);
+    },
+    cancelTransfer (transfer) {
+      const message = transfer.to_user_id === this.user.id ? '譲渡を断りますか？' : '譲渡を取り消しますか？';
+      confirm('譲渡の取り消し', message).then(() => {
+        return showWaitingDialog('Processing...');
+      }).then(() => {
+        return API.Transfer.cancel(transfer.id);
+      }).then(() => {
+        return updateMyPageModal(this.user.id);
+      }).catch(showError).finally(hideWaitingDialog);
+    },
   },
 });
 
 function updateMyPageModal(userId) {
   return new Promise((resolve, reject) => {
-    API.User.getDetails(userId).then(user => {
+    Promise.all([API.User.getDetails(userId), API.Transfer.getAll()]).then(([user, transfers]) => {
       MyPageModal.$data.user = user;
+      MyPageModal.$data.transfers = transfers;
       resolve(user);
     }).catch(reject);
   });